@@ -1,11 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// LogLocation is the time zone of the times in the TSV format, which does not
+// carry an offset. Times parsed from other formats are converted into it.
+var LogLocation = time.Local
+
+// InitLogLocation set LogLocation by an IANA time zone name such as
+// Asia/Shanghai, an empty name keeps the local time zone
+func InitLogLocation(name string) error {
+	if name == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	LogLocation = location
+	return nil
+}
+
 type AccessLog struct {
 	Hour                 string // 1
 	Year                 string // 2
@@ -62,36 +88,128 @@ func (accessLog *AccessLog) String() string {
 	return accessLogString
 }
 
+// LogTime return the time of the request in LogLocation
+func (accessLog *AccessLog) LogTime() (time.Time, error) {
+	var values [6]int
+	for i, field := range []string{accessLog.Year, accessLog.Month, accessLog.Day, accessLog.Hour, accessLog.Min, accessLog.Sec} {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad log time %q", accessLog.rawLogTimeString())
+		}
+		values[i] = value
+	}
+	t := time.Date(values[0], time.Month(values[1]), values[2], values[3], values[4], values[5], 0, LogLocation)
+	if t.Month() != time.Month(values[1]) || t.Day() != values[2] || t.Hour() != values[3] || t.Minute() != values[4] || t.Second() != values[5] {
+		return time.Time{}, fmt.Errorf("bad log time %q", accessLog.rawLogTimeString())
+	}
+	return t, nil
+}
+
+// LogTimeString return the time of the request as 2013-07-09 15:20:12, the
+// raw fields are joined as they are when they are not a valid time
 func (accessLog *AccessLog) LogTimeString() string {
-	strings := []uint8{}
-	strings = append(strings, accessLog.Year...)
-	strings = append(strings, "-"...)
-	strings = append(strings, accessLog.Month...)
-	strings = append(strings, "-"...)
-	strings = append(strings, accessLog.Day...)
-	strings = append(strings, " "...)
-	strings = append(strings, accessLog.Hour...)
-	strings = append(strings, ":"...)
-	strings = append(strings, accessLog.Min...)
-	strings = append(strings, ":"...)
-	strings = append(strings, accessLog.Sec...)
-
-	return string(strings)
+	if t, err := accessLog.LogTime(); err == nil {
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return accessLog.rawLogTimeString()
 }
 
+// LogTimeMinString return the minute of the request as 2013-07-09 15:20, which
+// is used as the field of the per minute counters and sorts as a time
 func (accessLog *AccessLog) LogTimeMinString() string {
-	strings := []uint8{}
-	strings = append(strings, accessLog.Year...)
-	strings = append(strings, "-"...)
-	strings = append(strings, accessLog.Month...)
-	strings = append(strings, "-"...)
-	strings = append(strings, accessLog.Day...)
-	strings = append(strings, " "...)
-	strings = append(strings, accessLog.Hour...)
-	strings = append(strings, ":"...)
-	strings = append(strings, accessLog.Min...)
+	if t, err := accessLog.LogTime(); err == nil {
+		return t.Format("2006-01-02 15:04")
+	}
+	raw := accessLog.rawLogTimeString()
+	return raw[:strings.LastIndex(raw, ":")]
+}
+
+func (accessLog *AccessLog) rawLogTimeString() string {
+	return accessLog.Year + "-" + accessLog.Month + "-" + accessLog.Day + " " +
+		accessLog.Hour + ":" + accessLog.Min + ":" + accessLog.Sec
+}
+
+// TypedAccessLog is the parsed form of an AccessLog. The AccessLog it is made
+// from is embedded, so String() still gives the original TSV line.
+type TypedAccessLog struct {
+	AccessLog
+	Time             time.Time
+	RemoteIP         net.IP
+	Status           int
+	Bytes            int64
+	RequestLength    int64
+	Latency          time.Duration // request_time
+	UpstreamLatency  time.Duration // upstream_response_time
+	ServerPortNumber int
+}
+
+// Typed parses the fields of an AccessLog, a field of "-" is left as zero
+func (accessLog *AccessLog) Typed() (TypedAccessLog, error) {
+	typed := TypedAccessLog{AccessLog: *accessLog}
+	var err error
+	if typed.Time, err = accessLog.LogTime(); err != nil {
+		return typed, err
+	}
+	if typed.RemoteIP = net.ParseIP(accessLog.RemoteAddr); typed.RemoteIP == nil {
+		return typed, fmt.Errorf("bad remote address %q", accessLog.RemoteAddr)
+	}
+	if typed.Status, err = atoiField("HttpCode", accessLog.HttpCode); err != nil {
+		return typed, err
+	}
+	if typed.ServerPortNumber, err = atoiField("ServerPort", accessLog.ServerPort); err != nil {
+		return typed, err
+	}
+	if typed.Bytes, err = parseIntField("BytesSent", accessLog.BytesSent); err != nil {
+		return typed, err
+	}
+	if typed.RequestLength, err = parseIntField("RequestLen", accessLog.RequestLen); err != nil {
+		return typed, err
+	}
+	if typed.Latency, err = parseSecondsField("RequestTime", accessLog.RequestTime); err != nil {
+		return typed, err
+	}
+	if typed.UpstreamLatency, err = parseSecondsField("UpstreamResponseTime", accessLog.UpstreamResponseTime); err != nil {
+		return typed, err
+	}
+	return typed, nil
+}
+
+func atoiField(name string, value string) (int, error) {
+	n, err := parseIntField(name, value)
+	return int(n), err
+}
+
+func parseIntField(name string, value string) (int64, error) {
+	if value == "-" || value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q", name, value)
+	}
+	return n, nil
+}
 
-	return string(strings)
+// parseSecondsField parses a nginx time such as 0.003, upstream_response_time
+// may hold several comma separated times when the request was retried, their
+// sum is returned
+func parseSecondsField(name string, value string) (time.Duration, error) {
+	if value == "-" || value == "" {
+		return 0, nil
+	}
+	var total time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "-" {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s %q", name, value)
+		}
+		total += time.Duration(seconds * float64(time.Second))
+	}
+	return total, nil
 }
 
 func ReadLogLines(filename string) []string {
@@ -117,123 +235,176 @@ func ReadFilenames(dirname string) []string {
 	return filenames
 }
 
-func GetLog(line string) AccessLog {
+// ReadLogFile calls line for each line of a log file, a .gz file is unzipped
+func ReadLogFile(path string, line func(line string)) error {
+	file, err := OpenLogFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := newLogScanner(file)
+	for scanner.Scan() {
+		line(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (file gzipFile) Close() error {
+	file.Reader.Close()
+	return file.file.Close()
+}
+
+// OpenLogFile opens a log file, a .gz file is unzipped as it is read
+func OpenLogFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return gzipFile{reader, file}, nil
+}
+
+func newLogScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// GetLog parses a line of the 23 columns TSV format written by String()
+func GetLog(line string) (AccessLog, error) {
 	var accessLog AccessLog
-	if line != "" {
-		fields := strings.Split(line, "\t")
-		accessLog.Hour = fields[0]
-		accessLog.Year = fields[1]
-		accessLog.Day = fields[2]
-		accessLog.Min = fields[3]
-		accessLog.RequestTime = fields[4]
-		accessLog.UpstreamResponseTime = fields[5]
-		accessLog.RemoteAddr = fields[6]
-		accessLog.UpstreamAddr = fields[7]
-		accessLog.Hostname = fields[8]
-		accessLog.Method = fields[9]
-		accessLog.RequestURI = fields[10]
-		accessLog.HttpCode = fields[11]
-		accessLog.BytesSent = fields[12]
-		accessLog.Referer = fields[13]
-		accessLog.UserAgent = fields[14]
-		accessLog.GzipRatio = fields[15]
-		accessLog.HttpXForwardedFor = fields[16]
-		accessLog.ServerAddr = fields[17]
-		accessLog.GUID = fields[18]
-		accessLog.Sec = fields[19]
-		accessLog.Month = fields[20]
-		accessLog.RequestLen = fields[21]
-		accessLog.ServerPort = fields[22]
-	}
-	return accessLog
-}
-
-func GetLogNginx(line string) AccessLog {
-	monthMap := map[string]string{"Jan": "1", "Feb": "2", "Mar": "3", "Apr": "4", "May": "5", "Jun": "6", "Jul": "7", "Aug": "8", "Sep": "9", "Oct": "10", "Nov": "11", "Dec": "12"}
-	pattern := `(\d+\.\d+|\-)` +
-		`\s` +
-		`(\d+\.\d+|\-)` +
-		`\s` +
-		`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})` +
-		`\s` +
-		`(\d+)` +
-		`\s` +
-		`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}|\-)(:(\d{1,5}))?` +
-		`\s+` +
-		`\[(\d{2})\/` +
-		`([A-Z][a-z]{2}?)\/` +
-		`(\d{4})\:` +
-		`(\d{2})\:` +
-		`(\d{2})\:` +
-		`(\d{2})` +
-		`\s+\+0800\]` +
-		`\s` +
-		`([^\s]+?)` +
-		`\s` +
-		`"` +
-		`([A-Z]+)` +
-		`\s` +
-		`([^\s]+?)` +
-		`\s` +
-		`HTTP/[0-9.]+` +
-		`"` +
-		`\s` +
-		`(\d{3})` +
-		`\s` +
-		`(\d+)` +
-		`\s` +
-		`"` +
-		`([^\"]+|\-)` +
-		`"` +
-		`\s` +
-		`"([^\"]+|\-)"` +
-		`\s` +
-		`"([^\"]+|\-)"` +
-		`\s` +
-		`"([^\"]+|\-)"` +
-		`\s` +
-		`-` +
-		`\s` +
-		`"` +
-		`(` +
-		`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})` +
-		`(:` +
-		`(\d+)?` +
-		`|\-)` +
-		`\s?` +
-		`(.+?))?` +
-		`"` +
-		`.*`
-
-	myRegexp, _ := regexp.Compile(pattern)
+	if line == "" {
+		return accessLog, fmt.Errorf("empty line")
+	}
+	fields := strings.Split(line, "\t")
+	if len(fields) != 23 {
+		return accessLog, fmt.Errorf("expect 23 fields, got %d", len(fields))
+	}
+	accessLog.Hour = fields[0]
+	accessLog.Year = fields[1]
+	accessLog.Day = fields[2]
+	accessLog.Min = fields[3]
+	accessLog.RequestTime = fields[4]
+	accessLog.UpstreamResponseTime = fields[5]
+	accessLog.RemoteAddr = fields[6]
+	accessLog.UpstreamAddr = fields[7]
+	accessLog.Hostname = fields[8]
+	accessLog.Method = fields[9]
+	accessLog.RequestURI = fields[10]
+	accessLog.HttpCode = fields[11]
+	accessLog.BytesSent = fields[12]
+	accessLog.Referer = fields[13]
+	accessLog.UserAgent = fields[14]
+	accessLog.GzipRatio = fields[15]
+	accessLog.HttpXForwardedFor = fields[16]
+	accessLog.ServerAddr = fields[17]
+	accessLog.GUID = fields[18]
+	accessLog.Sec = fields[19]
+	accessLog.Month = fields[20]
+	accessLog.RequestLen = fields[21]
+	accessLog.ServerPort = fields[22]
+	return accessLog, nil
+}
+
+var nginxLogRegexp = regexp.MustCompile(`(\d+\.\d+|\-)` +
+	`\s` +
+	`(\d+\.\d+|\-)` +
+	`\s` +
+	`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})` +
+	`\s` +
+	`(\d+)` +
+	`\s` +
+	`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}|\-)(:(\d{1,5}))?` +
+	`\s+` +
+	`\[(\d{2})\/` +
+	`([A-Z][a-z]{2}?)\/` +
+	`(\d{4})\:` +
+	`(\d{2})\:` +
+	`(\d{2})\:` +
+	`(\d{2})` +
+	`\s+([+-]\d{4})\]` +
+	`\s` +
+	`([^\s]+?)` +
+	`\s` +
+	`"` +
+	`([A-Z]+)` +
+	`\s` +
+	`([^\s]+?)` +
+	`\s` +
+	`HTTP/[0-9.]+` +
+	`"` +
+	`\s` +
+	`(\d{3})` +
+	`\s` +
+	`(\d+)` +
+	`\s` +
+	`"` +
+	`([^\"]+|\-)` +
+	`"` +
+	`\s` +
+	`"([^\"]+|\-)"` +
+	`\s` +
+	`"([^\"]+|\-)"` +
+	`\s` +
+	`"([^\"]+|\-)"` +
+	`\s` +
+	`-` +
+	`\s` +
+	`"` +
+	`(` +
+	`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})` +
+	`(:` +
+	`(\d+)?` +
+	`|\-)` +
+	`\s?` +
+	`(.+?))?` +
+	`"` +
+	`.*`)
 
+// GetLogNginx parses a line of our nginx access log
+func GetLogNginx(line string) (AccessLog, error) {
 	var accessLog AccessLog
-	if line != "" {
-		fields := myRegexp.FindSubmatch([]byte(line))
-		accessLog.Hour = string(fields[11])
-		accessLog.Year = string(fields[10])
-		accessLog.Day = string(fields[8])
-
-		accessLog.Min = string(fields[12])
-		accessLog.RequestTime = string(fields[1])
-		accessLog.UpstreamResponseTime = string(fields[2])
-		accessLog.RemoteAddr = string(fields[3])
-		accessLog.UpstreamAddr = string(fields[5])
-		accessLog.Hostname = string(fields[14])
-		accessLog.Method = string(fields[15])
-		accessLog.RequestURI = string(fields[16])
-		accessLog.HttpCode = string(fields[17])
-		accessLog.BytesSent = string(fields[18])
-		accessLog.Referer = string(fields[19])
-		accessLog.UserAgent = string(fields[20])
-		accessLog.GzipRatio = string(fields[21])
-		accessLog.HttpXForwardedFor = string(fields[22])
-		accessLog.ServerAddr = string(fields[24])
-		accessLog.GUID = string(fields[27])
-		accessLog.Sec = string(fields[13])
-		accessLog.Month = monthMap[string(fields[9])]
-		accessLog.RequestLen = string(fields[4])
-		accessLog.ServerPort = string(fields[26])
-	}
-	return accessLog
+	fields := nginxLogRegexp.FindSubmatch([]byte(line))
+	if fields == nil {
+		return accessLog, fmt.Errorf("line does not match the nginx format")
+	}
+	logTime := fmt.Sprintf("%s/%s/%s:%s:%s:%s %s", fields[8], fields[9], fields[10], fields[11], fields[12], fields[13], fields[14])
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", logTime)
+	if err != nil {
+		return accessLog, fmt.Errorf("bad log time %q", logTime)
+	}
+	setLogTime(&accessLog, t)
+	accessLog.RequestTime = string(fields[1])
+	accessLog.UpstreamResponseTime = string(fields[2])
+	accessLog.RemoteAddr = string(fields[3])
+	accessLog.UpstreamAddr = string(fields[5])
+	accessLog.Hostname = string(fields[15])
+	accessLog.Method = string(fields[16])
+	accessLog.RequestURI = string(fields[17])
+	accessLog.HttpCode = string(fields[18])
+	accessLog.BytesSent = string(fields[19])
+	accessLog.Referer = string(fields[20])
+	accessLog.UserAgent = string(fields[21])
+	accessLog.GzipRatio = string(fields[22])
+	accessLog.HttpXForwardedFor = string(fields[23])
+	accessLog.ServerAddr = string(fields[25])
+	accessLog.GUID = string(fields[28])
+	accessLog.RequestLen = string(fields[4])
+	accessLog.ServerPort = string(fields[27])
+	return accessLog, nil
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"testing"
+	"time"
 )
 
 func TestString(t *testing.T) {
@@ -30,7 +32,10 @@ func TestString(t *testing.T) {
 	accessLog.RequestLen = "22"
 	accessLog.ServerPort = "23"
 	accessLogString := accessLog.String()
-	newAccessLog := GetLog(accessLogString)
+	newAccessLog, err := GetLog(accessLogString)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if newAccessLog != accessLog {
 		t.Errorf("String() is not a correct method")
 		t.Errorf("%s len: %d", accessLogString, len(accessLogString))
@@ -46,7 +51,47 @@ func TestRequestTimeString(t *testing.T) {
 	accesslog.Min = "20"
 	accesslog.Sec = "12"
 	strings := accesslog.LogTimeString()
-	if strings != "2013-7-9 15:20:12" {
+	if strings != "2013-07-09 15:20:12" {
 		t.Errorf("%s len: %d", strings, len(strings))
 	}
 }
+
+func TestTyped(t *testing.T) {
+	line := "15\t2013\t09\t20\t0.103\t0.100, 0.003\t10.0.0.1\t10.0.0.2:80\tXXX.XXX.com\tGET\t/prop/view/1\t200\t295\t-\tMozilla/5.0\t-\t-\t10.0.0.3\t-\t12\t07\t1482\t80"
+	accessLog, err := GetLog(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed, err := accessLog.Typed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typed.Time != time.Date(2013, 7, 9, 15, 20, 12, 0, LogLocation) || !typed.RemoteIP.Equal(net.ParseIP("10.0.0.1")) ||
+		typed.Status != 200 || typed.Bytes != 295 || typed.RequestLength != 1482 || typed.ServerPortNumber != 80 ||
+		typed.Latency != 103*time.Millisecond || typed.UpstreamLatency != 103*time.Millisecond {
+		t.Errorf("wrong typed fields: %+v", typed)
+	}
+	if typed.String() != line {
+		t.Errorf("typed log is not the same line: %s", typed.String())
+	}
+	if minute := accessLog.LogTimeMinString(); minute != "2013-07-09 15:20" {
+		t.Errorf("wrong minute: %s", minute)
+	}
+
+	accessLog.Month = "13"
+	if _, err := accessLog.Typed(); err == nil {
+		t.Errorf("month 13 should be an error")
+	}
+}
+
+func TestMalformedLine(t *testing.T) {
+	if _, err := GetLog("15\t2013\t09"); err == nil {
+		t.Errorf("GetLog should fail on a truncated line")
+	}
+	if _, err := GetLog(""); err == nil {
+		t.Errorf("GetLog should fail on an empty line")
+	}
+	if _, err := GetLogNginx("GET / HTTP/1.1"); err == nil {
+		t.Errorf("GetLogNginx should fail on a foreign line")
+	}
+}
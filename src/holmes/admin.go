@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditList    = "AdminAudit"
+	auditListMax = 100000
+	ignoreList   = "IgnoreList"
+)
+
+// AdminRequest is the body of the admin API. Target is an IP or a CIDR such
+// as 10.0.0.0/8, User and Reason are kept in the audit log.
+type AdminRequest struct {
+	Target string
+	User   string
+	Reason string
+	TTL    int64  // seconds of a ban, 0 is for ever
+	As     string // human or robot, for /api/admin/resolve
+}
+
+// AuditEntry is a change made by the admin API, kept in the AdminAudit list
+type AuditEntry struct {
+	Time   string
+	User   string
+	Remote string // address of the client of the API
+	Action string // such as white/add or resolve
+	Target string
+	Reason string
+	Result string `json:",omitempty"`
+}
+
+// handleAdmin serves the admin API, which is off when AdminToken is "". POST
+// /api/admin/<list>/add and /api/admin/<list>/remove change the white, black
+// or ignore list, POST /api/admin/resolve resolves the watching list of an IP
+// As human or robot, and GET /api/admin/audit?limit=100 return the latest
+// changes. A request needs the header Authorization: Bearer <AdminToken>.
+func (api *API) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if api.adminToken == "" {
+		writeError(w, http.StatusForbidden, fmt.Errorf("the admin API is off, set AdminToken to turn it on"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+api.adminToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("a valid Authorization: Bearer <AdminToken> header is needed"))
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/api/admin/")
+	if action == "audit" {
+		onlyMethod("GET", api.getAudit)(w, r)
+		return
+	}
+	onlyMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		var request AdminRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if request.User == "" || request.Reason == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("User and Reason are needed for the audit log"))
+			return
+		}
+		entry := AuditEntry{
+			Time:   time.Now().In(LogLocation).Format("2006-01-02 15:04:05"),
+			User:   request.User,
+			Remote: r.RemoteAddr,
+			Action: action,
+			Reason: request.Reason,
+		}
+		status, result, err := api.admin(action, &request)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		entry.Target, entry.Result = request.Target, result
+		if err := RecordAudit(api.conns.Lists, entry); err != nil {
+			// the change is made, say so even if it could not be audited
+			log.Println("(Admin) audit log: ", err)
+		}
+		log.Println("(Admin) ", entry.User, " ", entry.Action, " ", entry.Target, ": ", entry.Reason)
+		writeJSON(w, http.StatusOK, entry)
+	})(w, r)
+}
+
+// admin makes the change of action, Target is normalized
+func (api *API) admin(action string, request *AdminRequest) (int, string, error) {
+	target, isCIDR, err := ParseTarget(request.Target)
+	if err != nil {
+		return http.StatusBadRequest, "", err
+	}
+	request.Target = target
+	lists := api.conns.Lists
+	switch action {
+	case "white/add":
+		// an IP white listed by hand is never swept
+		if isCIDR {
+			err = ChangeCIDRList(lists, "WhiteList", target, true)
+		} else {
+			_, err = lists.SortedSetAdd("WhiteList", math.Inf(1), target)
+		}
+	case "white/remove":
+		if isCIDR {
+			err = ChangeCIDRList(lists, "WhiteList", target, false)
+		} else {
+			_, err = lists.SortedSetRem("WhiteList", target)
+		}
+	case "black/add":
+		if request.TTL < 0 {
+			return http.StatusBadRequest, "", fmt.Errorf("TTL must not be negative")
+		}
+		err = AddBlackList(lists, target, "by "+request.User+": "+request.Reason, "", time.Duration(request.TTL)*time.Second)
+	case "black/remove":
+		err = DelBlackList(lists, target)
+	case "ignore/add":
+		if isCIDR {
+			err = ChangeCIDRList(lists, ignoreList, target, true)
+		} else {
+			_, err = lists.SetAdd(ignoreList, target)
+		}
+	case "ignore/remove":
+		if isCIDR {
+			err = ChangeCIDRList(lists, ignoreList, target, false)
+		} else {
+			_, err = lists.SetRem(ignoreList, target)
+		}
+	case "resolve":
+		if isCIDR {
+			return http.StatusBadRequest, "", fmt.Errorf("resolve needs an IP, got %s", target)
+		}
+		if request.As != "human" && request.As != "robot" {
+			return http.StatusBadRequest, "", fmt.Errorf("As must be human or robot, got %q", request.As)
+		}
+		var records []WatchedRecord
+		records, err = ForceResolveWatchingList(api.conns, target, request.As == "human")
+		logRedisError("Admin", PushWatchedRecords(api.conns, records))
+		if err == ErrWatchingClaimed {
+			return http.StatusConflict, "", fmt.Errorf("the watching list of %s is being resolved by a filter, try again later", target)
+		}
+		if err == nil {
+			return http.StatusOK, fmt.Sprintf("%d records resolved as %s", len(records), request.As), nil
+		}
+	default:
+		return http.StatusNotFound, "", fmt.Errorf("unknown admin action %q", action)
+	}
+	if err != nil {
+		return http.StatusBadGateway, "", err
+	}
+	return http.StatusOK, "", nil
+}
+
+// ParseTarget return an IP, or a CIDR with its host bits cleared
+func ParseTarget(target string) (string, bool, error) {
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return "", true, fmt.Errorf("%q is not a CIDR", target)
+		}
+		return network.String(), true, nil
+	}
+	ip := net.ParseIP(target)
+	if ip == nil && strings.HasPrefix(strings.ToUpper(target), "AS") {
+		return "", false, fmt.Errorf("%q is not an IP or a CIDR, add the networks of an AS as CIDRs", target)
+	}
+	if ip == nil {
+		return "", false, fmt.Errorf("%q is not an IP or a CIDR", target)
+	}
+	return ip.String(), false, nil
+}
+
+// ForceResolveWatchingList claims the watching list of ip and takes all its
+// records as human or robot, the counters are adjusted as ResolveWatchingList
+// does. A human IP is white listed. ErrWatchingClaimed is returned when a
+// filter is resolving the list.
+func ForceResolveWatchingList(conns *FilterConns, ip string, human bool) ([]WatchedRecord, error) {
+	claimed, ok, err := claimWatchingList(conns, ip)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]WatchedRecord, 0, len(claimed))
+	for _, watchAccesslog := range claimed {
+		logTimeMin := watchAccesslog.LogTimeMinString()
+		verdict := Verdict{Result: NO, Class: BadRobot, Reason: "admin", Confidence: 1}
+		if human {
+			verdict.Result, verdict.Class = YES, Human
+			conns.Counters.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
+			conns.Counters.HashIncrby("accesslog_result_vppv_admin_human_per_min", logTimeMin, 1)
+		} else {
+			conns.Counters.HashIncrby("accesslog_result_vppv_admin_robot_per_min", logTimeMin, 1)
+		}
+		conns.Counters.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, -1)
+		Reclassify(conns.Counters, logTimeMin, Unclassified, verdict.Class)
+		records = append(records, WatchedRecord{AccessLog: watchAccesslog, Verdict: verdict})
+	}
+	if human {
+		if err := TouchWhiteList(conns.Lists, ip, time.Now()); err != nil {
+			return records, err
+		}
+	}
+	if !ok {
+		// there was nothing to claim
+		return records, nil
+	}
+	return records, finishWatchingClaim(conns, ip)
+}
+
+// RecordAudit keeps entry in the AdminAudit list, the newest first
+func RecordAudit(redisConn *RedisConn, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("LPUSH", auditList, string(data)),
+		NewRedisCmd("LTRIM", auditList, 0, auditListMax-1),
+	})
+	return err
+}
+
+func (api *API) getAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit %q is not a positive number", value))
+			return
+		}
+	}
+	lines, err := api.conns.Lists.ListRange(auditList, 0, limit-1)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	entries := make([]AuditEntry, 0, len(lines))
+	for _, line := range lines {
+		var entry AuditEntry
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
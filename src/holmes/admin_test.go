@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	do := func(api *API, method string, url string, token string, body string, v interface{}) int {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Errorf("%s: %s", url, err)
+			}
+		}
+		return w.Code
+	}
+	if code := do(NewAPI(&FilterConns{}, nil, ""), "POST", "/api/admin/white/add", "", "{}", nil); code != http.StatusForbidden {
+		t.Errorf("admin API without AdminToken got %d", code)
+	}
+
+	api := NewAPI(&FilterConns{}, nil, "secret")
+	var entry AuditEntry
+	body := `{"Target":"10.1.2.3/24","User":"alice","Reason":"office network"}`
+	if code := do(api, "POST", "/api/admin/white/add", "secret", body, &entry); code != http.StatusOK ||
+		entry.Target != "10.1.2.0/24" || entry.User != "alice" || entry.Action != "white/add" {
+		t.Errorf("white/add got %d %+v", code, entry)
+	}
+	body = `{"Target":"10.0.0.1","User":"alice","Reason":"checked by hand","As":"human"}`
+	if code := do(api, "POST", "/api/admin/resolve", "secret", body, &entry); code != http.StatusOK || entry.Result != "0 records resolved as human" {
+		t.Errorf("resolve got %d %+v", code, entry)
+	}
+	var entries []AuditEntry
+	if code := do(api, "GET", "/api/admin/audit", "secret", "", &entries); code != http.StatusOK {
+		t.Errorf("audit got %d", code)
+	}
+
+	for _, c := range []struct {
+		method string
+		url    string
+		token  string
+		body   string
+		code   int
+	}{
+		{"POST", "/api/admin/white/add", "", `{"Target":"10.0.0.1","User":"a","Reason":"b"}`, http.StatusUnauthorized},
+		{"POST", "/api/admin/white/add", "wrong", `{"Target":"10.0.0.1","User":"a","Reason":"b"}`, http.StatusUnauthorized},
+		{"GET", "/api/admin/white/add", "secret", "", http.StatusMethodNotAllowed},
+		{"POST", "/api/admin/white/add", "secret", `{"Target":"10.0.0.1"}`, http.StatusBadRequest},
+		{"POST", "/api/admin/white/add", "secret", `{"Target":"www.anjuke.com","User":"a","Reason":"b"}`, http.StatusBadRequest},
+		{"POST", "/api/admin/black/add", "secret", `{"Target":"10.0.0.1","User":"a","Reason":"b","TTL":-1}`, http.StatusBadRequest},
+		{"POST", "/api/admin/resolve", "secret", `{"Target":"10.0.0.0/8","User":"a","Reason":"b","As":"human"}`, http.StatusBadRequest},
+		{"POST", "/api/admin/resolve", "secret", `{"Target":"10.0.0.1","User":"a","Reason":"b","As":"maybe"}`, http.StatusBadRequest},
+		{"POST", "/api/admin/grey/add", "secret", `{"Target":"10.0.0.1","User":"a","Reason":"b"}`, http.StatusNotFound},
+	} {
+		var apiErr apiError
+		if code := do(api, c.method, c.url, c.token, c.body, &apiErr); code != c.code || apiErr.Error == "" {
+			t.Errorf("%s %s %s got %d %+v", c.method, c.url, c.body, code, apiErr)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		want   string
+		isCIDR bool
+	}{
+		{" 10.0.0.1 ", "10.0.0.1", false},
+		{"10.0.0.1/8", "10.0.0.0/8", true},
+		{"2001:DB8::1", "2001:db8::1", false},
+		{"2001:db8::1/32", "2001:db8::/32", true},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8", true},
+	} {
+		if target, isCIDR, err := ParseTarget(c.target); err != nil || target != c.want || isCIDR != c.isCIDR {
+			t.Errorf("%q got %q %v %v", c.target, target, isCIDR, err)
+		}
+	}
+	for _, target := range []string{"", "10.0.0.256", "10.0.0.0/33", "localhost", "AS15169"} {
+		if _, _, err := ParseTarget(target); err == nil {
+			t.Errorf("%q is accepted", target)
+		}
+	}
+}
+
+func TestWhiteListByHand(t *testing.T) {
+	db := NewMemoryRedis()
+	conns := &FilterConns{Lists: db.Conn(), Counters: NewMemoryCounterBatch()}
+	api := NewAPI(conns, nil, "secret")
+	r := httptest.NewRequest("POST", "/api/admin/white/add", strings.NewReader(`{"Target":"10.0.0.1","User":"alice","Reason":"office"}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("white/add got %d %s", w.Code, w.Body.String())
+	}
+
+	// the records of the IP and a resolve as human keep it white for ever
+	accesslog := AccessLog{RemoteAddr: "10.0.0.1"}
+	AddWhiteList(conns.Lists, &accesslog)
+	if _, err := ForceResolveWatchingList(conns, "10.0.0.1", true); err != nil {
+		t.Fatal(err)
+	}
+	accesslog.RemoteAddr = "10.0.0.2"
+	AddWhiteList(conns.Lists, &accesslog)
+	if score := db.Do("ZSCORE", "WhiteList", "10.0.0.1"); string(score.([]byte)) != "inf" {
+		t.Errorf("the IP white listed by hand has the score %s", score)
+	}
+	if swept, err := SweepWhiteList(conns.Lists, time.Now().Add(time.Hour)); err != nil || swept != 1 {
+		t.Errorf("the sweep removed %d %v", swept, err)
+	}
+}
+
+func TestTouchWhiteScript(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"touchWhite new", [][]interface{}{{"ZADD", "WhiteList", 100, "10.0.0.2"}}, touchWhiteScript, []interface{}{"WhiteList", 200, "10.0.0.1"}},
+		{"touchWhite seen", [][]interface{}{{"ZADD", "WhiteList", 100, "10.0.0.1"}}, touchWhiteScript, []interface{}{"WhiteList", 200, "10.0.0.1"}},
+		{"touchWhite by hand", [][]interface{}{{"ZADD", "WhiteList", "+inf", "10.0.0.1"}}, touchWhiteScript, []interface{}{"WhiteList", 200, "10.0.0.1"}},
+	})
+}
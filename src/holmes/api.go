@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiMaxMinutes       = 7 * 24 * 60 // minutes a counter query can cover
+	apiDefaultMinutes   = 60
+	apiPendingRecords   = 20 // records of a watching list shown by /api/ip/
+	apiDefaultUAFamily  = 20
+	uaStatisticCounter  = "accesslog_result_ua_statistic"
+	apiShutdownDeadline = 5 * time.Second
+)
+
+// API serves the state of holmes as JSON. GET /api/ip/<ip> return the lists
+// an IP is in, GET /api/counters?name=<hash>&from=<minute>&to=<minute> the per
+// minute counters, with minutes like 2013-07-09 15:20, and
+// GET /api/ua_families?limit=20 the most seen UA families. The admin API is
+// under /api/admin/.
+type API struct {
+	conns      *FilterConns // the lists, and the counters changed by the admin API
+	counters   *RedisConn   // RedisConfs[2], to read the counters
+	adminToken string
+	mux        *http.ServeMux
+}
+
+func NewAPI(conns *FilterConns, counters *RedisConn, adminToken string) *API {
+	api := &API{conns: conns, counters: counters, adminToken: adminToken, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/api/ip/", onlyMethod("GET", api.getIP))
+	api.mux.HandleFunc("/api/counters", onlyMethod("GET", api.getCounters))
+	api.mux.HandleFunc("/api/ua_families", onlyMethod("GET", api.getUAFamilies))
+	api.mux.HandleFunc("/api/admin/", api.handleAdmin)
+	return api
+}
+
+func onlyMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// ServeAPI serves the API on HTTPListen until stop is closed, it return at
+// once if HTTPListen is ""
+func ServeAPI(holmesConfig HolmesConfig, stop <-chan struct{}) {
+	if holmesConfig.HTTPListen == "" {
+		return
+	}
+	conns := &FilterConns{
+		Lists:    NewRedisConn(holmesConfig.RedisConfs[1]),
+		Counters: NewCounterBatch(holmesConfig.RedisConfs[2], CounterFlushInterval(holmesConfig)),
+	}
+	defer conns.Close()
+	counters := NewRedisConn(holmesConfig.RedisConfs[2])
+	defer counters.Close()
+	api := NewAPI(conns, counters, holmesConfig.AdminToken)
+	server := &http.Server{Addr: holmesConfig.HTTPListen, Handler: api}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("(ServeAPI) ", err)
+		}
+	}()
+	select {
+	case <-stop:
+	case <-done:
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownDeadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("(ServeAPI) ", err)
+	}
+	<-done
+}
+
+type apiError struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(apiError{err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+// IPStatus is the state of an IP in the lists, Status is black, white,
+// watching or none, the first list the IP is in by itself or by a CIDR
+type IPStatus struct {
+	IP           string
+	Status       string
+	Black        *BlackListEntry     `json:",omitempty"` // of the IP, or of the narrowest banned CIDR
+	Networks     map[string][]string `json:",omitempty"` // the CIDRs of each list which contain the IP
+	WhiteSeen    string              `json:",omitempty"` // last seen in the WhiteList, forever if white listed by hand
+	WatchingSeen string              `json:",omitempty"` // last seen in the WatchingList
+	Watching     int64               // records of WL_<ip> waiting for a verdict
+	Pending      []string            // the latest of them
+	Referers     []string            // Referer_<ip>
+}
+
+func (api *API) getIP(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(r.URL.Path, "/api/ip/")
+	if net.ParseIP(ip) == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%q is not an IP", ip))
+		return
+	}
+	status, err := GetIPStatus(api.conns.Lists, ip, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// GetIPStatus looks an IP up in the black, white, watching and referer lists
+func GetIPStatus(redisConn *RedisConn, ip string, now time.Time) (IPStatus, error) {
+	status := IPStatus{IP: ip, Status: "none", Pending: []string{}, Referers: []string{}}
+	replies, err := redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("ZSCORE", blackListKey, ip),
+		NewRedisCmd("HGET", blackListInfoKey, ip),
+		NewRedisCmd("ZSCORE", "WhiteList", ip),
+		NewRedisCmd("ZSCORE", "WatchingList", ip),
+		NewRedisCmd("LLEN", "WL_"+ip),
+		NewRedisCmd("LRANGE", "WL_"+ip, 0, apiPendingRecords-1),
+		NewRedisCmd("SMEMBERS", "Referer_"+ip),
+	})
+	if err != nil || len(replies) < 7 {
+		return status, err
+	}
+	seen := func(reply interface{}) string {
+		score, err := redisFloat(reply)
+		if reply == nil || err != nil {
+			return ""
+		}
+		if math.IsInf(score, 1) {
+			return "forever"
+		}
+		return time.Unix(int64(score), 0).In(LogLocation).Format("2006-01-02 15:04:05")
+	}
+	if expire, err := redisFloat(replies[0]); err == nil && replies[0] != nil && expire > float64(now.Unix()) {
+		status.Status = "black"
+		status.Black = &BlackListEntry{IP: ip}
+		if data, err := nullableString(replies[1], nil); err == nil && data != "" {
+			json.Unmarshal([]byte(data), status.Black)
+		}
+	}
+	for _, list := range cidrListKeys {
+		for _, network := range cidrLists.Matches(list, ip) {
+			if list == blackListKey && network.Score <= float64(now.Unix()) {
+				continue
+			}
+			if status.Networks == nil {
+				status.Networks = map[string][]string{}
+			}
+			status.Networks[list] = append(status.Networks[list], network.Network)
+		}
+	}
+	if banned := status.Networks[blackListKey]; status.Status == "none" && len(banned) > 0 {
+		status.Status = "black"
+		entry, _, err := GetBlackListEntry(redisConn, banned[len(banned)-1])
+		if err != nil {
+			return status, err
+		}
+		status.Black = &entry
+	}
+	status.WhiteSeen = seen(replies[2])
+	status.WatchingSeen = seen(replies[3])
+	if status.Status == "none" && (status.WhiteSeen != "" || len(status.Networks["WhiteList"]) > 0) {
+		status.Status = "white"
+	}
+	if status.Status == "none" && status.WatchingSeen != "" {
+		status.Status = "watching"
+	}
+	status.Watching, _ = redisInt64(replies[4], nil)
+	if pending, err := stringSlice(replies[5], nil); err == nil {
+		status.Pending = pending
+	}
+	if referers, err := stringSlice(replies[6], nil); err == nil {
+		sort.Strings(referers)
+		status.Referers = referers
+	}
+	return status, nil
+}
+
+// redisFloat converts a bulk reply of a score
+func redisFloat(reply interface{}) (float64, error) {
+	if reply == nil {
+		return 0, nil
+	}
+	score, err := nullableString(reply, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(score, 64)
+}
+
+// CounterSeries are per minute counters over a range of minutes, a count is 0
+// when the minute has no field
+type CounterSeries struct {
+	From     string
+	To       string
+	Minutes  []string
+	Counters map[string][]int64
+}
+
+func (api *API) getCounters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	names := query["name"]
+	if len(names) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is missing, such as name=accesslog_result_total_request_per_min"))
+		return
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, "_per_min") {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not a per minute counter", name))
+			return
+		}
+	}
+	minutes, err := minuteRange(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	series, err := GetCounterSeries(api.counters, names, minutes)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+// minuteRange return the minutes from from to to, both included. The default
+// range is the last hour until now.
+func minuteRange(from string, to string, now time.Time) ([]string, error) {
+	const layout = "2006-01-02 15:04"
+	end := now.In(LogLocation).Truncate(time.Minute)
+	var err error
+	if to != "" {
+		if end, err = time.ParseInLocation(layout, to, LogLocation); err != nil {
+			return nil, fmt.Errorf("to %q is not like 2013-07-09 15:20", to)
+		}
+	}
+	start := end.Add(-(apiDefaultMinutes - 1) * time.Minute)
+	if from != "" {
+		if start, err = time.ParseInLocation(layout, from, LogLocation); err != nil {
+			return nil, fmt.Errorf("from %q is not like 2013-07-09 15:20", from)
+		}
+	}
+	if start.After(end) {
+		return nil, fmt.Errorf("from %s is after to %s", start.Format(layout), end.Format(layout))
+	}
+	if end.Sub(start) >= apiMaxMinutes*time.Minute {
+		return nil, fmt.Errorf("the range is longer than %d minutes", apiMaxMinutes)
+	}
+	minutes := []string{}
+	for t := start; !t.After(end); t = t.Add(time.Minute) {
+		minutes = append(minutes, t.Format(layout))
+	}
+	return minutes, nil
+}
+
+// GetCounterSeries reads the minutes of the counter hashes
+func GetCounterSeries(redisConn *RedisConn, names []string, minutes []string) (CounterSeries, error) {
+	series := CounterSeries{From: minutes[0], To: minutes[len(minutes)-1], Minutes: minutes, Counters: map[string][]int64{}}
+	for _, name := range names {
+		values, err := redisConn.HashMultiGet(name, minutes...)
+		if err != nil {
+			return series, err
+		}
+		counts := make([]int64, len(minutes))
+		for i, value := range values {
+			if value != "" {
+				counts[i], _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		series.Counters[name] = counts
+	}
+	return series, nil
+}
+
+// UAFamilyCount is a UA family of accesslog_result_ua_statistic
+type UAFamilyCount struct {
+	Family string
+	Count  int64
+	Share  float64 // of the records of all the families
+}
+
+func (api *API) getUAFamilies(w http.ResponseWriter, r *http.Request) {
+	limit := apiDefaultUAFamily
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit %q is not a positive number", value))
+			return
+		}
+	}
+	families, err := TopUAFamilies(api.counters, limit)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, families)
+}
+
+// TopUAFamilies return the limit most seen UA families, the most seen first
+func TopUAFamilies(redisConn *RedisConn, limit int) ([]UAFamilyCount, error) {
+	statistic, err := redisConn.HashGetAll(uaStatisticCounter)
+	if err != nil {
+		return nil, err
+	}
+	families := make([]UAFamilyCount, 0, len(statistic))
+	var total int64
+	for family, value := range statistic {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		total += count
+		families = append(families, UAFamilyCount{Family: family, Count: count})
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if families[i].Count != families[j].Count {
+			return families[i].Count > families[j].Count
+		}
+		return families[i].Family < families[j].Family
+	})
+	if len(families) > limit {
+		families = families[:limit]
+	}
+	for i := range families {
+		families[i].Share = float64(families[i].Count) / float64(total)
+	}
+	return families, nil
+}
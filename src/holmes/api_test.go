@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	LogLocation = time.UTC
+	defer func() { LogLocation = time.Local }()
+	api := NewAPI(&FilterConns{}, nil, "")
+	get := func(method string, url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Errorf("%s: %s", url, err)
+			}
+		}
+		return w.Code
+	}
+
+	var status IPStatus
+	if code := get("GET", "/api/ip/10.0.0.1", &status); code != http.StatusOK || status.Status != "none" || status.IP != "10.0.0.1" {
+		t.Errorf("ip got %d %+v", code, status)
+	}
+	var series CounterSeries
+	url := "/api/counters?name=accesslog_result_total_request_per_min&from=2013-07-09+15:20&to=2013-07-09+15:22"
+	if code := get("GET", url, &series); code != http.StatusOK || len(series.Minutes) != 3 || series.Minutes[2] != "2013-07-09 15:22" ||
+		len(series.Counters["accesslog_result_total_request_per_min"]) != 3 {
+		t.Errorf("counters got %d %+v", code, series)
+	}
+	var families []UAFamilyCount
+	if code := get("GET", "/api/ua_families", &families); code != http.StatusOK || len(families) != 0 {
+		t.Errorf("ua_families got %d %+v", code, families)
+	}
+
+	for _, c := range []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"GET", "/api/ip/anjuke.com", http.StatusBadRequest},
+		{"POST", "/api/ip/10.0.0.1", http.StatusMethodNotAllowed},
+		{"GET", "/api/counters", http.StatusBadRequest},
+		{"GET", "/api/counters?name=WhiteList", http.StatusBadRequest},
+		{"GET", "/api/counters?name=a_per_min&from=2013-07-09+15:20&to=2013-07-09+15:00", http.StatusBadRequest},
+		{"GET", "/api/counters?name=a_per_min&from=2013-07-01+15:20&to=2013-07-09+15:20", http.StatusBadRequest},
+		{"GET", "/api/ua_families?limit=0", http.StatusBadRequest},
+	} {
+		var apiErr apiError
+		if code := get(c.method, c.url, &apiErr); code != c.code || apiErr.Error == "" {
+			t.Errorf("%s %s got %d %+v", c.method, c.url, code, apiErr)
+		}
+	}
+
+	// the default range is the last hour
+	minutes, err := minuteRange("", "", time.Date(2013, 7, 9, 15, 20, 30, 0, time.UTC))
+	if err != nil || len(minutes) != 60 || minutes[0] != "2013-07-09 14:21" || minutes[59] != "2013-07-09 15:20" {
+		t.Errorf("default range got %v %v", minutes, err)
+	}
+}
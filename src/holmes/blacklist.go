@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The blacklist is kept in RedisConfs[1]: BlackList is a sorted set of the
+// banned IPs scored by the unix time their ban expires (+inf for ever), and
+// BlackListInfo is a hash of the BlackListEntry of each IP. A banned CIDR is
+// also kept in the BlackListCIDR set.
+// Each change is published on BlackListChanged with the IP.
+const (
+	blackListKey     = "BlackList"
+	blackListInfoKey = "BlackListInfo"
+	blackListChannel = "BlackListChanged"
+)
+
+// BlackListEntry is why and until when an IP is banned
+type BlackListEntry struct {
+	IP     string
+	Reason string
+	Rule   string // the ban rule, or "" when banned by hand
+	Since  string
+	Expire string // "" when the ban does not expire
+}
+
+// BanRuleConf declares in holmes.conf when an IP is banned automatically
+type BanRuleConf struct {
+	Name string
+	// watching_size: the watching list of the IP is longer than Threshold
+	// no: the IP got more than Threshold NO within Window seconds, counting
+	// the NO decided by the filter rules in Rules (all the rules if empty)
+	Trigger   string
+	Threshold int64
+	Window    int64    // seconds, for the no trigger
+	Rules     []string // filter rules of the no trigger
+	TTL       int64    // seconds the IP is banned, 0 is for ever
+}
+
+// BanRule is a compiled BanRuleConf
+type BanRule struct {
+	BanRuleConf
+	rules map[string]bool
+}
+
+type BanRules []*BanRule
+
+// NewBanRules checks the ban rules against the filter rules they count
+func NewBanRules(confs []BanRuleConf, filterRules RulePipeline) (BanRules, error) {
+	names := map[string]bool{}
+	for _, rule := range filterRules {
+		names[rule.name] = true
+	}
+	banRules := make(BanRules, 0, len(confs))
+	for i, conf := range confs {
+		if conf.Name == "" {
+			return nil, fmt.Errorf("ban rule %d has no name", i)
+		}
+		if conf.Threshold <= 0 {
+			return nil, fmt.Errorf("ban rule %s: Threshold must be positive", conf.Name)
+		}
+		banRule := &BanRule{BanRuleConf: conf, rules: map[string]bool{}}
+		switch conf.Trigger {
+		case "watching_size":
+		case "no":
+			if conf.Window <= 0 {
+				return nil, fmt.Errorf("ban rule %s: Window must be positive", conf.Name)
+			}
+			for _, name := range conf.Rules {
+				if !names[name] {
+					return nil, fmt.Errorf("ban rule %s: unknown filter rule %q", conf.Name, name)
+				}
+				banRule.rules[name] = true
+			}
+		default:
+			return nil, fmt.Errorf("ban rule %s: unknown trigger %q", conf.Name, conf.Trigger)
+		}
+		banRules = append(banRules, banRule)
+	}
+	return banRules, nil
+}
+
+// banCountScript counts within a fixed window of ARGV[1] seconds
+var banCountScript = NewRedisScript(1, `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	n := db.Do("INCRBY", keys[0], 1)
+	if n == int64(1) {
+		db.Do("EXPIRE", keys[0], args[0])
+	}
+	return n
+})
+
+// CountNo counts a NO decided by the filter rule, and bans the IP when a no
+// rule reaches its threshold
+func (banRules BanRules) CountNo(conns *FilterConns, ip string, rule string) {
+	for _, banRule := range banRules {
+		if banRule.Trigger != "no" || (len(banRule.rules) > 0 && !banRule.rules[rule]) {
+			continue
+		}
+		n, err := redisInt64(conns.Lists.EvalScript(banCountScript, "BanCount_"+banRule.Name+"_"+ip, banRule.Window))
+		if err != nil {
+			logRedisError("CountNo", err)
+			continue
+		}
+		if n > banRule.Threshold {
+			banRule.ban(conns, ip, fmt.Sprintf("%d NO within %ds", n, banRule.Window))
+		}
+	}
+}
+
+// CheckWatchingSize bans the IP when its watching list is longer than the
+// threshold of a watching_size rule
+func (banRules BanRules) CheckWatchingSize(conns *FilterConns, ip string, size int64) {
+	for _, banRule := range banRules {
+		if banRule.Trigger == "watching_size" && size > banRule.Threshold {
+			banRule.ban(conns, ip, fmt.Sprintf("%d records in its watching list", size))
+		}
+	}
+}
+
+func (banRule *BanRule) ban(conns *FilterConns, ip string, reason string) {
+	err := AddBlackList(conns.Lists, ip, reason, banRule.Name, time.Duration(banRule.TTL)*time.Second)
+	if err != nil {
+		logRedisError("BanRule "+banRule.Name, err)
+		return
+	}
+	log.Println("(BanRule) ", banRule.Name, " banned ", ip, ": ", reason)
+}
+
+// AddBlackList bans ip for ttl, for ever if ttl is 0, a banned IP is banned
+// again with the new reason and ttl
+func AddBlackList(redisConn *RedisConn, ip string, reason string, rule string, ttl time.Duration) error {
+	now := time.Now().In(LogLocation)
+	entry := BlackListEntry{IP: ip, Reason: reason, Rule: rule, Since: now.Format("2006-01-02 15:04:05")}
+	score := math.Inf(1)
+	if ttl > 0 {
+		expire := now.Add(ttl)
+		entry.Expire = expire.Format("2006-01-02 15:04:05")
+		score = float64(expire.Unix())
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	cmds := []RedisCmd{
+		NewRedisCmd("ZADD", blackListKey, strconv.FormatFloat(score, 'f', -1, 64), ip),
+		NewRedisCmd("HSET", blackListInfoKey, ip, string(data)),
+	}
+	if IsCIDR(ip) {
+		cmds = append(cmds, NewRedisCmd("SADD", cidrIndexKey(blackListKey), ip))
+	}
+	_, err = redisConn.Transaction(append(cmds, NewRedisCmd("PUBLISH", redisConn.Channel(blackListChannel), ip)))
+	return err
+}
+
+// DelBlackList lifts the ban of ip
+func DelBlackList(redisConn *RedisConn, ip string) error {
+	cmds := []RedisCmd{
+		NewRedisCmd("ZREM", blackListKey, ip),
+		NewRedisCmd("HDEL", blackListInfoKey, ip),
+	}
+	if IsCIDR(ip) {
+		cmds = append(cmds, NewRedisCmd("SREM", cidrIndexKey(blackListKey), ip))
+	}
+	_, err := redisConn.Transaction(append(cmds, NewRedisCmd("PUBLISH", redisConn.Channel(blackListChannel), ip)))
+	return err
+}
+
+// IsBlackListed return whether ip is banned at now, by itself or by a banned
+// network in cidrLists. An expired ban which is not swept yet does not count.
+func IsBlackListed(redisConn *RedisConn, ip string, now time.Time) (bool, error) {
+	for _, network := range cidrLists.Matches(blackListKey, ip) {
+		if network.Score > float64(now.Unix()) {
+			return true, nil
+		}
+	}
+	expire, ok, err := redisConn.SortedSetScore(blackListKey, ip)
+	if err != nil || !ok {
+		return false, err
+	}
+	return expire > float64(now.Unix()), nil
+}
+
+// GetBlackListEntry return the entry of ip, ok is false if ip is not banned
+func GetBlackListEntry(redisConn *RedisConn, ip string) (entry BlackListEntry, ok bool, err error) {
+	data, err := redisConn.HashGet(blackListInfoKey, ip)
+	if err != nil || data == "" {
+		return entry, false, err
+	}
+	err = json.Unmarshal([]byte(data), &entry)
+	return entry, err == nil, err
+}
+
+// sweepBlackListScript removes the bans which expired before ARGV[1]
+var sweepBlackListScript = NewRedisScript(2, `
+local ips = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1000)
+for _, ip in ipairs(ips) do
+	redis.call('ZREM', KEYS[1], ip)
+	redis.call('HDEL', KEYS[2], ip)
+	redis.call('PUBLISH', ARGV[2], ip)
+end
+return #ips
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	ips := db.Do("ZRANGEBYSCORE", keys[0], "-inf", args[0]).([]interface{})
+	if len(ips) > 1000 {
+		ips = ips[:1000]
+	}
+	for _, ip := range ips {
+		db.Do("ZREM", keys[0], string(ip.([]byte)))
+		db.Do("HDEL", keys[1], string(ip.([]byte)))
+		db.Do("PUBLISH", args[1], string(ip.([]byte)))
+	}
+	return int64(len(ips))
+})
+
+// SweepBlackList removes the expired bans
+// output:the number of removed bans
+func SweepBlackList(redisConn *RedisConn, now time.Time) (int64, error) {
+	var swept int64
+	for {
+		n, err := redisInt64(redisConn.EvalScript(sweepBlackListScript, blackListKey, blackListInfoKey, now.Unix(), redisConn.Channel(blackListChannel)))
+		swept += n
+		if err != nil || n < 1000 {
+			return swept, err
+		}
+	}
+}
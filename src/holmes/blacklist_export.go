@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIpsetName            = "holmes_blacklist"
+	defaultIptablesChain        = "HOLMES_BLACKLIST"
+	defaultBlackListCheckPeriod = 60 // seconds
+)
+
+// BlackListExportConf says where the blacklist is rendered for the firewalls,
+// a file is not written when its path is ""
+type BlackListExportConf struct {
+	NginxFile     string   // include file of deny lines, or of a geo block in geo mode
+	NginxMode     string   // deny (the default) or geo
+	NginxVariable string   // variable of the geo block, default is $holmes_blacklist
+	IpsetFile     string   // ipset restore file, IPv6 addresses go to the set named IpsetName6
+	IpsetName     string   // default is holmes_blacklist
+	IptablesFile  string   // iptables-save fragment of the IPv4 addresses
+	IptablesChain string   // default is HOLMES_BLACKLIST
+	Exceptions    []string // IPs which are never rendered, as well as the WhiteList and its CIDRs
+	ReloadCommand string   // run by sh -c after a file changed, such as "nginx -s reload"
+	CheckPeriod   int64    // seconds between two checks besides the change notices, default is 60
+}
+
+// BlackListCommand is `holmes blacklist`, it renders the blacklist once, or
+// again on every change with -watch
+func BlackListCommand(args []string) error {
+	flags := flag.NewFlagSet("blacklist", flag.ContinueOnError)
+	confFile := flags.String("conf", "holmes.conf", "holmes config file")
+	watch := flags.Bool("watch", false, "render again on every change of the blacklist")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	holmesConfig, err := ReadConfig(*confFile)
+	if err != nil {
+		return err
+	}
+	if err := InitLogLocation(holmesConfig.LogTimeZone); err != nil {
+		return err
+	}
+	exportConf := holmesConfig.BlackListExport
+	if exportConf.NginxFile == "" && exportConf.IpsetFile == "" && exportConf.IptablesFile == "" {
+		return fmt.Errorf("%s: BlackListExport has no file to write", *confFile)
+	}
+	redisConn := NewRedisConn(holmesConfig.RedisConfs[1])
+	defer redisConn.Close()
+	if !*watch {
+		_, err := RenderBlackList(redisConn, exportConf, time.Now())
+		return err
+	}
+	WatchBlackList(redisConn, exportConf, nil)
+	return nil
+}
+
+// WatchBlackList renders the blacklist when it is changed, and every
+// CheckPeriod for the bans which expire. It return after stop is closed.
+func WatchBlackList(redisConn *RedisConn, exportConf BlackListExportConf, stop <-chan struct{}) {
+	var changes <-chan PubSubMessage
+	subscription, err := redisConn.Subscribe(blackListChannel)
+	if err != nil {
+		log.Println("(WatchBlackList) can not subscribe ", blackListChannel, ", only check every period: ", err)
+	} else {
+		defer subscription.Close()
+		changes = subscription.Messages
+	}
+	period := time.Duration(exportConf.CheckPeriod) * time.Second
+	if period <= 0 {
+		period = defaultBlackListCheckPeriod * time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if _, err := RenderBlackList(redisConn, exportConf, time.Now()); err != nil {
+			log.Println("(WatchBlackList) ", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-changes:
+			// a ban rule may ban many IPs at once, render them together
+			time.Sleep(time.Second)
+			for drained := false; !drained; {
+				select {
+				case <-changes:
+				default:
+					drained = true
+				}
+			}
+		}
+	}
+}
+
+// RenderBlackList writes the files of the IPs banned at now, a file is only
+// replaced when its content changed, and the ReloadCommand is run then
+// output:whether a file was replaced
+func RenderBlackList(redisConn *RedisConn, exportConf BlackListExportConf, now time.Time) (bool, error) {
+	ips, err := bannedIPs(redisConn, exportConf.Exceptions, now)
+	if err != nil {
+		return false, err
+	}
+	files := []struct {
+		path   string
+		render func(ips []string, exportConf BlackListExportConf) []byte
+	}{
+		{exportConf.NginxFile, renderNginx},
+		{exportConf.IpsetFile, renderIpset},
+		{exportConf.IptablesFile, renderIptables},
+	}
+	changed := false
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		replaced, err := replaceFile(file.path, file.render(ips, exportConf))
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || replaced
+	}
+	if changed {
+		log.Println("(RenderBlackList) ", len(ips), " IPs rendered")
+		if exportConf.ReloadCommand != "" {
+			output, err := exec.Command("sh", "-c", exportConf.ReloadCommand).CombinedOutput()
+			if err != nil {
+				return changed, fmt.Errorf("%s: %s: %s", exportConf.ReloadCommand, err, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+	return changed, nil
+}
+
+// bannedIPs return the sorted IPs banned at now which are neither in
+// exceptions nor in the WhiteList
+func bannedIPs(redisConn *RedisConn, exceptions []string, now time.Time) ([]string, error) {
+	ips, err := redisConn.SortedSetRangeByScore(blackListKey, "("+strconv.FormatInt(now.Unix(), 10), "+inf")
+	if err != nil || len(ips) == 0 {
+		return ips, err
+	}
+	cmds := make([]RedisCmd, len(ips))
+	for i, ip := range ips {
+		cmds[i] = NewRedisCmd("ZSCORE", "WhiteList", ip)
+	}
+	replies, err := redisConn.Pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+	tries, err := LoadCIDRLists(redisConn, now)
+	if err != nil {
+		return nil, err
+	}
+	excepted := map[string]bool{}
+	for _, ip := range exceptions {
+		excepted[ip] = true
+	}
+	banned := make([]string, 0, len(ips))
+	for i, ip := range ips {
+		if replies[i] != nil || excepted[ip] {
+			continue
+		}
+		if IsCIDR(ip) {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				log.Println("(RenderBlackList) skip ", ip, ", it is not a CIDR")
+				continue
+			}
+		} else if parsed := net.ParseIP(ip); parsed == nil {
+			log.Println("(RenderBlackList) skip ", ip, ", it is not an IP")
+			continue
+		} else if len(tries["WhiteList"].Matches(parsed)) > 0 {
+			continue
+		}
+		banned = append(banned, ip)
+	}
+	sort.Strings(banned)
+	return banned, nil
+}
+
+func renderNginx(ips []string, exportConf BlackListExportConf) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("# generated by holmes, do not edit\n")
+	if exportConf.NginxMode == "geo" {
+		variable := exportConf.NginxVariable
+		if variable == "" {
+			variable = "$holmes_blacklist"
+		}
+		fmt.Fprintf(&buffer, "geo %s {\n    default 0;\n", variable)
+		for _, ip := range ips {
+			fmt.Fprintf(&buffer, "    %s 1;\n", ip)
+		}
+		buffer.WriteString("}\n")
+		return buffer.Bytes()
+	}
+	for _, ip := range ips {
+		fmt.Fprintf(&buffer, "deny %s;\n", ip)
+	}
+	return buffer.Bytes()
+}
+
+// isIPv4 tells whether a banned IP or CIDR is IPv4
+func isIPv4(ip string) bool {
+	if IsCIDR(ip) {
+		network, _, _ := net.ParseCIDR(ip)
+		return network.To4() != nil
+	}
+	return net.ParseIP(ip).To4() != nil
+}
+
+// renderIpset puts the IPs in hash:ip sets and the CIDRs in hash:net sets
+// named <IpsetName>_net and <IpsetName>_net6
+func renderIpset(ips []string, exportConf BlackListExportConf) []byte {
+	name := exportConf.IpsetName
+	if name == "" {
+		name = defaultIpsetName
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("# generated by holmes, do not edit\n")
+	fmt.Fprintf(&buffer, "create %s hash:ip family inet -exist\nflush %s\n", name, name)
+	fmt.Fprintf(&buffer, "create %s6 hash:ip family inet6 -exist\nflush %s6\n", name, name)
+	fmt.Fprintf(&buffer, "create %s_net hash:net family inet -exist\nflush %s_net\n", name, name)
+	fmt.Fprintf(&buffer, "create %s_net6 hash:net family inet6 -exist\nflush %s_net6\n", name, name)
+	for _, ip := range ips {
+		set := name
+		if IsCIDR(ip) {
+			set += "_net"
+		}
+		if !isIPv4(ip) {
+			set += "6"
+		}
+		fmt.Fprintf(&buffer, "add %s %s\n", set, ip)
+	}
+	return buffer.Bytes()
+}
+
+func renderIptables(ips []string, exportConf BlackListExportConf) []byte {
+	chain := exportConf.IptablesChain
+	if chain == "" {
+		chain = defaultIptablesChain
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("# generated by holmes, do not edit, load it with iptables-restore -n\n")
+	fmt.Fprintf(&buffer, "*filter\n:%s - [0:0]\n-F %s\n", chain, chain)
+	for _, ip := range ips {
+		switch {
+		case !isIPv4(ip):
+		case IsCIDR(ip):
+			fmt.Fprintf(&buffer, "-A %s -s %s -j DROP\n", chain, ip)
+		default:
+			fmt.Fprintf(&buffer, "-A %s -s %s/32 -j DROP\n", chain, ip)
+		}
+	}
+	buffer.WriteString("COMMIT\n")
+	return buffer.Bytes()
+}
+
+// replaceFile writes content to a temporary file beside path and renames it to
+// path, unless path already has this content
+func replaceFile(path string, content []byte) (bool, error) {
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+	temp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(temp, path)
+}
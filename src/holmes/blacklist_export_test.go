@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderBlackListFiles(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.1.0.0/16", "2001:db8::1", "2001:db8:1::/48"}
+	exportConf := BlackListExportConf{NginxMode: "geo"}
+	if nginx := string(renderNginx(ips, exportConf)); !strings.Contains(nginx, "geo $holmes_blacklist {") || !strings.Contains(nginx, "    2001:db8::1 1;\n") {
+		t.Errorf("nginx geo got %q", nginx)
+	}
+	if nginx := string(renderNginx(ips, BlackListExportConf{})); !strings.Contains(nginx, "deny 10.0.0.1;\n") {
+		t.Errorf("nginx deny got %q", nginx)
+	}
+	ipset := string(renderIpset(ips, exportConf))
+	if !strings.Contains(ipset, "add holmes_blacklist 10.0.0.1\n") || !strings.Contains(ipset, "add holmes_blacklist6 2001:db8::1\n") ||
+		!strings.Contains(ipset, "add holmes_blacklist_net 10.1.0.0/16\n") || !strings.Contains(ipset, "add holmes_blacklist_net6 2001:db8:1::/48\n") {
+		t.Errorf("ipset got %q", ipset)
+	}
+	iptables := string(renderIptables(ips, exportConf))
+	if !strings.Contains(iptables, "-A HOLMES_BLACKLIST -s 10.0.0.1/32 -j DROP\n") || !strings.Contains(iptables, "-A HOLMES_BLACKLIST -s 10.1.0.0/16 -j DROP\n") ||
+		strings.Contains(iptables, "2001:db8") {
+		t.Errorf("iptables got %q", iptables)
+	}
+
+	dir, err := ioutil.TempDir("", "holmes_blacklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blacklist.conf")
+	for i, want := range []bool{true, false} {
+		if replaced, err := replaceFile(path, []byte("deny 10.0.0.1;\n")); err != nil || replaced != want {
+			t.Errorf("replaceFile %d got %v %v", i, replaced, err)
+		}
+	}
+}
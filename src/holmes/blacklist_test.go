@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBanRules(t *testing.T) {
+	filterRules, err := NewRulePipeline(DefaultFilterRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBanRules([]BanRuleConf{
+		{Name: "long_watching", Trigger: "watching_size", Threshold: 500},
+		{Name: "bad_ua", Trigger: "no", Threshold: 300, Window: 600, Rules: []string{"ua_keyword"}, TTL: 3600},
+	}, filterRules); err != nil {
+		t.Error(err)
+	}
+	for _, conf := range []BanRuleConf{
+		{Trigger: "watching_size", Threshold: 500},
+		{Name: "zero", Trigger: "watching_size"},
+		{Name: "no_window", Trigger: "no", Threshold: 300},
+		{Name: "unknown_rule", Trigger: "no", Threshold: 300, Window: 600, Rules: []string{"nothing"}},
+		{Name: "unknown_trigger", Trigger: "often", Threshold: 300},
+	} {
+		if _, err := NewBanRules([]BanRuleConf{conf}, filterRules); err == nil {
+			t.Errorf("%+v is accepted", conf)
+		}
+	}
+}
+
+func TestBanRules(t *testing.T) {
+	filterRules, err := NewRulePipeline(DefaultFilterRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banRules, err := NewBanRules([]BanRuleConf{
+		{Name: "long_watching", Trigger: "watching_size", Threshold: 5},
+		{Name: "bad_ua", Trigger: "no", Threshold: 2, Window: 60, Rules: []string{"ua_family"}, TTL: 3600},
+	}, filterRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryRedis()
+	conns := &FilterConns{Lists: db.Conn(), Counters: NewMemoryCounterBatch()}
+	now := time.Now()
+	banned := func(ip string, at time.Time) bool {
+		banned, err := IsBlackListed(conns.Lists, ip, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return banned
+	}
+
+	// the NO of other rules are not counted, the third NO within the window bans
+	banRules.CountNo(conns, "10.0.0.1", "ua_keyword")
+	banRules.CountNo(conns, "10.0.0.1", "ua_family")
+	banRules.CountNo(conns, "10.0.0.1", "ua_family")
+	if banned("10.0.0.1", now) {
+		t.Errorf("10.0.0.1 is banned at the threshold")
+	}
+	banRules.CountNo(conns, "10.0.0.1", "ua_family")
+	if !banned("10.0.0.1", now) {
+		t.Errorf("10.0.0.1 is not banned over the threshold")
+	}
+	if entry, ok, err := GetBlackListEntry(conns.Lists, "10.0.0.1"); err != nil || !ok || entry.Rule != "bad_ua" || entry.Expire == "" {
+		t.Errorf("entry is %+v %v", entry, err)
+	}
+	if banned("10.0.0.1", now.Add(2*time.Hour)) {
+		t.Errorf("the ban of 10.0.0.1 does not expire")
+	}
+
+	// the NO counted in an expired window are forgotten
+	banRules.CountNo(conns, "10.0.0.2", "ua_family")
+	banRules.CountNo(conns, "10.0.0.2", "ua_family")
+	db.expires["BanCount_bad_ua_10.0.0.2"] = now.Add(-time.Second)
+	banRules.CountNo(conns, "10.0.0.2", "ua_family")
+	if banned("10.0.0.2", now) {
+		t.Errorf("10.0.0.2 is banned by the NO of an expired window")
+	}
+
+	banRules.CheckWatchingSize(conns, "10.0.0.3", 5)
+	if banned("10.0.0.3", now) {
+		t.Errorf("10.0.0.3 is banned at the threshold")
+	}
+	banRules.CheckWatchingSize(conns, "10.0.0.3", 6)
+	if !banned("10.0.0.3", now.Add(24*365*time.Hour)) {
+		t.Errorf("10.0.0.3 is not banned for ever")
+	}
+
+	// the expired bans are swept and published, the others are kept
+	if n, err := SweepBlackList(conns.Lists, now.Add(2*time.Hour)); err != nil || n != 1 {
+		t.Errorf("swept %d %v", n, err)
+	}
+	if _, ok, _ := GetBlackListEntry(conns.Lists, "10.0.0.1"); ok {
+		t.Errorf("the entry of the expired ban is kept")
+	}
+	if last := db.published[len(db.published)-1]; last.Channel != blackListChannel || last.Data != "10.0.0.1" {
+		t.Errorf("published %+v", last)
+	}
+	if !banned("10.0.0.3", now.Add(2*time.Hour)) {
+		t.Errorf("the ban for ever is swept")
+	}
+
+	// a banned network bans its IPs
+	if err := AddBlackList(conns.Lists, "10.1.0.0/16", "test", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	tries, err := LoadCIDRLists(conns.Lists, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrLists.Set(tries)
+	defer cidrLists.Set(map[string]*PrefixTrie{})
+	if !banned("10.1.2.3", now) || banned("10.1.2.3", now.Add(2*time.Hour)) || banned("10.2.0.1", now) {
+		t.Errorf("the ban of 10.1.0.0/16 is not matched")
+	}
+}
+
+func TestBanScripts(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"banCount new", nil, banCountScript, []interface{}{"BanCount_10.0.0.1", 60}},
+		{"banCount counted", [][]interface{}{{"SET", "BanCount_10.0.0.1", 3}}, banCountScript, []interface{}{"BanCount_10.0.0.1", 60}},
+		{"sweepBlackList", [][]interface{}{{"ZADD", "BlackList", 100, "10.0.0.1", 300, "10.0.0.2"}, {"HSET", "BlackListInfo", "10.0.0.1", "a"}, {"HSET", "BlackListInfo", "10.0.0.2", "b"}},
+			sweepBlackListScript, []interface{}{"BlackList", "BlackListInfo", 200, blackListChannel}},
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The WhiteList, BlackList and IgnoreList can hold CIDRs besides IPs. The
+// CIDRs of a list are indexed in the set <list>CIDR, the filter loads them into
+// prefix tries, so an IP is matched by the networks of a list without a redis
+// command. The tries are loaded again when ListsChanged or BlackListChanged is
+// published, and every cidrSyncInterval. An AS is not a list member, the
+// networks it announces are added as CIDRs, they are listed by the routing
+// registries, e.g. whois -h whois.radb.net -- '-i origin AS15169'.
+const (
+	cidrListsChannel = "ListsChanged"
+	cidrSyncInterval = 10 * time.Second
+)
+
+// cidrListKeys are the lists which can hold CIDRs
+var cidrListKeys = []string{"WhiteList", blackListKey, ignoreList}
+
+func cidrIndexKey(list string) string {
+	return list + "CIDR"
+}
+
+// IsCIDR tells whether a list member is a network rather than an IP
+func IsCIDR(member string) bool {
+	return strings.Contains(member, "/")
+}
+
+// CIDREntry is a network of a list, Score is its score when the list is a
+// sorted set, the expiry of a ban in the BlackList
+type CIDREntry struct {
+	Network string
+	Score   float64
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	entry    *CIDREntry // a network ends at this node
+}
+
+// PrefixTrie is a binary trie of networks, one bit of the address per level.
+// The IPv4 networks are kept apart from the IPv6 ones.
+type PrefixTrie struct {
+	v4   trieNode
+	v6   trieNode
+	size int
+}
+
+func NewPrefixTrie() *PrefixTrie {
+	return &PrefixTrie{}
+}
+
+func (trie *PrefixTrie) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &trie.v4, ip4
+	}
+	return &trie.v6, ip.To16()
+}
+
+// Insert adds a network, an entry of the same network is replaced. An IPv4
+// network written as IPv6, such as ::ffff:10.0.0.0/104, is an IPv4 one.
+func (trie *PrefixTrie) Insert(network *net.IPNet, entry CIDREntry) {
+	node, ip := trie.root(network.IP)
+	ones, bits := network.Mask.Size()
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	if ones < 0 || ones > 8*len(ip) {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> uint(7-i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.entry == nil {
+		trie.size++
+	}
+	node.entry = &entry
+}
+
+// Matches return the networks which contain ip, the widest first
+func (trie *PrefixTrie) Matches(ip net.IP) []CIDREntry {
+	var matches []CIDREntry
+	if trie == nil || ip == nil {
+		return matches
+	}
+	node, ip := trie.root(ip)
+	for i := 0; node != nil; i++ {
+		if node.entry != nil {
+			matches = append(matches, *node.entry)
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ip[i/8]>>uint(7-i%8)&1]
+	}
+	return matches
+}
+
+func (trie *PrefixTrie) Len() int {
+	if trie == nil {
+		return 0
+	}
+	return trie.size
+}
+
+// CIDRLists are the prefix tries of the lists, swapped as a whole by a sync
+type CIDRLists struct {
+	tries atomic.Value // map[string]*PrefixTrie
+}
+
+// cidrLists are the networks of the lists of the filter
+var cidrLists = &CIDRLists{}
+
+func (lists *CIDRLists) Set(tries map[string]*PrefixTrie) {
+	lists.tries.Store(tries)
+}
+
+func (lists *CIDRLists) trie(list string) *PrefixTrie {
+	tries, _ := lists.tries.Load().(map[string]*PrefixTrie)
+	return tries[list]
+}
+
+// Matches return the networks of list which contain ip, the widest first
+func (lists *CIDRLists) Matches(list string, ip string) []CIDREntry {
+	trie := lists.trie(list)
+	if trie.Len() == 0 {
+		return nil
+	}
+	return trie.Matches(net.ParseIP(ip))
+}
+
+// Contains tells whether a network of list contains ip
+func (lists *CIDRLists) Contains(list string, ip string) bool {
+	return len(lists.Matches(list, ip)) > 0
+}
+
+// ChangeCIDRList adds network to the WhiteList, for ever, or to the
+// IgnoreList, or removes it, along with its index entry. The change is
+// published on ListsChanged. The BlackList is changed by AddBlackList and
+// DelBlackList.
+func ChangeCIDRList(redisConn *RedisConn, list string, network string, add bool) error {
+	cmds := []RedisCmd{}
+	switch {
+	case list == ignoreList && add:
+		cmds = append(cmds, NewRedisCmd("SADD", list, network), NewRedisCmd("SADD", cidrIndexKey(list), network))
+	case list == ignoreList:
+		cmds = append(cmds, NewRedisCmd("SREM", list, network), NewRedisCmd("SREM", cidrIndexKey(list), network))
+	case add:
+		cmds = append(cmds, NewRedisCmd("ZADD", list, "+inf", network), NewRedisCmd("SADD", cidrIndexKey(list), network))
+	default:
+		cmds = append(cmds, NewRedisCmd("ZREM", list, network), NewRedisCmd("SREM", cidrIndexKey(list), network))
+	}
+	_, err := redisConn.Transaction(append(cmds, NewRedisCmd("PUBLISH", redisConn.Channel(cidrListsChannel), network)))
+	return err
+}
+
+// LoadCIDRLists reads the networks of the lists, a ban expired at now is left
+// out. The index entries of the networks no longer in their list are removed.
+func LoadCIDRLists(redisConn *RedisConn, now time.Time) (map[string]*PrefixTrie, error) {
+	tries := map[string]*PrefixTrie{}
+	for _, list := range cidrListKeys {
+		trie := NewPrefixTrie()
+		tries[list] = trie
+		members, err := redisConn.SetMembers(cidrIndexKey(list))
+		if err != nil {
+			return nil, err
+		}
+		if len(members) == 0 {
+			continue
+		}
+		cmds := make([]RedisCmd, len(members))
+		for i, member := range members {
+			if list == ignoreList {
+				cmds[i] = NewRedisCmd("SISMEMBER", list, member)
+			} else {
+				cmds[i] = NewRedisCmd("ZSCORE", list, member)
+			}
+		}
+		replies, err := redisConn.Pipeline(cmds)
+		if err != nil {
+			return nil, err
+		}
+		stale := []RedisCmd{}
+		for i, member := range members {
+			_, network, err := net.ParseCIDR(member)
+			if err != nil || i >= len(replies) || replies[i] == nil || replies[i] == int64(0) {
+				stale = append(stale, NewRedisCmd("SREM", cidrIndexKey(list), member))
+				continue
+			}
+			entry := CIDREntry{Network: member}
+			if list != ignoreList {
+				if entry.Score, err = redisFloat(replies[i]); err != nil {
+					continue
+				}
+			}
+			if list == blackListKey && entry.Score <= float64(now.Unix()) {
+				continue
+			}
+			trie.Insert(network, entry)
+		}
+		if len(stale) > 0 {
+			_, err := redisConn.Pipeline(stale)
+			logRedisError("LoadCIDRLists", err)
+		}
+	}
+	return tries, nil
+}
+
+// SyncCIDRLists keeps cidrLists in sync with redis, it return after stop is
+// closed
+func SyncCIDRLists(holmesConfig HolmesConfig, stop <-chan struct{}) {
+	redisConn := NewRedisConn(holmesConfig.RedisConfs[1])
+	defer redisConn.Close()
+	var changes <-chan PubSubMessage
+	subscription, err := redisConn.Subscribe(cidrListsChannel, blackListChannel)
+	if err != nil {
+		log.Println("(SyncCIDRLists) can not subscribe, only sync every ", cidrSyncInterval, ": ", err)
+	} else {
+		defer subscription.Close()
+		changes = subscription.Messages
+	}
+	ticker := time.NewTicker(cidrSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+		tries, err := LoadCIDRLists(redisConn, time.Now())
+		if err != nil {
+			log.Println("(SyncCIDRLists) keep the loaded networks: ", err)
+			continue
+		}
+		cidrLists.Set(tries)
+	}
+}
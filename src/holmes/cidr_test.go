@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie := NewPrefixTrie()
+	for i, network := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "0.0.0.0/0", "2001:db8::/32", "10.1.0.0/16", "::ffff:172.16.0.0/108"} {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Insert(ipNet, CIDREntry{Network: network, Score: float64(i)})
+	}
+	if trie.Len() != 6 {
+		t.Errorf("Len got %d", trie.Len())
+	}
+	for _, c := range []struct {
+		ip   string
+		want []string
+	}{
+		{"10.1.2.3", []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32"}},
+		{"10.1.2.4", []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16"}},
+		{"192.168.0.1", []string{"0.0.0.0/0"}},
+		{"172.16.9.9", []string{"0.0.0.0/0", "::ffff:172.16.0.0/108"}},
+		{"2001:db8::1", []string{"2001:db8::/32"}},
+		{"2001:db9::1", nil},
+	} {
+		matches := trie.Matches(net.ParseIP(c.ip))
+		got := []string{}
+		for _, match := range matches {
+			got = append(got, match.Network)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s got %v", c.ip, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s got %v", c.ip, got)
+				break
+			}
+		}
+	}
+	if matches := trie.Matches(net.ParseIP("10.1.9.9")); matches[len(matches)-1].Score != 5 {
+		t.Errorf("the entry of 10.1.0.0/16 is not replaced: %+v", matches)
+	}
+
+	cidrLists.Set(map[string]*PrefixTrie{"WhiteList": trie})
+	defer cidrLists.Set(map[string]*PrefixTrie{})
+	if !cidrLists.Contains("WhiteList", "10.9.9.9") || cidrLists.Contains(blackListKey, "10.9.9.9") || cidrLists.Contains("WhiteList", "not an ip") {
+		t.Errorf("cidrLists.Contains is wrong")
+	}
+}
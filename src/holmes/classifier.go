@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultClassifierMinRequests = 5
+	modelFormat                  = 1 // the latest Format of the model files
+)
+
+// Classifier tells how likely the client of a session is a human
+type Classifier interface {
+	HumanProbability(features SessionFeatures) float64
+}
+
+// ClassifierFactory builds a Classifier from the model of a model file, the
+// model reads the session features named in features
+type ClassifierFactory func(features []string, model json.RawMessage) (Classifier, error)
+
+var classifierFactories = map[string]ClassifierFactory{}
+
+// RegisterClassifier makes a model type loadable from a model file
+func RegisterClassifier(name string, factory ClassifierFactory) {
+	classifierFactories[name] = factory
+}
+
+func init() {
+	RegisterClassifier("decision_tree", NewDecisionTree)
+	RegisterClassifier("naive_bayes", NewNaiveBayes)
+}
+
+// ModelFile is a trained model as it is saved on disk
+type ModelFile struct {
+	Format   int      // layout of the file, 0 is 1
+	Type     string   // decision_tree or naive_bayes
+	Version  string   // set by holmes train, the time it was trained by default
+	Trained  string   `json:",omitempty"`
+	Features []string // names of the numeric fields of SessionFeatures
+	Model    json.RawMessage
+}
+
+// LoadClassifier reads a model file and builds its classifier
+func LoadClassifier(path string) (Classifier, ModelFile, error) {
+	var modelFile ModelFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, modelFile, err
+	}
+	if err := json.Unmarshal(data, &modelFile); err != nil {
+		return nil, modelFile, fmt.Errorf("%s: %s", path, err)
+	}
+	classifier, err := NewClassifier(modelFile)
+	if err != nil {
+		return nil, modelFile, fmt.Errorf("%s: %s", path, err)
+	}
+	return classifier, modelFile, nil
+}
+
+// NewClassifier builds the classifier of a model file
+func NewClassifier(modelFile ModelFile) (Classifier, error) {
+	if modelFile.Format > modelFormat {
+		return nil, fmt.Errorf("model format %d is newer than this holmes (%d)", modelFile.Format, modelFormat)
+	}
+	factory, ok := classifierFactories[modelFile.Type]
+	if !ok {
+		names := []string{}
+		for name := range classifierFactories {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown model type %q, the known types are %s", modelFile.Type, strings.Join(names, ", "))
+	}
+	return factory(modelFile.Features, modelFile.Model)
+}
+
+// compileClassifier is the classifier op, it matches when the model of the
+// runtime scores the session of the record within Value, such as ">=0.9" or
+// "<=0.1". It misses without a model, or when the session has less than
+// ClassifierMinRequests records.
+func compileClassifier(conf RuleConf) (func(ctx *RuleContext, value string) bool, error) {
+	var compare func(p, bound float64) bool
+	var spec string
+	switch {
+	case strings.HasPrefix(conf.Value, ">="):
+		compare, spec = func(p, bound float64) bool { return p >= bound }, conf.Value[2:]
+	case strings.HasPrefix(conf.Value, "<="):
+		compare, spec = func(p, bound float64) bool { return p <= bound }, conf.Value[2:]
+	case strings.HasPrefix(conf.Value, ">"):
+		compare, spec = func(p, bound float64) bool { return p > bound }, conf.Value[1:]
+	case strings.HasPrefix(conf.Value, "<"):
+		compare, spec = func(p, bound float64) bool { return p < bound }, conf.Value[1:]
+	default:
+		return nil, fmt.Errorf("classifier needs a bound such as >=0.9, got %q", conf.Value)
+	}
+	bound, err := strconv.ParseFloat(strings.TrimSpace(spec), 64)
+	if err != nil || bound < 0 || bound > 1 {
+		return nil, fmt.Errorf("classifier needs a bound within [0, 1], got %q", conf.Value)
+	}
+	return func(ctx *RuleContext, value string) bool {
+		if !ctx.scored && !ctx.score() {
+			return false
+		}
+		return compare(ctx.human, bound)
+	}, nil
+}
+
+// score runs the classifier of the runtime on the session of the record once,
+// and keeps the probability in the session
+func (ctx *RuleContext) score() bool {
+	classifier := ctx.runtime.Classifier
+	if classifier == nil || ctx.session == nil {
+		return false
+	}
+	minRequests := ctx.runtime.Config.ClassifierMinRequests
+	if minRequests <= 0 {
+		minRequests = defaultClassifierMinRequests
+	}
+	if ctx.session.Requests < minRequests {
+		return false
+	}
+	ctx.human = classifier.HumanProbability(*ctx.session)
+	ctx.scored = true
+	sessions.Score(ctx.session.Key, ctx.human)
+	return true
+}
+
+// SessionFeatureNames are the fields of SessionFeatures a model can read
+var SessionFeatureNames = []string{
+	"Requests", "DistinctURIs", "PropViewRatio", "StaticRatio", "InterArrivalMean",
+	"InterArrivalVariance", "HeadRatio", "ClientErrorRatio", "EmptyRefererRatio", "NightRatio",
+}
+
+// featureVector reads the named fields of SessionFeatures as numbers
+type featureVector []int
+
+func newFeatureVector(names []string) (featureVector, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the model reads no feature")
+	}
+	known := map[string]bool{}
+	for _, name := range SessionFeatureNames {
+		known[name] = true
+	}
+	vector := make(featureVector, len(names))
+	for i, name := range names {
+		field, ok := reflect.TypeOf(SessionFeatures{}).FieldByName(name)
+		if !ok || !known[name] {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		vector[i] = field.Index[0]
+	}
+	return vector, nil
+}
+
+func (vector featureVector) values(features SessionFeatures) []float64 {
+	fields := reflect.ValueOf(features)
+	values := make([]float64, len(vector))
+	for i, index := range vector {
+		field := fields.Field(index)
+		if field.Kind() == reflect.Int {
+			values[i] = float64(field.Int())
+		} else {
+			values[i] = field.Float()
+		}
+	}
+	return values
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Decision tree
+///////////////////////////////////////////////////////////////////////////////
+
+// TreeNode is a node of a decision tree, a node without children is a leaf
+type TreeNode struct {
+	Feature   int       `json:",omitempty"` // index in the Features of the model
+	Threshold float64   `json:",omitempty"`
+	Left      *TreeNode `json:",omitempty"` // the feature <= Threshold
+	Right     *TreeNode `json:",omitempty"`
+	Human     float64   // share of the humans among the training sessions of the node
+	Samples   int       `json:",omitempty"`
+}
+
+func (node *TreeNode) IsLeaf() bool {
+	return node.Left == nil || node.Right == nil
+}
+
+type DecisionTree struct {
+	vector featureVector
+	root   *TreeNode
+}
+
+func NewDecisionTree(features []string, model json.RawMessage) (Classifier, error) {
+	vector, err := newFeatureVector(features)
+	if err != nil {
+		return nil, err
+	}
+	var root TreeNode
+	if err := json.Unmarshal(model, &root); err != nil {
+		return nil, err
+	}
+	if err := root.check(len(features)); err != nil {
+		return nil, err
+	}
+	return &DecisionTree{vector: vector, root: &root}, nil
+}
+
+func (node *TreeNode) check(featureCount int) error {
+	if node.IsLeaf() {
+		if node.Human < 0 || node.Human > 1 {
+			return fmt.Errorf("leaf probability %v is not within [0, 1]", node.Human)
+		}
+		return nil
+	}
+	if node.Feature < 0 || node.Feature >= featureCount {
+		return fmt.Errorf("node reads feature %d of %d", node.Feature, featureCount)
+	}
+	if err := node.Left.check(featureCount); err != nil {
+		return err
+	}
+	return node.Right.check(featureCount)
+}
+
+func (tree *DecisionTree) HumanProbability(features SessionFeatures) float64 {
+	return tree.root.Classify(tree.vector.values(features))
+}
+
+// Classify walks down to the leaf of the values
+func (node *TreeNode) Classify(values []float64) float64 {
+	for !node.IsLeaf() {
+		if values[node.Feature] <= node.Threshold {
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+	return node.Human
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Gaussian naive Bayes
+///////////////////////////////////////////////////////////////////////////////
+
+// Gaussian is the distribution of a feature within a class
+type Gaussian struct {
+	Mean     float64
+	Variance float64
+}
+
+// NaiveBayesModel is the model of a Gaussian naive Bayes classifier, Human and
+// Robot are in the order of the Features of the model
+type NaiveBayesModel struct {
+	HumanPrior float64
+	Human      []Gaussian
+	Robot      []Gaussian
+}
+
+type NaiveBayes struct {
+	vector featureVector
+	model  NaiveBayesModel
+}
+
+// the variance of a feature which never changes in the training sessions
+const minVariance = 1e-6
+
+func NewNaiveBayes(features []string, model json.RawMessage) (Classifier, error) {
+	vector, err := newFeatureVector(features)
+	if err != nil {
+		return nil, err
+	}
+	bayes := &NaiveBayes{vector: vector}
+	if err := json.Unmarshal(model, &bayes.model); err != nil {
+		return nil, err
+	}
+	if bayes.model.HumanPrior <= 0 || bayes.model.HumanPrior >= 1 {
+		return nil, fmt.Errorf("HumanPrior %v is not within (0, 1)", bayes.model.HumanPrior)
+	}
+	if len(bayes.model.Human) != len(features) || len(bayes.model.Robot) != len(features) {
+		return nil, fmt.Errorf("expect %d gaussians per class", len(features))
+	}
+	return bayes, nil
+}
+
+func (bayes *NaiveBayes) HumanProbability(features SessionFeatures) float64 {
+	return bayes.model.Classify(bayes.vector.values(features))
+}
+
+// Classify return P(human|values), computed in logs so many features do not
+// underflow
+func (model *NaiveBayesModel) Classify(values []float64) float64 {
+	human := math.Log(model.HumanPrior)
+	robot := math.Log(1 - model.HumanPrior)
+	for i, value := range values {
+		human += logGaussian(value, model.Human[i])
+		robot += logGaussian(value, model.Robot[i])
+	}
+	// human / (human + robot)
+	return 1 / (1 + math.Exp(robot-human))
+}
+
+func logGaussian(value float64, gaussian Gaussian) float64 {
+	variance := math.Max(gaussian.Variance, minVariance)
+	delta := value - gaussian.Mean
+	return -0.5*math.Log(2*math.Pi*variance) - delta*delta/(2*variance)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecisionTree(t *testing.T) {
+	model := `{"Feature":1,"Threshold":0.5,
+		"Left":{"Feature":0,"Threshold":100,"Left":{"Human":0.95},"Right":{"Human":0.3}},
+		"Right":{"Human":0.02}}`
+	classifier, err := NewClassifier(ModelFile{Type: "decision_tree", Features: []string{"Requests", "EmptyRefererRatio"}, Model: json.RawMessage(model)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		features SessionFeatures
+		human    float64
+	}{
+		{SessionFeatures{Requests: 10, EmptyRefererRatio: 0.1}, 0.95},
+		{SessionFeatures{Requests: 500, EmptyRefererRatio: 0.5}, 0.3},
+		{SessionFeatures{Requests: 10, EmptyRefererRatio: 0.9}, 0.02},
+	} {
+		if human := classifier.HumanProbability(c.features); human != c.human {
+			t.Errorf("%+v got %v, want %v", c.features, human, c.human)
+		}
+	}
+
+	for _, modelFile := range []ModelFile{
+		{Type: "decision_tree", Features: []string{"RemoteAddr"}, Model: json.RawMessage(`{"Human":1}`)},
+		{Type: "decision_tree", Features: []string{"HumanProbability"}, Model: json.RawMessage(`{"Human":1}`)},
+		{Type: "decision_tree", Features: []string{"Requests"}, Model: json.RawMessage(`{"Feature":3,"Left":{},"Right":{}}`)},
+		{Type: "decision_tree", Features: []string{"Requests"}, Model: json.RawMessage(`{"Human":2}`)},
+		{Type: "neural_network", Features: []string{"Requests"}, Model: json.RawMessage(`{}`)},
+	} {
+		if _, err := NewClassifier(modelFile); err == nil {
+			t.Errorf("%s %v %s is accepted", modelFile.Type, modelFile.Features, modelFile.Model)
+		}
+	}
+}
+
+func TestNaiveBayes(t *testing.T) {
+	model := `{"HumanPrior":0.5,
+		"Human":[{"Mean":10,"Variance":4},{"Mean":0.2,"Variance":0.01}],
+		"Robot":[{"Mean":200,"Variance":400},{"Mean":0.9,"Variance":0}]}`
+	classifier, err := NewClassifier(ModelFile{Type: "naive_bayes", Features: []string{"Requests", "EmptyRefererRatio"}, Model: json.RawMessage(model)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if human := classifier.HumanProbability(SessionFeatures{Requests: 12, EmptyRefererRatio: 0.25}); human < 0.99 {
+		t.Errorf("a human session got %v", human)
+	}
+	if human := classifier.HumanProbability(SessionFeatures{Requests: 180, EmptyRefererRatio: 0.9}); human > 0.01 {
+		t.Errorf("a robot session got %v", human)
+	}
+	// far from both classes, the logs keep it from 0/0
+	if human := classifier.HumanProbability(SessionFeatures{Requests: 100000, EmptyRefererRatio: 5}); math.IsNaN(human) {
+		t.Errorf("an odd session got NaN")
+	}
+	if _, err := NewClassifier(ModelFile{Type: "naive_bayes", Features: []string{"Requests"}, Model: json.RawMessage(model)}); err == nil {
+		t.Errorf("gaussians of 2 features for 1 feature are accepted")
+	}
+}
+
+func TestClassifierRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "model.json")
+	data := `{"Type":"decision_tree","Version":"1","Features":["PropViewRatio"],
+		"Model":{"Feature":0,"Threshold":0.5,"Left":{"Human":0.95},"Right":{"Human":0.05}}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, modelFile, err := LoadClassifier(path); err != nil || modelFile.Version != "1" {
+		t.Fatalf("LoadClassifier got %+v %v", modelFile, err)
+	}
+	runtime, err := NewRuntime(HolmesConfig{ClassifierModel: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewRulePipeline([]RuleConf{
+		{Name: "human", Field: "RemoteAddr", Op: "classifier", Value: ">=0.9", OnMatch: RuleOutcome{Result: "YES"}},
+		{Name: "robot", Field: "RemoteAddr", Op: "classifier", Value: "<=0.1", OnMatch: RuleOutcome{Result: "NO"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accesslog := &AccessLog{RemoteAddr: "10.0.0.1"}
+	for _, c := range []struct {
+		session *SessionFeatures
+		result  int
+		rule    string
+	}{
+		{&SessionFeatures{Requests: 8, PropViewRatio: 0.2}, YES, "human"},
+		{&SessionFeatures{Requests: 8, PropViewRatio: 0.8}, NO, "robot"},
+		{&SessionFeatures{Requests: 2, PropViewRatio: 0.8}, UNKNOWN, ""},
+		{nil, UNKNOWN, ""},
+	} {
+		if verdict := pipeline.Decide(runtime, &FilterConns{}, accesslog, c.session); verdict.Result != c.result || verdict.Reason != c.rule {
+			t.Errorf("%+v got %s", c.session, verdict)
+		}
+	}
+	if verdict := pipeline.Decide(runtime, &FilterConns{}, accesslog, &SessionFeatures{Requests: 8, PropViewRatio: 0.8}); verdict.Class != BadRobot || verdict.Confidence < 0.9 {
+		t.Errorf("the robot session got %s", verdict)
+	}
+
+	for _, value := range []string{"", "0.9", ">=x", "<=1.5"} {
+		if _, err := NewRulePipeline([]RuleConf{{Name: "c", Field: "RemoteAddr", Op: "classifier", Value: value}}); err == nil {
+			t.Errorf("bound %q is accepted", value)
+		}
+	}
+}
@@ -1,45 +1,60 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
-	"log"
-	"os"
+	"fmt"
+	"io/ioutil"
 )
 
 type HolmesConfig struct {
-	RedisConfs []RedisConf
-	InLogDir   string
-	OutLogDir  string
+	RedisConfs      []RedisConf
+	InLogDir        string
+	OutLogDir       string
+	StageOffsetFile string // default is .holmes_stage_offset under InLogDir
+	ExportMaxBytes  int64  // rotate the exported file when it is larger than this
+	ExportInterval  int64  // rotate the exported file after this many seconds
+	InLogFormat     string // parser of the files under InLogDir, default is nginx
+	QueueLogFormat  string // parser of the accesslog list, default is tsv
+	NginxLogFormat  string // log_format used by the nginx_log_format parser
+	LogTimeZone     string // time zone of the TSV times, such as Asia/Shanghai
+	DeadLetterList  string // list of the lines which can not be parsed
+	FilterWorkers   int    // number of filter workers, default is 1
+	FilterRules     []RuleConf
+	WatchingRules   []RuleConf
+	BanRules        []BanRuleConf // when an IP is added to the BlackList, none by default
+	BlackListExport BlackListExportConf
+	WhiteListTTL    int64  // seconds an IP stays in the WhiteList after it was last seen, 0 is for ever
+	WatchingTTL     int64  // seconds a watching list is kept after its last record, 0 is for ever
+	RefererTTL      int64  // seconds the referers of an IP are kept after its last record, 0 is for ever
+	ExpiredWatching string // the records of an expired watching list are UNKNOWN (the default) or NO
+	SweepInterval   int64  // seconds between two sweeps of the expired entries, default is 60
+	SessionTimeout  int64  // seconds without a request which close a session, default is 1800
+	SessionKeep     int64  // seconds the last session of a client is kept in redis, default is 86400
+	ClassifierModel string // model file of the classifier rules, they never match without one
+	HTTPListen      string // address of the JSON API, such as 127.0.0.1:8036, "" is no API
+	AdminToken      string // bearer token of the admin API, "" turns it off
+	// search engine crawlers verified by DNS, default is DefaultCrawlers
+	Crawlers        []CrawlerConf
+	CrawlerResolver string // DNS server of the crawler checks, such as 127.0.0.1:53, "" is the system one
+	CrawlerCacheTTL int64  // seconds a crawler check is cached in redis, default is 86400
+	// records a session needs before the classifier rules score it, default is 5
+	ClassifierMinRequests int
+	// milliseconds between two flushes of the per minute counters, default is 1000
+	CounterFlushInterval int64
 }
 
-func LoadConfig(configPath string) HolmesConfig {
+// ReadConfig reads and checks the holmes config file
+func ReadConfig(configPath string) (HolmesConfig, error) {
 	var holmesConfig HolmesConfig
-	file, err := os.Open(configPath)
+	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		log.Fatal(err)
-	} else {
-		configReader := bufio.NewReader(file)
-		var content string
-		for {
-			line, err := configReader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					content = content + line
-					break
-				}
-				log.Fatal(err)
-			} else {
-				content = content + line
-			}
-		}
-		temp := []byte(content)
-		err := json.Unmarshal(temp, &holmesConfig)
-		if err != nil {
-			log.Fatal(err)
-		}
+		return holmesConfig, err
 	}
-	defer file.Close()
-	return holmesConfig
+	if err := json.Unmarshal(data, &holmesConfig); err != nil {
+		return holmesConfig, fmt.Errorf("%s: %s", configPath, err)
+	}
+	if len(holmesConfig.RedisConfs) < 3 {
+		return holmesConfig, fmt.Errorf("%s: expect 3 RedisConfs, got %d", configPath, len(holmesConfig.RedisConfs))
+	}
+	return holmesConfig, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultCounterFlushInterval = 1000 // milliseconds
+
+type counterKey struct {
+	ht    string
+	field string
+}
+
+// CounterBatch sums the per minute counters in memory and flushes them to
+// redis in one MULTI/EXEC every flush interval, instead of one HINCRBY round
+// trip per counter and record. Close flushes what is left.
+type CounterBatch struct {
+	redisConn *RedisConn
+	mutex     sync.Mutex
+	pending   map[counterKey]int64
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewCounterBatch return a batch flushed to the redis of redisConf every
+// interval, the default interval is 1 second
+func NewCounterBatch(redisConf RedisConf, interval time.Duration) *CounterBatch {
+	if interval <= 0 {
+		interval = defaultCounterFlushInterval * time.Millisecond
+	}
+	batch := &CounterBatch{
+		redisConn: NewRedisConn(redisConf),
+		pending:   map[counterKey]int64{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go batch.run(interval)
+	return batch
+}
+
+// NewMemoryCounterBatch return a batch which is never flushed, the counts are
+// read by Counts
+func NewMemoryCounterBatch() *CounterBatch {
+	return &CounterBatch{pending: map[counterKey]int64{}}
+}
+
+// Counts return the pending counts by hash and field
+func (batch *CounterBatch) Counts() map[string]map[string]int64 {
+	counts := map[string]map[string]int64{}
+	if batch == nil {
+		return counts
+	}
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	for key, count := range batch.pending {
+		if counts[key.ht] == nil {
+			counts[key.ht] = map[string]int64{}
+		}
+		counts[key.ht][key.field] += count
+	}
+	return counts
+}
+
+// CounterFlushInterval return the configured flush interval of the counters
+func CounterFlushInterval(holmesConfig HolmesConfig) time.Duration {
+	return time.Duration(holmesConfig.CounterFlushInterval) * time.Millisecond
+}
+
+// HashIncrby adds increment to the field of ht at the next flush
+func (batch *CounterBatch) HashIncrby(ht string, field string, increment int) {
+	if batch == nil {
+		return
+	}
+	batch.mutex.Lock()
+	batch.pending[counterKey{ht, field}] += int64(increment)
+	batch.mutex.Unlock()
+}
+
+// Flush sends the pending counts. When the transaction fails the counts are
+// put back and sent again by the next flush.
+func (batch *CounterBatch) Flush() error {
+	if batch == nil || batch.redisConn == nil {
+		return nil
+	}
+	pending := batch.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	cmds := make([]RedisCmd, 0, len(pending))
+	for key, increment := range pending {
+		cmds = append(cmds, NewRedisCmd("HINCRBY", key.ht, key.field, increment))
+	}
+	if _, err := batch.redisConn.Transaction(cmds); err != nil {
+		batch.putBack(pending)
+		return err
+	}
+	return nil
+}
+
+// take return the pending counts and start a new batch, the counts which
+// sum to 0 are dropped
+func (batch *CounterBatch) take() map[counterKey]int64 {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	pending := batch.pending
+	batch.pending = map[counterKey]int64{}
+	for key, increment := range pending {
+		if increment == 0 {
+			delete(pending, key)
+		}
+	}
+	return pending
+}
+
+func (batch *CounterBatch) putBack(pending map[counterKey]int64) {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	for key, increment := range pending {
+		batch.pending[key] += increment
+	}
+}
+
+func (batch *CounterBatch) run(interval time.Duration) {
+	defer close(batch.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-batch.stop:
+			return
+		case <-ticker.C:
+			if err := batch.Flush(); err != nil {
+				log.Println("(CounterBatch) flush failed, retry at next flush: ", err)
+			}
+		}
+	}
+}
+
+// Close stops the flush loop and flushes the pending counts. The last flush
+// is retried a few times, the counts which still can not be sent are logged.
+func (batch *CounterBatch) Close() {
+	if batch == nil || batch.stop == nil {
+		return
+	}
+	close(batch.stop)
+	<-batch.done
+	backoff := batch.redisConn.backoff
+	for i := 0; ; i++ {
+		err := batch.Flush()
+		if err == nil {
+			break
+		}
+		if i >= batch.redisConn.retries {
+			for key, increment := range batch.take() {
+				log.Println("(CounterBatch) lost counter ", key.ht, " ", key.field, " ", increment, ": ", err)
+			}
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	batch.redisConn.Close()
+}
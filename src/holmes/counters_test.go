@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCounterBatch(t *testing.T) {
+	batch := &CounterBatch{pending: map[counterKey]int64{}}
+	batch.HashIncrby("accesslog_result_total_request_per_min", "2013-07-09 15:20", 1)
+	batch.HashIncrby("accesslog_result_total_request_per_min", "2013-07-09 15:20", 1)
+	batch.HashIncrby("accesslog_result_vppv_watching_per_min", "2013-07-09 15:20", 1)
+	batch.HashIncrby("accesslog_result_vppv_watching_per_min", "2013-07-09 15:20", -1)
+
+	pending := batch.take()
+	total := counterKey{"accesslog_result_total_request_per_min", "2013-07-09 15:20"}
+	if len(pending) != 1 || pending[total] != 2 {
+		t.Errorf("take got %v", pending)
+	}
+
+	// a failed flush puts the counts back into the next batch
+	batch.HashIncrby("accesslog_result_total_request_per_min", "2013-07-09 15:20", 1)
+	batch.putBack(pending)
+	if pending := batch.take(); pending[total] != 3 {
+		t.Errorf("take after put back got %v", pending)
+	}
+
+	var nilBatch *CounterBatch
+	nilBatch.HashIncrby("accesslog_result_total_request_per_min", "2013-07-09 15:20", 1)
+	if err := nilBatch.Flush(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A self declared search engine crawler is verified by DNS: a reverse lookup
+// of its IP must give a name in a domain of the search engine, and a forward
+// lookup of the name must give the IP back. The names confirmed for an IP are
+// kept in CrawlerDNS_<ip> for CrawlerCacheTTL, "-" when there is none, "!"
+// for crawlerDNSErrorTTL when the DNS failed. The filter never waits for the
+// DNS: an IP which is not in the cache is queued, checked in the background,
+// and neither verified nor fake until then.
+const (
+	crawlerDNSKeyPrefix    = "CrawlerDNS_"
+	defaultCrawlerCacheTTL = 86400
+	crawlerDNSTimeout      = 2 * time.Second
+	crawlerDNSErrorTTL     = 60 * time.Second // a failed lookup is tried again after it
+	crawlerDNSQueueSize    = 1024
+	crawlerDNSWorkers      = 4
+	crawlerMemoryCacheSize = 100000 // IPs the verifier keeps in memory
+)
+
+// How a CrawlerVerifier looks an IP up which is not in the cache
+const (
+	CrawlerLookupQueued = iota // in the background, the filter goes on
+	CrawlerLookupAtOnce        // and waits for the answer, such as a replay with -dns
+	CrawlerLookupNever         // the IP stays unknown, such as a replay
+)
+
+// CrawlerConf is a search engine crawler in holmes.conf
+type CrawlerConf struct {
+	Name      string
+	UserAgent string   // regexp of the UserAgent the crawler declares itself with
+	Domains   []string // the reverse DNS names of its IPs are in one of them
+}
+
+// DefaultCrawlers are the crawlers verified when holmes.conf has no Crawlers
+var DefaultCrawlers = []CrawlerConf{
+	{Name: "Googlebot", UserAgent: `Googlebot|AdsBot-Google|Mediapartners-Google|Google-InspectionTool`, Domains: []string{"googlebot.com", "google.com"}},
+	{Name: "Bingbot", UserAgent: `bingbot|msnbot|BingPreview|adidxbot`, Domains: []string{"search.msn.com"}},
+	{Name: "Baiduspider", UserAgent: `Baiduspider`, Domains: []string{"baidu.com", "baidu.jp"}},
+	{Name: "YandexBot", UserAgent: `Yandex[A-Za-z]*/`, Domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{Name: "Sogou", UserAgent: `Sogou web spider|Sogou inst spider`, Domains: []string{"sogou.com"}},
+	{Name: "Applebot", UserAgent: `Applebot`, Domains: []string{"applebot.apple.com"}},
+	{Name: "Slurp", UserAgent: `Yahoo! Slurp`, Domains: []string{"crawl.yahoo.net"}},
+}
+
+// Crawler is a compiled CrawlerConf
+type Crawler struct {
+	CrawlerConf
+	userAgent *regexp.Regexp
+}
+
+// Owns tells whether a DNS name is in a domain of the crawler
+func (crawler *Crawler) Owns(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range crawler.Domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CrawlerVerifier checks the crawlers with the DNS server of CrawlerResolver.
+// The answers are kept in memory besides redis, the queued lookups are run by
+// crawlerDNSWorkers goroutines started at the first one, until Close.
+type CrawlerVerifier struct {
+	crawlers []*Crawler
+	resolver *net.Resolver
+	ttl      time.Duration
+	Lookup   int
+	mutex    sync.Mutex
+	cache    map[string]crawlerDNSEntry
+	queue    chan crawlerDNSCheck
+	start    sync.Once
+	done     chan struct{}
+	closed   sync.Once
+}
+
+type crawlerDNSEntry struct {
+	names   []string
+	known   bool // false while the IP is queued, or after the DNS failed
+	expires time.Time
+}
+
+type crawlerDNSCheck struct {
+	redisConn *RedisConn
+	ip        string
+}
+
+// NewCrawlerVerifier compiles the crawlers, resolver is the address of a DNS
+// server such as 127.0.0.1:53, "" is the resolver of the system
+func NewCrawlerVerifier(confs []CrawlerConf, resolver string, ttl int64) (*CrawlerVerifier, error) {
+	verifier := &CrawlerVerifier{
+		resolver: net.DefaultResolver,
+		ttl:      time.Duration(ttl) * time.Second,
+		cache:    map[string]crawlerDNSEntry{},
+		queue:    make(chan crawlerDNSCheck, crawlerDNSQueueSize),
+		done:     make(chan struct{}),
+	}
+	if ttl <= 0 {
+		verifier.ttl = defaultCrawlerCacheTTL * time.Second
+	}
+	for _, conf := range confs {
+		if conf.Name == "" || len(conf.Domains) == 0 {
+			return nil, fmt.Errorf("crawler %q needs a Name and Domains", conf.Name)
+		}
+		userAgent, err := regexp.Compile(conf.UserAgent)
+		if err != nil || conf.UserAgent == "" {
+			return nil, fmt.Errorf("crawler %s: UserAgent %q is not a regexp", conf.Name, conf.UserAgent)
+		}
+		domains := make([]string, len(conf.Domains))
+		for i, domain := range conf.Domains {
+			domains[i] = strings.ToLower(strings.Trim(domain, "."))
+		}
+		conf.Domains = domains
+		verifier.crawlers = append(verifier.crawlers, &Crawler{CrawlerConf: conf, userAgent: userAgent})
+	}
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return nil, fmt.Errorf("CrawlerResolver %q is not a host:port", resolver)
+		}
+		verifier.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return verifier, nil
+}
+
+// Claimed return the crawler a UserAgent declares itself as, or nil
+func (verifier *CrawlerVerifier) Claimed(userAgent string) *Crawler {
+	if verifier == nil {
+		return nil
+	}
+	for _, crawler := range verifier.crawlers {
+		if crawler.userAgent.MatchString(userAgent) {
+			return crawler
+		}
+	}
+	return nil
+}
+
+// Verify tells whether ip belongs to crawler, known is false when the DNS did
+// not tell yet
+func (verifier *CrawlerVerifier) Verify(redisConn *RedisConn, crawler *Crawler, ip string) (verified bool, known bool) {
+	names, known := verifier.ConfirmedNames(redisConn, ip)
+	for _, name := range names {
+		if crawler.Owns(name) {
+			return true, known
+		}
+	}
+	return false, known
+}
+
+// ConfirmedNames return the reverse DNS names of ip which resolve back to ip,
+// from the memory or from redis. When neither has ip, it is looked up as
+// Lookup says and known is false unless the lookup was done at once.
+func (verifier *CrawlerVerifier) ConfirmedNames(redisConn *RedisConn, ip string) (names []string, known bool) {
+	now := time.Now()
+	verifier.mutex.Lock()
+	entry, ok := verifier.cache[ip]
+	verifier.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.names, entry.known
+	}
+	cached, err := redisConn.Get(crawlerDNSKeyPrefix + ip)
+	logRedisError("CrawlerVerifier", err)
+	switch cached {
+	case "":
+	case "!":
+		verifier.remember(ip, crawlerDNSEntry{expires: now.Add(crawlerDNSErrorTTL)})
+		return nil, false
+	case "-":
+		verifier.remember(ip, crawlerDNSEntry{known: true, expires: now.Add(verifier.ttl)})
+		return nil, true
+	default:
+		names = strings.Fields(cached)
+		verifier.remember(ip, crawlerDNSEntry{names: names, known: true, expires: now.Add(verifier.ttl)})
+		return names, true
+	}
+
+	switch verifier.Lookup {
+	case CrawlerLookupAtOnce:
+		entry := verifier.check(redisConn, ip)
+		return entry.names, entry.known
+	case CrawlerLookupQueued:
+		// the IP is not queued again while it waits
+		verifier.remember(ip, crawlerDNSEntry{expires: now.Add(crawlerDNSTimeout + crawlerDNSErrorTTL)})
+		verifier.start.Do(func() {
+			for i := 0; i < crawlerDNSWorkers; i++ {
+				go verifier.work()
+			}
+		})
+		select {
+		case verifier.queue <- crawlerDNSCheck{redisConn: redisConn, ip: ip}:
+		case <-verifier.done:
+		default:
+			log.Println("(crawler) the DNS queue is full, ", ip, " is checked later")
+		}
+	}
+	return nil, false
+}
+
+func (verifier *CrawlerVerifier) work() {
+	for {
+		select {
+		case <-verifier.done:
+			return
+		case check := <-verifier.queue:
+			verifier.check(check.redisConn, check.ip)
+		}
+	}
+}
+
+// check looks ip up and keeps the answer in memory and in redis
+func (verifier *CrawlerVerifier) check(redisConn *RedisConn, ip string) crawlerDNSEntry {
+	names, err := verifier.resolve(ip)
+	entry := crawlerDNSEntry{names: names, known: true, expires: time.Now().Add(verifier.ttl)}
+	cached, ttl := "-", verifier.ttl
+	switch {
+	case err != nil:
+		log.Println("(crawler) can not verify ", ip, ", try again in ", crawlerDNSErrorTTL, ": ", err)
+		entry = crawlerDNSEntry{expires: time.Now().Add(crawlerDNSErrorTTL)}
+		cached, ttl = "!", crawlerDNSErrorTTL
+	case len(names) > 0:
+		cached = strings.Join(names, " ")
+	}
+	verifier.remember(ip, entry)
+	_, err = redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("SET", crawlerDNSKeyPrefix+ip, cached, "EX", int64(ttl/time.Second)),
+	})
+	logRedisError("CrawlerVerifier", err)
+	return entry
+}
+
+// remember keeps an entry in memory, the expired entries are dropped when the
+// memory is full, all of them if none expired
+func (verifier *CrawlerVerifier) remember(ip string, entry crawlerDNSEntry) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+	if len(verifier.cache) >= crawlerMemoryCacheSize {
+		now := time.Now()
+		for cachedIP, cached := range verifier.cache {
+			if now.After(cached.expires) {
+				delete(verifier.cache, cachedIP)
+			}
+		}
+		if len(verifier.cache) >= crawlerMemoryCacheSize {
+			verifier.cache = map[string]crawlerDNSEntry{}
+		}
+	}
+	verifier.cache[ip] = entry
+}
+
+// Close stops the lookups in the background, a lookup queued after it is
+// dropped
+func (verifier *CrawlerVerifier) Close() {
+	if verifier != nil {
+		verifier.closed.Do(func() { close(verifier.done) })
+	}
+}
+
+func (verifier *CrawlerVerifier) resolve(ip string) ([]string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("%q is not an IP", ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crawlerDNSTimeout)
+	defer cancel()
+	names, err := verifier.resolver.LookupAddr(ctx, ip)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	confirmed := []string{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		hosts, err := verifier.resolver.LookupHost(ctx, name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if addr.Equal(net.ParseIP(host)) {
+				confirmed = append(confirmed, name)
+				break
+			}
+		}
+	}
+	return confirmed, nil
+}
+
+// isNotFound tells whether a DNS lookup failed for a name without record,
+// which is an answer rather than a failure
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// compileCrawler builds the crawler op, Value verified matches the crawlers
+// verified by DNS, fake the ones which declare themselves as a crawler from
+// another network
+func compileCrawler(conf RuleConf) (func(ctx *RuleContext, value string) bool, error) {
+	if conf.Value != "verified" && conf.Value != "fake" {
+		return nil, fmt.Errorf("crawler needs verified or fake, got %q", conf.Value)
+	}
+	return func(ctx *RuleContext, value string) bool {
+		return ctx.verifyCrawler(value) == conf.Value
+	}, nil
+}
+
+// verifyCrawler checks the crawler the record declares once, it return
+// verified, fake or "" when the record is no crawler or the DNS did not tell
+func (ctx *RuleContext) verifyCrawler(userAgent string) string {
+	if ctx.crawlerChecked {
+		return ctx.crawler
+	}
+	ctx.crawlerChecked = true
+	crawler := ctx.runtime.Crawlers.Claimed(userAgent)
+	if crawler == nil {
+		return ""
+	}
+	verified, known := ctx.runtime.Crawlers.Verify(ctx.conns.Lists, crawler, ctx.accesslog.RemoteAddr)
+	switch {
+	case !known:
+	case verified:
+		ctx.crawler = "verified"
+	default:
+		ctx.crawler = "fake"
+	}
+	return ctx.crawler
+}
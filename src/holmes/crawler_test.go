@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubDNS answers the PTR and A queries of records over UDP, any other name
+// is NXDOMAIN
+func stubDNS(t *testing.T, records map[string][]string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if reply := stubAnswer(buffer[:n], records); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func stubAnswer(query []byte, records map[string][]string) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		n := int(query[i])
+		if i+1+n > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	reply := append([]byte{}, query[:2]...)
+	values, ok := records[name]
+	flags := uint16(0x8580) // response, authoritative, recursion
+	if !ok {
+		flags |= 3 // NXDOMAIN
+	}
+	answers := []byte{}
+	count := 0
+	for _, value := range values {
+		var data []byte
+		switch ip := net.ParseIP(value); {
+		case qtype == 1 && ip != nil && ip.To4() != nil:
+			data = ip.To4()
+		case qtype == 12 && ip == nil:
+			for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+				data = append(append(data, byte(len(label))), label...)
+			}
+			data = append(data, 0)
+		default:
+			continue
+		}
+		answers = append(answers, 0xc0, 12)
+		answers = binary.BigEndian.AppendUint16(answers, qtype)
+		answers = binary.BigEndian.AppendUint16(answers, 1)
+		answers = binary.BigEndian.AppendUint32(answers, 60)
+		answers = binary.BigEndian.AppendUint16(answers, uint16(len(data)))
+		answers = append(answers, data...)
+		count++
+	}
+	reply = binary.BigEndian.AppendUint16(reply, flags)
+	reply = binary.BigEndian.AppendUint16(reply, 1)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(count))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, question...)
+	return append(reply, answers...)
+}
+
+func TestCrawlerVerifier(t *testing.T) {
+	dns := stubDNS(t, map[string][]string{
+		"1.66.249.66.in-addr.arpa":        {"crawl-66-249-66-1.googlebot.com"},
+		"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+		// a fake Googlebot whose reverse name is in the domain of Google,
+		// but Google does not resolve it back
+		"2.0.0.10.in-addr.arpa":          {"crawl-10-0-0-2.googlebot.com"},
+		"crawl-10-0-0-2.googlebot.com":   {"66.249.66.2"},
+		"3.0.0.10.in-addr.arpa":          {"host.googlebot.com.example.net"},
+		"host.googlebot.com.example.net": {"10.0.0.3"},
+	})
+	defer dns.Close()
+	verifier, err := NewCrawlerVerifier(DefaultCrawlers, dns.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.Lookup = CrawlerLookupAtOnce
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	crawler := verifier.Claimed(googlebot)
+	if crawler == nil || crawler.Name != "Googlebot" || verifier.Claimed("Mozilla/5.0 (Windows NT 6.1)") != nil {
+		t.Fatalf("Claimed got %+v", crawler)
+	}
+	for _, c := range []struct {
+		ip   string
+		want bool
+	}{
+		{"66.249.66.1", true},
+		{"10.0.0.2", false},
+		{"10.0.0.3", false},
+		{"10.0.0.4", false}, // no reverse name
+	} {
+		if verified, known := verifier.Verify(nil, crawler, c.ip); !known || verified != c.want {
+			t.Errorf("%s got %v %v", c.ip, verified, known)
+		}
+	}
+	if verified, _ := verifier.Verify(nil, verifier.Claimed("Baiduspider"), "66.249.66.1"); verified {
+		t.Errorf("a Googlebot IP is verified as Baiduspider")
+	}
+	// a DNS failure is neither verified nor fake, and kept for a while
+	down, _ := NewCrawlerVerifier(DefaultCrawlers, "127.0.0.1:1", 0)
+	down.Lookup = CrawlerLookupAtOnce
+	if verified, known := down.Verify(nil, crawler, "66.249.66.1"); verified || known || down.cache["66.249.66.1"].expires.After(time.Now().Add(crawlerDNSErrorTTL)) {
+		t.Errorf("a failed lookup got %v %v %+v", verified, known, down.cache["66.249.66.1"])
+	}
+
+	runtime, err := NewRuntime(HolmesConfig{CrawlerResolver: dns.LocalAddr().String()}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Crawlers.Close()
+	conns := &FilterConns{Counters: NewMemoryCounterBatch()}
+	filter := func(ip string) Verdict {
+		accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: "20", Sec: "00",
+			RemoteAddr: ip, UserAgent: googlebot, RequestURI: "/prop/view/1", HttpCode: "200"}
+		return DoFilter(runtime, conns, &accesslog)
+	}
+	// the filter does not wait for the DNS, the IPs are checked in the
+	// background
+	for _, ip := range []string{"66.249.66.1", "10.0.0.2"} {
+		if verdict := filter(ip); verdict.Reason == "good_robot" || verdict.Reason == "fake_robot" {
+			t.Errorf("%s got %s before the DNS answered", ip, verdict)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_, known1 := runtime.Crawlers.ConfirmedNames(nil, "66.249.66.1")
+		_, known2 := runtime.Crawlers.ConfirmedNames(nil, "10.0.0.2")
+		if known1 && known2 {
+			break
+		}
+	}
+	conns.Counters = NewMemoryCounterBatch()
+	for _, c := range []struct {
+		ip     string
+		result int
+	}{
+		{"66.249.66.1", UNKNOWN},
+		{"10.0.0.2", NO},
+	} {
+		if verdict := filter(c.ip); verdict.Result != c.result {
+			t.Errorf("%s got %s", c.ip, verdict)
+		}
+	}
+	counts := conns.Counters.Counts()
+	if counts["accesslog_result_good_robot_per_min"]["2013-07-09 15:20"] != 1 || counts["accesslog_result_fake_robot_per_min"]["2013-07-09 15:20"] != 1 {
+		t.Errorf("counters are %v", counts)
+	}
+
+	if _, err := NewCrawlerVerifier([]CrawlerConf{{Name: "a", UserAgent: "(", Domains: []string{"a.com"}}}, "", 0); err == nil {
+		t.Errorf("a bad UserAgent regexp is accepted")
+	}
+	if _, err := NewCrawlerVerifier(DefaultCrawlers, "127.0.0.1", 0); err == nil {
+		t.Errorf("a resolver without port is accepted")
+	}
+}
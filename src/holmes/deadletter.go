@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const defaultDeadLetterList = "accesslog_dead"
+
+// DeadLetter is an input line which can not be parsed. It is kept in the dead
+// letter list with the reason, so bad input can be inspected instead of
+// stopping holmes.
+type DeadLetter struct {
+	Time   string
+	Source string // stage or filter
+	Reason string
+	Line   string
+}
+
+// DeadLetterList return the configured dead letter list
+func DeadLetterList(holmesConfig HolmesConfig) string {
+	if holmesConfig.DeadLetterList == "" {
+		return defaultDeadLetterList
+	}
+	return holmesConfig.DeadLetterList
+}
+
+// PushDeadLetter push a malformed line into the dead letter list of redisConn
+// and count it in accesslog_result_malformed_per_min of counters, an error
+// means the line was not kept
+func PushDeadLetter(redisConn *RedisConn, counters *CounterBatch, list string, source string, line string, reason error) error {
+	now := time.Now().In(LogLocation)
+	deadLetter := DeadLetter{
+		Time:   now.Format("2006-01-02 15:04:05"),
+		Source: source,
+		Reason: reason.Error(),
+		Line:   line,
+	}
+	data, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+	if _, err := redisConn.ListLeftPush(list, string(data)); err != nil {
+		return err
+	}
+	counters.HashIncrby("accesslog_result_malformed_per_min", now.Format("2006-01-02 15:04"), 1)
+	return nil
+}
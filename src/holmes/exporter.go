@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExportMaxBytes = 64 * 1024 * 1024
+	defaultExportInterval = 3600 // seconds
+)
+
+// ResultLists are the redis lists which Filter push the classified records
+// into, keyed by the result of DoFilter. A record is followed by the columns of
+// its Verdict: result, class, reason and confidence, 27 columns in all where
+// an older holmes wrote 24. A watched record is pushed once, with its verdict
+// when its watching list is resolved or expires.
+var ResultLists = map[int]string{
+	YES:     "accesslog_yes",
+	NO:      "accesslog_no",
+	UNKNOWN: "accesslog_unknown",
+}
+
+// VerdictString return the name of a result of DoFilter
+func VerdictString(result int) string {
+	switch result {
+	case YES:
+		return "YES"
+	case NO:
+		return "NO"
+	}
+	return "UNKNOWN"
+}
+
+// exportingList holds the records taken from a result list until the file they
+// are written into is committed, so a crash of the exporter loses none of them
+func exportingList(list string) string {
+	return list + "_exporting"
+}
+
+// exportTakeScript moves the oldest record of the first result list which has
+// one into its exporting list, KEYS are the result lists then their exporting
+// lists. It return the result list and the record, or nil.
+var exportTakeScript = NewRedisScript(2*len(ResultLists), `
+local n = #KEYS / 2
+for i = 1, n do
+	local line = redis.call('RPOPLPUSH', KEYS[i], KEYS[n + i])
+	if line then
+		return {KEYS[i], line}
+	end
+end
+return false
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	n := len(keys) / 2
+	for i := 0; i < n; i++ {
+		if line := db.Do("RPOPLPUSH", keys[i], keys[n+i]); line != nil {
+			return []interface{}{[]byte(keys[i]), line}
+		}
+	}
+	return nil
+})
+
+// exportLine is the line a record of a result list is exported as
+func exportLine(list string, line string) string {
+	if strings.Count(line, "\t") != 22 {
+		return line
+	}
+	// a bare record of 23 columns, pushed before the filter wrote its verdict
+	// along
+	for result, resultList := range ResultLists {
+		if resultList == list {
+			return line + "\t" + VerdictString(result)
+		}
+	}
+	return line
+}
+
+// Exporter writes the classified records into rolling files. A file is written
+// under a hidden temporary name and only renamed to its final name after it is
+// synced to disk, so the downstream jobs only ever see finished files.
+// Committed is called after each commit.
+type Exporter struct {
+	dir       string
+	maxBytes  int64
+	interval  time.Duration
+	file      *os.File
+	writer    *bufio.Writer
+	name      string // final name of the current file
+	size      int64
+	opened    time.Time
+	partition string
+	Committed func()
+}
+
+func NewExporter(dir string, maxBytes int64, interval time.Duration) *Exporter {
+	if maxBytes <= 0 {
+		maxBytes = defaultExportMaxBytes
+	}
+	if interval <= 0 {
+		interval = defaultExportInterval * time.Second
+	}
+	return &Exporter{
+		dir:      dir,
+		maxBytes: maxBytes,
+		interval: interval,
+	}
+}
+
+// Export drains the result lists into OutLogDir, it commits the current file
+// and return after stop is closed. A record stays in the exporting list of its
+// result list until its file is committed. After a restart or a failed write
+// the records of the exporting lists are written again into a new file, so a
+// record is exported at least once.
+func Export(holmesConfig HolmesConfig, stop <-chan struct{}) {
+	exporter := NewExporter(holmesConfig.OutLogDir, holmesConfig.ExportMaxBytes, time.Duration(holmesConfig.ExportInterval)*time.Second)
+	redisConn := NewRedisConn(holmesConfig.RedisConfs[0])
+	defer redisConn.Close()
+
+	lists := []string{ResultLists[YES], ResultLists[NO], ResultLists[UNKNOWN]}
+	keys := []interface{}{}
+	for _, list := range lists {
+		keys = append(keys, list)
+	}
+	exporting := []RedisCmd{}
+	for _, list := range lists {
+		keys = append(keys, exportingList(list))
+		exporting = append(exporting, NewRedisCmd("DEL", exportingList(list)))
+	}
+	exporter.Committed = func() {
+		_, err := redisConn.Pipeline(exporting)
+		logRedisError("Export", err)
+	}
+
+	recovered := false
+	for {
+		select {
+		case <-stop:
+			if err := exporter.Commit(); err != nil {
+				log.Println("(Export) ", err)
+			}
+			return
+		default:
+		}
+		var err error
+		if !recovered {
+			if err = exporter.Recover(redisConn, lists, time.Now()); err == nil {
+				recovered = true
+			}
+		} else {
+			var list, line string
+			list, line, err = pair(redisConn.EvalScript(exportTakeScript, keys...))
+			switch {
+			case err != nil:
+				log.Println("(Export) ", err)
+				time.Sleep(time.Second)
+				continue
+			case line == "":
+				err = exporter.Tick(time.Now())
+				select {
+				case <-stop:
+				case <-time.After(time.Second):
+				}
+			default:
+				err = exporter.Write(time.Now(), exportLine(list, line))
+			}
+		}
+		if err != nil {
+			// the records of the file are still in the exporting lists
+			log.Println("(Export) write them again into a new file: ", err)
+			exporter.Abort()
+			recovered = false
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// Recover makes sure the directory exists and writes the records left in the
+// exporting lists of lists into the current file. The temporary files left by
+// a crash are removed when their records are in the exporting lists, and
+// committed otherwise, so no record is lost. The delivery is at least once: a
+// crash between the commit of a file and the DEL of its exporting lists
+// exports their records again in the next file.
+func (exporter *Exporter) Recover(redisConn *RedisConn, lists []string, now time.Time) error {
+	if err := os.MkdirAll(exporter.dir, 0755); err != nil {
+		return err
+	}
+	records := []string{}
+	for _, list := range lists {
+		lines, err := redisConn.ListRange(exportingList(list), 0, -1)
+		if err != nil {
+			return err
+		}
+		// the newest record is at the left
+		for i := len(lines) - 1; i >= 0; i-- {
+			records = append(records, exportLine(list, lines[i]))
+		}
+	}
+	temps, err := filepath.Glob(filepath.Join(exporter.dir, ".accesslog_result.*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if exporter.file != nil && temp == exporter.tempPath() {
+			continue
+		}
+		if len(records) > 0 {
+			err = os.Remove(temp)
+		} else {
+			log.Println("(Export) commit the file left by a crash ", temp)
+			err = commitTemp(temp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// the records go into one file, a commit between them would remove the
+	// ones not written yet from the exporting lists
+	for _, record := range records {
+		if err := exporter.write(now, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitTemp renames a temporary file to its final name, a partial last line
+// is cut
+func commitTemp(temp string) error {
+	data, err := ioutil.ReadFile(temp)
+	if err != nil {
+		return err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		if err := os.Truncate(temp, int64(end)); err != nil {
+			return err
+		}
+	}
+	dir, base := filepath.Split(temp)
+	name := strings.TrimSuffix(strings.TrimPrefix(base, "."), ".tmp")
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		name = strings.TrimSuffix(name, ".log") + ".recovered.log"
+	}
+	return os.Rename(temp, filepath.Join(dir, name))
+}
+
+// Write append a line to the current file, the file is committed first when
+// it is full, too old or belongs to an earlier hour
+func (exporter *Exporter) Write(now time.Time, line string) error {
+	if err := exporter.Tick(now); err != nil {
+		return err
+	}
+	return exporter.write(now, line)
+}
+
+func (exporter *Exporter) write(now time.Time, line string) error {
+	if exporter.file == nil {
+		if err := exporter.open(now); err != nil {
+			return err
+		}
+	}
+	n, err := exporter.writer.WriteString(line + "\n")
+	exporter.size += int64(n)
+	return err
+}
+
+// Tick commit the current file if it should be rotated at now
+func (exporter *Exporter) Tick(now time.Time) error {
+	if exporter.file == nil {
+		return nil
+	}
+	if exporter.size >= exporter.maxBytes ||
+		now.Sub(exporter.opened) >= exporter.interval ||
+		now.Format("2006010215") != exporter.partition {
+		return exporter.Commit()
+	}
+	return nil
+}
+
+// open creates the next file of the hour, a name already used by a committed
+// or a temporary file is skipped
+func (exporter *Exporter) open(now time.Time) error {
+	exporter.partition = now.Format("2006010215")
+	var file *os.File
+	for seq := 0; file == nil; seq++ {
+		exporter.name = fmt.Sprintf("accesslog_result.%s.%d.log", exporter.partition, seq)
+		if _, err := os.Stat(filepath.Join(exporter.dir, exporter.name)); !os.IsNotExist(err) {
+			continue
+		}
+		var err error
+		file, err = os.OpenFile(exporter.tempPath(), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	exporter.file = file
+	exporter.writer = bufio.NewWriter(file)
+	exporter.size = 0
+	exporter.opened = now
+	return nil
+}
+
+func (exporter *Exporter) tempPath() string {
+	return filepath.Join(exporter.dir, "."+exporter.name+".tmp")
+}
+
+// Commit flush and fsync the current file, then rename it to its final name
+func (exporter *Exporter) Commit() error {
+	if exporter.file == nil {
+		return nil
+	}
+	file := exporter.file
+	exporter.file = nil
+	if err := exporter.writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(exporter.tempPath(), filepath.Join(exporter.dir, exporter.name)); err != nil {
+		return err
+	}
+	dir, err := os.Open(exporter.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return err
+	}
+	if exporter.Committed != nil {
+		exporter.Committed()
+	}
+	return nil
+}
+
+// Abort closes and removes the current file
+func (exporter *Exporter) Abort() {
+	if exporter.file == nil {
+		return
+	}
+	exporter.file.Close()
+	exporter.file = nil
+	if err := os.Remove(exporter.tempPath()); err != nil && !os.IsNotExist(err) {
+		log.Println("(Export) ", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outDir := filepath.Join(dir, "out")
+	now := time.Date(2013, 7, 9, 15, 20, 0, 0, time.Local)
+
+	// a crash left the temporary file of the first file of the hour
+	exporter := NewExporter(outDir, 0, 0)
+	commits := 0
+	exporter.Committed = func() { commits++ }
+	if err := exporter.Recover(nil, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Write(now, "a"); err != nil {
+		t.Fatal(err)
+	}
+	exporter.writer.WriteString("b\npart")
+	exporter.writer.Flush()
+	exporter.file.Close()
+
+	// the restarted exporter does not truncate it but commits its complete lines
+	exporter = NewExporter(outDir, 0, 0)
+	if err := exporter.Write(now, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.name != "accesslog_result.2013070915.1.log" {
+		t.Errorf("the new file is %s", exporter.name)
+	}
+	if err := exporter.Recover(nil, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "accesslog_result.2013070915.0.log"))
+	if err != nil || string(data) != "a\nb\n" {
+		t.Errorf("the recovered file is %q %v", data, err)
+	}
+
+	// an aborted file is removed, its records are still in the exporting lists
+	exporter.Abort()
+	if names, _ := filepath.Glob(filepath.Join(outDir, ".*.tmp")); len(names) != 0 {
+		t.Errorf("temporary files %v are left", names)
+	}
+	if err := exporter.Write(now, "d"); err != nil {
+		t.Fatal(err)
+	}
+	exporter.Committed = func() { commits++ }
+	if err := exporter.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(outDir, "accesslog_result.2013070915.1.log"))
+	if err != nil || string(data) != "d\n" || commits != 1 {
+		t.Errorf("the committed file is %q %v, %d commits", data, err, commits)
+	}
+}
+
+func TestExportLine(t *testing.T) {
+	bare := strings.Repeat("x\t", 22) + "x"
+	if line := exportLine(ResultLists[NO], bare); line != bare+"\tNO" {
+		t.Errorf("a bare record is exported as %q", line)
+	}
+	classified := bare + "\t" + Verdict{Result: YES, Class: Human}.String()
+	if line := exportLine(ResultLists[YES], classified); line != classified {
+		t.Errorf("a classified record is exported as %q", line)
+	}
+}
+
+func TestExportTakeScript(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"exportTake", [][]interface{}{{"RPUSH", "accesslog_no", "a", "b"}}, exportTakeScript, exportTakeKeys()},
+		{"exportTake none", nil, exportTakeScript, exportTakeKeys()},
+	})
+}
+
+// exportTakeKeys are the keys Export runs exportTakeScript with
+func exportTakeKeys() []interface{} {
+	keys := []interface{}{ResultLists[YES], ResultLists[NO], ResultLists[UNKNOWN]}
+	for _, list := range keys[:3] {
+		keys = append(keys, exportingList(list.(string)))
+	}
+	return keys
+}
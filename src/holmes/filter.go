@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strings"
-	//"net"
-	//"net/http"
-	//"log"
-	"regexp"
+	"github.com/garyburd/redigo/redis"
+	"hash/fnv"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,249 +19,521 @@ const (
 	UNKNOWN
 )
 
-var redisConn1 *RedisConn
-var redisConn2 *RedisConn
-var redisConn3 *RedisConn
-
-func Filter(holmesConfig HolmesConfig) {
-	var accesslogLine string
-	var accesslog AccessLog
-	var filterResult int
-	//var i int
-	redisConn1 = NewRedisConn(holmesConfig.RedisConfs[0])
-	defer redisConn1.Close()
-	redisConn2 = NewRedisConn(holmesConfig.RedisConfs[1])
-	defer redisConn2.Close()
-	redisConn3 = NewRedisConn(holmesConfig.RedisConfs[2])
-	defer redisConn3.Close()
+// FilterConns are the redis connections of one filter worker
+type FilterConns struct {
+	Queue    *RedisConn    // RedisConfs[0]: accesslog list, result lists and dead letters
+	Lists    *RedisConn    // RedisConfs[1]: white, watching and referer lists
+	Counters *CounterBatch // RedisConfs[2]: per minute counters
+}
+
+func NewFilterConns(holmesConfig HolmesConfig) *FilterConns {
+	redisConfs := holmesConfig.RedisConfs
+	return &FilterConns{
+		Queue:    NewRedisConn(redisConfs[0]),
+		Lists:    NewRedisConn(redisConfs[1]),
+		Counters: NewCounterBatch(redisConfs[2], CounterFlushInterval(holmesConfig)),
+	}
+}
+
+// Close flushes the counters and closes the connections
+func (conns *FilterConns) Close() {
+	conns.Queue.Close()
+	conns.Lists.Close()
+	conns.Counters.Close()
+}
+
+// A record popped by the filter is kept in the processing list of its host
+// until its verdict is pushed, the records a crashed filter left there are
+// queued again when it starts, so they are filtered once more rather than lost.
+func filterProcessingList() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "accesslog_processing_" + host
+}
+
+// requeueScript moves the records of the processing list KEYS[1] back to the
+// right side of the accesslog list KEYS[2], the oldest is popped first
+var requeueScript = NewRedisScript(2, `
+local n = 0
+local line = redis.call('LPOP', KEYS[1])
+while line do
+	redis.call('RPUSH', KEYS[2], line)
+	n = n + 1
+	line = redis.call('LPOP', KEYS[1])
+end
+return n
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	n := int64(0)
+	for line := db.Do("LPOP", keys[0]); line != nil; line = db.Do("LPOP", keys[0]) {
+		db.Do("RPUSH", keys[1], string(line.([]byte)))
+		n++
+	}
+	return n
+})
 
+// RequeueProcessing queues again the records left in processing
+func RequeueProcessing(redisConn *RedisConn, processing string) (int64, error) {
+	return redisInt64(redisConn.EvalScript(requeueScript, processing, "accesslog"))
+}
+
+type filterRecord struct {
+	line      string
+	accesslog AccessLog
+}
+
+// FilterWorker classifies the records of one shard of the client IPs. All the
+// records of an IP go to the same worker in the order of the queue, so the
+// watching list of an IP is never processed by two workers at once.
+type FilterWorker struct {
+	records    chan filterRecord
+	processing string
+}
+
+// Filter pops the records of the accesslog list into the processing list and
+// dispatch them to FilterWorkers workers by RemoteAddr. It return after stop is
+// closed and the workers have finished their records and flushed their
+// counters.
+func Filter(stop <-chan struct{}) {
+	runtime := CurrentRuntime()
+	workerNum := runtime.Config.FilterWorkers
+	if workerNum <= 0 {
+		workerNum = 1
+	}
+	processing := filterProcessingList()
+	var running sync.WaitGroup
+	workers := make([]*FilterWorker, workerNum)
+	for i := range workers {
+		workers[i] = &FilterWorker{records: make(chan filterRecord, 1024), processing: processing}
+		running.Add(1)
+		go func(worker *FilterWorker) {
+			defer running.Done()
+			worker.Run()
+		}(workers[i])
+	}
+
+	redisConfs := runtime.Config.RedisConfs
+	conns := NewFilterConns(runtime.Config)
+	defer func() { conns.Close() }()
+	if n, err := RequeueProcessing(conns.Queue, processing); err != nil {
+		log.Println("(Filter) requeue ", processing, ": ", err)
+	} else if n > 0 {
+		log.Println("(Filter) ", n, " records left in ", processing, " are queued again")
+	}
 	for {
-		//log.Println("start to get a log from redis-6379")
-		_, accesslogLine = redisConn1.BlockListRightPop("accesslog", 5)
-		//fmt.Printf("%dfilter==>%s\n", i, accesslogLine)
-		//log.Println("finished get a log from redis-6379")
+		select {
+		case <-stop:
+			for _, worker := range workers {
+				close(worker.records)
+			}
+			running.Wait()
+			err := StoreSessions(conns.Lists, runtime.Config, sessions.Close(time.Time{}))
+			logRedisError("Filter", err)
+			return
+		default:
+		}
+		runtime = CurrentRuntime()
+		if !reflect.DeepEqual(runtime.Config.RedisConfs, redisConfs) {
+			log.Println("(Filter) RedisConfs changed, reconnect")
+			conns.Close()
+			redisConfs = runtime.Config.RedisConfs
+			conns = NewFilterConns(runtime.Config)
+		}
+		accesslogLine, err := conns.Queue.BlockListRightPopLeftPush("accesslog", processing, 5)
+		if err != nil {
+			log.Println("(Filter) pop the accesslog list: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
 		if accesslogLine == "" {
 			fmt.Printf("%s now list have no log to process,continue to wait others to add log to list\n", time.Now())
 			continue
 		}
 
-		accesslog = GetLog(accesslogLine)
-		//i++
-		//if i%100000 == 0 {
-		//fmt.Printf("%s holmes have processed %d logs\n", time.Now(), i)
-		//}
-
-		logTimeMin := accesslog.LogTimeMinString()
-		redisConn3.HashIncrby("accesslog_result_total_request_per_min", logTimeMin, 1)
-		//log.Println("start to do filter")
-		filterResult = DoFilter(redisConn2, &accesslog)
-		//log.Println("finished to do filter")
-		//  these should done in filter function
-		//
-		if filterResult == YES {
-			logTimeMin = accesslog.LogTimeMinString()
-			//log.Println("Result of DoFilter() is YES,increment accesslog_result_vppv_per_min at ",logTimeMin)
-			redisConn3.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
-			//redisConn.ListLeftPush("accesslog_yes", accesslogLine)
+		accesslog, err := runtime.QueueParser.Parse(accesslogLine)
+		if err == nil {
+			_, err = accesslog.LogTime()
 		}
-		//else if filterResult == NO {
-		//	redisConn.ListLeftPush("accesslog_no", accesslogLine)
-		//} else {
-		//	redisConn.ListLeftPush("accesslog_unkown", accesslogLine)
-		//}
+		if err != nil {
+			err = PushDeadLetter(conns.Queue, conns.Counters, DeadLetterList(runtime.Config), "filter", accesslogLine, err)
+			logRedisError("Filter", err)
+			if err == nil {
+				_, err = conns.Queue.ListRem(processing, -1, accesslogLine)
+				logRedisError("Filter", err)
+			}
+			continue
+		}
+		workers[fnv32(accesslog.RemoteAddr)%uint32(workerNum)].records <- filterRecord{line: accesslogLine, accesslog: accesslog}
 	}
 }
 
-func DoFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	return UserAgentFilter(redisConn, accesslog)
-}
-
-func UserAgentFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	//log.Println("enter UserAgentFilter()")
-	ua := strings.ToLower(accesslog.UserAgent)
-	logTimeMin := accesslog.LogTimeMinString()
-	if accesslog.UserAgent == "-" || strings.Contains(ua, "bot") || strings.Contains(ua, "spider") {
-		redisConn3.HashIncrby("accesslog_result_ua_not_pass_per_min", logTimeMin, 1)
-		return NO
-	} else {
-		uaFamily := Parse(accesslog.UserAgent)
-		//log.Println("after Parse fun in UserAgentFilter()")
-		if uaFamily == "" {
-			redisConn3.HashIncrby("accesslog_result_ua_not_pass_per_min", logTimeMin, 1)
-			return NO
-		} else {
-			uaFamily = strings.ToLower(uaFamily)
-			//if strings.Contains(uaFamily, "bot") {
-			//redisConn3.HashIncrby("accesslog_result_ua_not_pass_per_min", logTimeMin, 1)
-			//return NO
-			//} else {
-			redisConn3.HashIncrby("accesslog_result_ua_pass_per_min", logTimeMin, 1)
-			redisConn3.HashIncrby("accesslog_result_ua_statistic", uaFamily, 1)
-			AddRefererList(redisConn, accesslog)
-			return URIFilter(redisConn, accesslog)
-			//}
+// Run classifies the records sent to the worker, it return when the records
+// channel is closed
+func (worker *FilterWorker) Run() {
+	runtime := CurrentRuntime()
+	redisConfs := runtime.Config.RedisConfs
+	conns := NewFilterConns(runtime.Config)
+	defer func() { conns.Close() }()
+	for record := range worker.records {
+		runtime = CurrentRuntime()
+		if !reflect.DeepEqual(runtime.Config.RedisConfs, redisConfs) {
+			conns.Close()
+			redisConfs = runtime.Config.RedisConfs
+			conns = NewFilterConns(runtime.Config)
+		}
+		accesslog := record.accesslog
+		logTimeMin := accesslog.LogTimeMinString()
+		conns.Counters.HashIncrby("accesslog_result_total_request_per_min", logTimeMin, 1)
+		verdict := DoFilter(runtime, conns, &accesslog)
+		if verdict.Result == YES {
+			conns.Counters.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
+		}
+		CountClass(conns.Counters, logTimeMin, verdict.Class)
+		// the record leaves the processing list along with its verdict, a
+		// watched record is pushed when its watching list is resolved
+		cmds := []RedisCmd{NewRedisCmd("LREM", worker.processing, -1, record.line)}
+		if !verdict.Watched {
+			cmds = append(cmds, NewRedisCmd("LPUSH", ResultLists[verdict.Result], accesslog.String()+"\t"+verdict.String()))
 		}
+		_, err := conns.Queue.Transaction(cmds)
+		logRedisError("FilterWorker", err)
 	}
 }
 
-func URIFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	//
-	//redisConn.SetAdd(accesslog.RemoteAddr, accesslog.RequestURI) // record all logs of each ip
-	logTimeMin := accesslog.LogTimeMinString()
-	if matched, err := regexp.MatchString("^/prop/view/", accesslog.RequestURI); err == nil && matched {
-		redisConn3.HashIncrby("accesslog_result_vppv_total_per_min", logTimeMin, 1)
-		return HttpCodeFilter(redisConn, accesslog)
-	} else {
-		Analysis(redisConn, accesslog)
-		return UNKNOWN
+// PushWatchedRecords pushes the resolved or expired watched records into the
+// result lists with their verdicts, they were not pushed when they were watched
+func PushWatchedRecords(conns *FilterConns, records []WatchedRecord) error {
+	if len(records) == 0 {
+		return nil
 	}
+	cmds := make([]RedisCmd, len(records))
+	for i, record := range records {
+		cmds[i] = NewRedisCmd("LPUSH", ResultLists[record.Verdict.Result], record.AccessLog.String()+"\t"+record.Verdict.String())
+	}
+	_, err := conns.Queue.Pipeline(cmds)
+	return err
 }
 
-func HttpCodeFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	logTimeMin := accesslog.LogTimeMinString()
-	redisConn3.HashIncrby("accesslog_result_vppv_code_"+accesslog.HttpCode+"_per_min", logTimeMin, 1)
-
-	if matched, err := regexp.MatchString("^2", accesslog.HttpCode); err == nil && matched {
-		return WhiteIpFilter(redisConn, accesslog)
-	} else {
-		return UNKNOWN
-	}
+func fnv32(s string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(s))
+	return hash.Sum32()
 }
 
-func RefererFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	logTimeMin := accesslog.LogTimeMinString()
-	/*if accesslog.Referer == "-" && accesslog.GUID == "-" {
-		return NO
-	}
-	if accesslog.Referer == "-" && accesslog.GUID != "-" {
-		if redisConn.SetIsMember("s.anjuke.com", accesslog.RemoteAddr) == 1 {
-			return YES
-		} else {
-			return NO
-		}
-	}*/
-	if strings.Contains(accesslog.Referer, "my.anjuke.com") == true {
-		//log.Println(accesslog.String(), "is come from my.anjuke.com")
-		redisConn3.HashIncrby("accesslog_result_vppv_from_my_per_min", logTimeMin, 1)
-		return NO
-	} else {
-		/*if redisConn.SetIsMember("Referer_"+accesslog.RemoteAddr, accesslog.Referer) == 1 {
-			log.Println(accesslog.String(), "is come from ", accesslog.Referer)
-			return YES
-		} else {
-			//log.Println(accesslog.String(),"is not come from ",accesslog.Referer)
-			return NO
-		}*/
-		if accesslog.Referer != "-" {
-			//log.Println(accesslog.String(), "is come from ", accesslog.Referer)
-			return YES
-		} else {
-			redisConn3.HashIncrby("accesslog_result_vppv_no_referer_per_min", logTimeMin, 1)
-			//log.Println(accesslog.String(),"is not come from ",accesslog.Referer)
-			return NO
-		}
+// logRedisError logs a failed redis command, the filter does not stop for it
+// and goes on with the next step
+func logRedisError(where string, err error) {
+	if err != nil {
+		log.Println("("+where+") ", err)
 	}
-
-	//////////// get UA type from website
-	//
-	//_, err := http.Get("http://www.useragentstring.com/?usa=" + accesslog.UserAgent + "&getText=all")
-	//if err != nil {
-	//	fmt.Println(err)
-	//} else {
-	//	//	fmt.Println("success", res)
-	//}
-
-	////////////  DNS reverse lookup
-	//
-	//if matched,err := regexp.MatchString("[S|s]pider",accesslog.UserAgent) ; err != nil || !matched{
-	//    return UNKNOWN
-	//} else {
-	//    ans , err1 := net.LookupAddr(accesslog.RemoteAddr)
-	//    if err1 != nil{
-	//        fmt.Println("Failed",accesslog.UserAgent,"+", accesslog.RemoteAddr,err1)
-	//    } else {
-	//        fmt.Println("Successful",accesslog.UserAgent,"+",accesslog.RemoteAddr,"-->",ans)
-	//    }
-	//    return UNKNOWN
-	//}
 }
 
-func WhiteIpFilter(redisConn *RedisConn, accesslog *AccessLog) int {
-	if 1 == redisConn.SetIsMember("WhiteList", accesslog.RemoteAddr) {
-		return YES
-	} else {
-		AddWatchingList(redisConn, accesslog)
-		return UNKNOWN
+// DoFilter decide whether a record is an effective view and who made it by
+// the filter rules. A banned IP is NO at once. The record is added to its
+// session first.
+func DoFilter(runtime *Runtime, conns *FilterConns, accesslog *AccessLog) Verdict {
+	session, closed := sessions.Observe(accesslog, SessionTimeout(runtime.Config))
+	logRedisError("DoFilter", StoreSessions(conns.Lists, runtime.Config, closed))
+	banned, err := IsBlackListed(conns.Lists, accesslog.RemoteAddr, time.Now())
+	logRedisError("DoFilter", err)
+	if banned {
+		conns.Counters.HashIncrby("accesslog_result_blacklist_per_min", accesslog.LogTimeMinString(), 1)
+		return Verdict{Result: NO, Class: BadRobot, Reason: "blacklist", Confidence: 1}
 	}
+	verdict := runtime.FilterRules.Decide(runtime, conns, accesslog, &session)
+	if verdict.Result == NO {
+		runtime.BanRules.CountNo(conns, accesslog.RemoteAddr, verdict.Reason)
+	}
+	return verdict
 }
 
 func AddRefererList(redisConn *RedisConn, accesslog *AccessLog) {
 	//log.Println("add to Referer_"+accesslog.RemoteAddr, "member:","http://"+accesslog.Hostname+accesslog.RequestURI)
-	redisConn.SetAdd("RefererList", accesslog.RemoteAddr)
-	redisConn.SetAdd("Referer_"+accesslog.RemoteAddr, "http://"+accesslog.Hostname+accesslog.RequestURI)
+	_, err := redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("ZADD", "RefererList", time.Now().Unix(), accesslog.RemoteAddr),
+		NewRedisCmd("SADD", "Referer_"+accesslog.RemoteAddr, "http://"+accesslog.Hostname+accesslog.RequestURI),
+	})
+	logRedisError("AddRefererList", err)
 }
 
 func DelRefererList(redisConn *RedisConn, accesslog *AccessLog) {
 	//log.Println("DelRefererList delete member ",accesslog.RemoteAddr," and key Referer_" + accesslog.RemoteAddr)
-	redisConn.SetRem("RefererList", accesslog.RemoteAddr)
-	redisConn.KeyDel("Referer_" + accesslog.RemoteAddr)
+	_, err := redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("ZREM", "RefererList", accesslog.RemoteAddr),
+		NewRedisCmd("DEL", "Referer_"+accesslog.RemoteAddr),
+	})
+	logRedisError("DelRefererList", err)
 }
 
-func AddWatchingList(redisConn *RedisConn, accesslog *AccessLog) {
+// AddWatchingList return the size of the watching list of the IP, 0 if the
+// record could not be added
+func AddWatchingList(conns *FilterConns, accesslog *AccessLog) int64 {
 	logTimeMin := accesslog.LogTimeMinString()
-	redisConn3.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, 1)
-	redisConn.SetAdd("WatchingList", accesslog.RemoteAddr)
-	redisConn.ListLeftPush("WL_"+accesslog.RemoteAddr, accesslog.String())
+	conns.Counters.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, 1)
+	replies, err := conns.Lists.Pipeline([]RedisCmd{
+		NewRedisCmd("ZADD", "WatchingList", time.Now().Unix(), accesslog.RemoteAddr),
+		NewRedisCmd("LPUSH", "WL_"+accesslog.RemoteAddr, accesslog.String()),
+	})
+	if err != nil || len(replies) < 2 {
+		logRedisError("AddWatchingList", err)
+		return 0
+	}
+	size, _ := redisInt64(replies[1], nil)
+	return size
 }
 
 func DelWatchingList(redisConn *RedisConn, accesslog *AccessLog) {
-	redisConn.SetRem("WatchingList", accesslog.RemoteAddr)
-	redisConn.KeyDel("WL_" + accesslog.RemoteAddr)
+	_, err := redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("ZREM", "WatchingList", accesslog.RemoteAddr),
+		NewRedisCmd("DEL", "WL_"+accesslog.RemoteAddr),
+	})
+	logRedisError("DelWatchingList", err)
 }
 
 func AddWhiteList(redisConn *RedisConn, accesslog *AccessLog) {
-	redisConn.SetAdd("WhiteList", accesslog.RemoteAddr)
+	logRedisError("AddWhiteList", TouchWhiteList(redisConn, accesslog.RemoteAddr, time.Now()))
+}
+
+// touchWhiteScript sets the time an IP of the WhiteList was last seen, unless
+// it is +inf, which an IP white listed by hand has for ever
+// KEYS: WhiteList  ARGV: time, ip
+var touchWhiteScript = NewRedisScript(1, `
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) == 'inf' then
+	return 0
+end
+return redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	if score, ok := db.Do("ZSCORE", keys[0], args[1]).([]byte); ok && string(score) == "inf" {
+		return int64(0)
+	}
+	return db.Do("ZADD", keys[0], args[0], args[1])
+})
+
+// TouchWhiteList adds ip to the WhiteList, or updates the time it was last
+// seen
+func TouchWhiteList(redisConn *RedisConn, ip string, now time.Time) error {
+	_, err := redisConn.EvalScript(touchWhiteScript, "WhiteList", now.Unix(), ip)
+	return err
 }
 
 func AddIgnoreList(redisConn *RedisConn, accesslog *AccessLog) {
-	redisConn.SetAdd("IgnoreList", accesslog.RemoteAddr)
+	_, err := redisConn.SetAdd(ignoreList, accesslog.RemoteAddr)
+	logRedisError("AddIgnoreList", err)
+}
+
+// A watching list is claimed by renaming it to WLClaimed_<ip>, the IP is kept
+// in WatchingClaimed scored by the claim time. The claim is finished, and the
+// records are dropped, once the watched records are counted and the IP is
+// white listed if it has to. The claims not finished within
+// watchingClaimTimeout, by a filter which crashed, are put back into the
+// watching lists by the sweeper.
+const (
+	watchingClaimedKey   = "WatchingClaimed"
+	watchingClaimTimeout = 60 * time.Second
+)
+
+func watchingClaimKey(ip string) string {
+	return "WLClaimed_" + ip
+}
+
+// claimWatchingScript takes the watching list of an IP and its referers out of
+// redis in one step, so when several holmes share the redis each watched record
+// is resolved and counted by one filter only. Nothing is claimed while an
+// earlier claim of the IP is not finished. It return whether the records are
+// claimed (1), there are none (0) or another claim holds them (-1), then the
+// records.
+// KEYS: WL_<ip>, Referer_<ip>, WatchingList, RefererList, WLClaimed_<ip>,
+// WatchingClaimed  ARGV: ip, now
+var claimWatchingScript = NewRedisScript(6, `
+if redis.call('EXISTS', KEYS[5]) == 1 then
+	return {-1, {}}
+end
+local records = redis.call('LRANGE', KEYS[1], 0, -1)
+local claimed = 0
+if #records > 0 then
+	redis.call('RENAME', KEYS[1], KEYS[5])
+	redis.call('ZADD', KEYS[6], ARGV[2], ARGV[1])
+	claimed = 1
+end
+redis.call('DEL', KEYS[2])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+return {claimed, records}
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	if db.Do("EXISTS", keys[4]) == int64(1) {
+		return []interface{}{int64(-1), []interface{}{}}
+	}
+	records := db.Do("LRANGE", keys[0], 0, -1)
+	claimed := int64(0)
+	if len(records.([]interface{})) > 0 {
+		db.Do("RENAME", keys[0], keys[4])
+		db.Do("ZADD", keys[5], args[1], args[0])
+		claimed = 1
+	}
+	db.Do("DEL", keys[1])
+	db.Do("ZREM", keys[2], args[0])
+	db.Do("ZREM", keys[3], args[0])
+	return []interface{}{claimed, records}
+})
+
+// ErrWatchingClaimed is returned when the watching list of an IP is claimed by
+// another filter which has not finished resolving it
+var ErrWatchingClaimed = errors.New("the watching list is being resolved by another filter")
+
+// claimWatchingList return the records of the watching list of ip, claimed is
+// true when this filter claimed them and has to finish the claim. The broken
+// records are dropped.
+func claimWatchingList(conns *FilterConns, ip string) (records []AccessLog, claimed bool, err error) {
+	r, err := conns.Lists.EvalScript(claimWatchingScript, "WL_"+ip, "Referer_"+ip, "WatchingList", "RefererList",
+		watchingClaimKey(ip), watchingClaimedKey, ip, time.Now().Unix())
+	if err != nil || r == nil {
+		return nil, false, err
+	}
+	reply, err := redis.Values(r, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(reply) != 2 {
+		return nil, false, fmt.Errorf("unexpected claim reply %v", reply)
+	}
+	status, err := redisInt64(reply[0], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if status < 0 {
+		return nil, false, ErrWatchingClaimed
+	}
+	lines, err := stringSlice(reply[1], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	records = make([]AccessLog, 0, len(lines))
+	for _, line := range lines {
+		watchAccesslog, err := GetLog(line)
+		if err != nil {
+			log.Println("(claimWatchingList) drop a broken record of WL_"+ip, ": ", err)
+			continue
+		}
+		records = append(records, watchAccesslog)
+	}
+	return records, status == 1, nil
+}
+
+// finishWatchingClaim drops the claimed records of ip once their counters are
+// flushed
+func finishWatchingClaim(conns *FilterConns, ip string) error {
+	logRedisError("finishWatchingClaim", conns.Counters.Flush())
+	_, err := conns.Lists.Pipeline([]RedisCmd{
+		NewRedisCmd("DEL", watchingClaimKey(ip)),
+		NewRedisCmd("ZREM", watchingClaimedKey, ip),
+	})
+	return err
 }
 
-func Analysis(redisConn *RedisConn, accesslog *AccessLog) {
-	if matched, err := regexp.MatchString("^s.anjuke.com", accesslog.Hostname); err == nil && matched {
-		//AddWhiteList(redisConn, accesslog)
-		//log.Println("call Analysis... Hostname is: ",accesslog.Hostname)
-		ProcessWatchingList(redisConn, accesslog)
+// returnWatchingScript puts the records of an unfinished claim back in front
+// of the watching list of the IP
+// KEYS: WLClaimed_<ip>, WL_<ip>, WatchingList, WatchingClaimed  ARGV: ip, now
+var returnWatchingScript = NewRedisScript(4, `
+local records = redis.call('LRANGE', KEYS[1], 0, -1)
+for i = 1, #records, 1000 do
+	redis.call('RPUSH', KEYS[2], unpack(records, i, math.min(i + 999, #records)))
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+if #records > 0 then
+	redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+end
+return #records
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	records := db.Do("LRANGE", keys[0], 0, -1).([]interface{})
+	for _, record := range records {
+		db.Do("RPUSH", keys[1], string(record.([]byte)))
+	}
+	db.Do("DEL", keys[0])
+	db.Do("ZREM", keys[3], args[0])
+	if len(records) > 0 {
+		db.Do("ZADD", keys[2], args[1], args[0])
+	}
+	return int64(len(records))
+})
+
+// ReturnWatchingClaims puts the claims made before into the watching lists
+// again, so their records are resolved by the next record of the IP
+// output:the number of records put back
+func ReturnWatchingClaims(redisConn *RedisConn, before time.Time, now time.Time) (int64, error) {
+	var returned int64
+	ips, err := redisConn.SortedSetRangeByScore(watchingClaimedKey, "-inf", strconv.FormatInt(before.Unix(), 10))
+	if err != nil {
+		return returned, err
+	}
+	for _, ip := range ips {
+		n, err := redisInt64(redisConn.EvalScript(returnWatchingScript, watchingClaimKey(ip), "WL_"+ip, "WatchingList", watchingClaimedKey, ip, now.Unix()))
+		if err != nil {
+			return returned, err
+		}
+		returned += n
 	}
+	return returned, nil
 }
 
-func ProcessWatchingList(redisConn *RedisConn, accesslog *AccessLog) {
-	//log.Println("call ProcessWatchingList... : ",accesslog.String())
+// WatchedRecord is a record of a watching list with the verdict of the
+// watching rules
+type WatchedRecord struct {
+	AccessLog AccessLog
+	Verdict   Verdict
+}
+
+// ResolveWatchingList claims the watching list of ip and decides each record by
+// the watching rules, the IP is white listed if one record is YES. The records
+// claimed by another filter are not returned, they are resolved by it.
+func ResolveWatchingList(runtime *Runtime, conns *FilterConns, ip string) ([]WatchedRecord, error) {
+	claimed, ok, err := claimWatchingList(conns, ip)
+	if err == ErrWatchingClaimed || (err == nil && !ok) {
+		return nil, nil
+	}
+	if err != nil {
+		// the watching list is kept, the next record of the IP tries again
+		return nil, err
+	}
+	records := make([]WatchedRecord, 0, len(claimed))
 	trustFlag := false
-	listLen := redisConn.ListLen("WL_" + accesslog.RemoteAddr)
-	for i := 0; i < int(listLen); i++ {
-		line := redisConn.ListLeftPop("WL_" + accesslog.RemoteAddr)
-		watchAccesslog := GetLog(line)
+	for _, watchAccesslog := range claimed {
 		logTimeMin := watchAccesslog.LogTimeMinString()
-		//if matched, err := regexp.MatchString("^/prop/view/", watchAccesslog.RequestURI); err == nil && matched {
-		//if matched, err := regexp.MatchString("^2", watchAccesslog.HttpCode); err == nil && matched {
-		if RefererFilter(redisConn, &watchAccesslog) == YES {
-			//if watchAccesslog.Referer != "-" {
+		verdict := runtime.WatchingRules.Run(runtime, conns, &watchAccesslog)
+		if verdict.Result == YES {
 			trustFlag = true
-			//log.Println("Result of RefererFilter() is YES,increment accesslog_result_vppv_per_min at ",logTimeMin)
-			redisConn3.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
+			conns.Counters.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
 		}
-		//}
-		//}
-		redisConn3.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, -1)
-	} // end of loop for each log in watching list
-	DelWatchingList(redisConn, accesslog)
-	DelRefererList(redisConn, accesslog)
+		conns.Counters.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, -1)
+		// the record was counted unclassified by the watch rule
+		Reclassify(conns.Counters, logTimeMin, Unclassified, verdict.Class)
+		records = append(records, WatchedRecord{AccessLog: watchAccesslog, Verdict: verdict})
+	}
 	if trustFlag {
-		AddWhiteList(redisConn, accesslog)
+		if err := TouchWhiteList(conns.Lists, ip, time.Now()); err != nil {
+			// the claim is returned by the sweeper and resolved again
+			return records, err
+		}
 	}
+	return records, finishWatchingClaim(conns, ip)
 }
 
+func ProcessWatchingList(runtime *Runtime, conns *FilterConns, accesslog *AccessLog) {
+	records, err := ResolveWatchingList(runtime, conns, accesslog.RemoteAddr)
+	logRedisError("ProcessWatchingList", err)
+	logRedisError("ProcessWatchingList", PushWatchedRecords(conns, records))
+}
+
+//////////// get UA type from website
+//
+//_, err := http.Get("http://www.useragentstring.com/?usa=" + accesslog.UserAgent + "&getText=all")
+//if err != nil {
+//	fmt.Println(err)
+//} else {
+//	//	fmt.Println("success", res)
+//}
+
 //func GUIDFilter(redisConn RedisConn, accesslog *AccessLog) int {
 //	if accesslog.GUID == "-" {
 //		return NO
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveWatchingList(t *testing.T) {
+	runtime, err := NewRuntime(HolmesConfig{}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryRedis()
+	conns := &FilterConns{Lists: db.Conn(), Counters: NewMemoryCounterBatch()}
+	for _, min := range []string{"20", "21"} {
+		accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: min, Sec: "00",
+			RemoteAddr: "10.0.0.1", UserAgent: "Chrome/28", GUID: "-", Method: "GET", HttpCode: "200",
+			Hostname: "www.anjuke.com", RequestURI: "/prop/view/1", Referer: "-"}
+		AddWatchingList(conns, &accesslog)
+	}
+
+	// a filter crashes after it claimed the watching list
+	claimed, ok, err := claimWatchingList(conns, "10.0.0.1")
+	if err != nil || !ok || len(claimed) != 2 || db.Do("EXISTS", "WL_10.0.0.1") != int64(0) {
+		t.Fatalf("claimed %v %v %v", claimed, ok, err)
+	}
+	if again, ok, err := claimWatchingList(conns, "10.0.0.1"); err != ErrWatchingClaimed || ok || len(again) != 0 {
+		t.Errorf("an unfinished claim is claimed again: %v %v %v", again, ok, err)
+	}
+	// another filter, or the admin API, leaves the claim to its owner
+	if records, err := ResolveWatchingList(runtime, conns, "10.0.0.1"); err != nil || len(records) != 0 {
+		t.Errorf("the claim of another filter is resolved: %v %v", records, err)
+	}
+	if _, err := ForceResolveWatchingList(conns, "10.0.0.1", true); err != ErrWatchingClaimed {
+		t.Errorf("the admin resolve of a claimed list got %v", err)
+	}
+	if db.Do("EXISTS", watchingClaimKey("10.0.0.1")) != int64(1) || db.Do("ZCARD", watchingClaimedKey) != int64(1) {
+		t.Fatalf("the claim of another filter is cleared")
+	}
+	if n, err := ReturnWatchingClaims(conns.Lists, time.Now().Add(-watchingClaimTimeout), time.Now()); err != nil || n != 0 {
+		t.Errorf("a recent claim is returned: %d %v", n, err)
+	}
+	if n, err := ReturnWatchingClaims(conns.Lists, time.Now().Add(time.Second), time.Now()); err != nil || n != 2 {
+		t.Errorf("returned %d %v", n, err)
+	}
+
+	// the returned records are resolved and counted once
+	records, err := ResolveWatchingList(runtime, conns, "10.0.0.1")
+	if err != nil || len(records) != 2 || records[0].AccessLog.Min != "21" {
+		t.Fatalf("resolved %+v %v", records, err)
+	}
+	for _, key := range []string{"WL_10.0.0.1", watchingClaimKey("10.0.0.1"), watchingClaimedKey, "WatchingList"} {
+		if db.Do("EXISTS", key) != int64(0) {
+			t.Errorf("%s is left", key)
+		}
+	}
+	counts := conns.Counters.Counts()
+	if watching := counts["accesslog_result_vppv_watching_per_min"]; watching["2013-07-09 15:20"] != 0 || watching["2013-07-09 15:21"] != 0 {
+		t.Errorf("the watching counters are %v", watching)
+	}
+}
+
+func TestProcessWatchingList(t *testing.T) {
+	runtime, err := NewRuntime(HolmesConfig{}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryRedis()
+	conns := &FilterConns{Queue: db.Conn(), Lists: db.Conn(), Counters: NewMemoryCounterBatch()}
+	accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: "20", Sec: "00",
+		RemoteAddr: "10.0.0.1", UserAgent: "Chrome/28", GUID: "-", Method: "GET", HttpCode: "200",
+		Hostname: "www.anjuke.com", RequestURI: "/prop/view/1", Referer: "-"}
+	AddWatchingList(conns, &accesslog)
+	ProcessWatchingList(runtime, conns, &accesslog)
+
+	// the resolved record is exported with the columns of its verdict
+	lines := []string{}
+	for _, list := range ResultLists {
+		exported, err := conns.Queue.ListRange(list, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, exported...)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], accesslog.String()+"\t") || strings.Count(lines[0], "\t") != 26 {
+		t.Errorf("exported %q", lines)
+	}
+}
+
+func TestRequeueProcessing(t *testing.T) {
+	db := NewMemoryRedis()
+	queue := db.Conn()
+	db.Do("LPUSH", "accesslog", "a", "b", "c", "d")
+	for _, want := range []string{"a", "b", "c"} {
+		if line, err := queue.BlockListRightPopLeftPush("accesslog", "processing", 1); err != nil || line != want {
+			t.Fatalf("popped %q %v, want %q", line, err, want)
+		}
+	}
+	// a is filtered, the filter crashes before b and c are
+	if n, err := queue.ListRem("processing", -1, "a"); err != nil || n != 1 {
+		t.Errorf("removed %d %v", n, err)
+	}
+	if n, err := RequeueProcessing(queue, "processing"); err != nil || n != 2 {
+		t.Errorf("requeued %d %v", n, err)
+	}
+	for _, want := range []string{"b", "c", "d"} {
+		if line, err := queue.ListRightPop("accesslog"); err != nil || line != want {
+			t.Errorf("popped %q %v, want %q", line, err, want)
+		}
+	}
+	if db.Do("EXISTS", "processing") != int64(0) {
+		t.Errorf("the processing list is left")
+	}
+}
+
+func TestRequeueScript(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"requeue", [][]interface{}{{"RPUSH", "processing", "a", "b", "c"}, {"RPUSH", "accesslog", "d"}}, requeueScript, []interface{}{"processing", "accesslog"}},
+	})
+}
+
+func TestWatchingScripts(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"claimWatching", [][]interface{}{{"RPUSH", "WL_10.0.0.1", "a", "b"}, {"SADD", "Referer_10.0.0.1", "http://a/"}, {"ZADD", "WatchingList", 100, "10.0.0.1"}, {"ZADD", "RefererList", 100, "10.0.0.1"}},
+			claimWatchingScript, []interface{}{"WL_10.0.0.1", "Referer_10.0.0.1", "WatchingList", "RefererList", "WLClaimed_10.0.0.1", "WatchingClaimed", "10.0.0.1", 200}},
+		{"claimWatching none", [][]interface{}{{"ZADD", "RefererList", 100, "10.0.0.1"}},
+			claimWatchingScript, []interface{}{"WL_10.0.0.1", "Referer_10.0.0.1", "WatchingList", "RefererList", "WLClaimed_10.0.0.1", "WatchingClaimed", "10.0.0.1", 200}},
+		{"claimWatching claimed", [][]interface{}{{"RPUSH", "WL_10.0.0.1", "c"}, {"RPUSH", "WLClaimed_10.0.0.1", "a", "b"}, {"ZADD", "WatchingClaimed", 100, "10.0.0.1"}},
+			claimWatchingScript, []interface{}{"WL_10.0.0.1", "Referer_10.0.0.1", "WatchingList", "RefererList", "WLClaimed_10.0.0.1", "WatchingClaimed", "10.0.0.1", 200}},
+		{"returnWatching", [][]interface{}{{"RPUSH", "WLClaimed_10.0.0.1", "a", "b"}, {"RPUSH", "WL_10.0.0.1", "c"}, {"ZADD", "WatchingClaimed", 100, "10.0.0.1"}},
+			returnWatchingScript, []interface{}{"WLClaimed_10.0.0.1", "WL_10.0.0.1", "WatchingList", "WatchingClaimed", "10.0.0.1", 200}},
+		{"returnWatching none", [][]interface{}{{"ZADD", "WatchingClaimed", 100, "10.0.0.1"}},
+			returnWatchingScript, []interface{}{"WLClaimed_10.0.0.1", "WL_10.0.0.1", "WatchingList", "WatchingClaimed", "10.0.0.1", 200}},
+	})
+}
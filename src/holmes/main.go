@@ -1,11 +1,97 @@
 package main
 
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
 var holmesConf HolmesConfig
 
+// commands are the subcommands of holmes, without one holmes runs the filter
+var commands = map[string]func(args []string) error{
+	"blacklist": BlackListCommand,
+	"replay":    ReplayCommand,
+	"train":     TrainCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatal("unknown command ", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	confFile := "holmes.conf"
 	ua_pattern_file := "../data/user_agent_pattern.json"
-	holmesConf = LoadConfig(confFile)
-	InitUAParsers(ua_pattern_file)
-	Filter(holmesConf)
+	runtime, err := LoadRuntime(confFile, ua_pattern_file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetRuntime(runtime)
+	holmesConf = runtime.Config
+	if err := InitLogLocation(holmesConf.LogTimeZone); err != nil {
+		log.Fatal(err)
+	}
+	go WatchRuntime(confFile, ua_pattern_file)
+	listConn := NewRedisConn(holmesConf.RedisConfs[1])
+	retryStartup("MigrateListKeys", func() error {
+		return MigrateListKeys(listConn, time.Now())
+	})
+	retryStartup("LoadCIDRLists", func() error {
+		tries, err := LoadCIDRLists(listConn, time.Now())
+		if err == nil {
+			cidrLists.Set(tries)
+		}
+		return err
+	})
+	listConn.Close()
+
+	// on SIGINT or SIGTERM the stages finish what they hold and flush their
+	// counters before holmes exits
+	stop := make(chan struct{})
+	var running sync.WaitGroup
+	for _, stage := range []func(){
+		func() { Stage(holmesConf, stop) },
+		func() { Export(holmesConf, stop) },
+		func() { Filter(stop) },
+		func() { Sweeper(holmesConf, stop) },
+		func() { ServeAPI(holmesConf, stop) },
+		func() { SyncCIDRLists(holmesConf, stop) },
+	} {
+		running.Add(1)
+		go func(stage func()) {
+			defer running.Done()
+			stage()
+		}(stage)
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("(main) got ", <-quit, ", stopping")
+	close(stop)
+	running.Wait()
+}
+
+// retryStartup calls step until it succeeds, with backoff, so holmes waits for
+// a redis which is not up yet
+func retryStartup(name string, step func() error) {
+	backoff := time.Second
+	for {
+		err := step()
+		if err == nil {
+			return
+		}
+		log.Println("(main) ", name, " failed, retry in ", backoff, ": ", err)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
 }
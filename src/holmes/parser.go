@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogParser converts a line of access log into an AccessLog
+type LogParser interface {
+	Parse(line string) (AccessLog, error)
+}
+
+// LogParserFunc adapts an ordinary function such as GetLog to a LogParser
+type LogParserFunc func(line string) (AccessLog, error)
+
+func (f LogParserFunc) Parse(line string) (AccessLog, error) {
+	return f(line)
+}
+
+// LogParserFactory builds a LogParser from the holmes configuration
+type LogParserFactory func(holmesConfig HolmesConfig) (LogParser, error)
+
+var logParserFactories = map[string]LogParserFactory{}
+
+// RegisterLogParser makes a log format selectable by name in holmes.conf
+func RegisterLogParser(name string, factory LogParserFactory) {
+	logParserFactories[name] = factory
+}
+
+// NewLogParser return the parser registered as name
+func NewLogParser(name string, holmesConfig HolmesConfig) (LogParser, error) {
+	factory, ok := logParserFactories[name]
+	if !ok {
+		names := []string{}
+		for name := range logParserFactories {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown log format %q, the known formats are %s", name, strings.Join(names, ", "))
+	}
+	return factory(holmesConfig)
+}
+
+const apacheCombinedFormat = `$remote_addr $remote_ident $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+func init() {
+	RegisterLogParser("tsv", func(HolmesConfig) (LogParser, error) {
+		return LogParserFunc(GetLog), nil
+	})
+	RegisterLogParser("nginx", func(HolmesConfig) (LogParser, error) {
+		return LogParserFunc(GetLogNginx), nil
+	})
+	RegisterLogParser("apache_combined", func(HolmesConfig) (LogParser, error) {
+		return NewFormatLogParser(apacheCombinedFormat)
+	})
+	RegisterLogParser("nginx_log_format", func(holmesConfig HolmesConfig) (LogParser, error) {
+		return NewFormatLogParser(holmesConfig.NginxLogFormat)
+	})
+}
+
+// FormatLogParser parses the lines written by an Nginx log_format
+type FormatLogParser struct {
+	regexp    *regexp.Regexp
+	variables []string
+}
+
+// NewFormatLogParser compiles a Nginx log_format string such as
+// `$remote_addr - $remote_user [$time_local] "$request"` into a parser. Each
+// variable matches lazily up to the literal text which follows it.
+func NewFormatLogParser(format string) (*FormatLogParser, error) {
+	if format == "" {
+		return nil, fmt.Errorf("empty log format")
+	}
+	variableRegexp := regexp.MustCompile(`\$(\{[a-z0-9_]+\}|[a-z0-9_]+)`)
+	pattern := "^"
+	variables := []string{}
+	last := 0
+	locs := variableRegexp.FindAllStringSubmatchIndex(format, -1)
+	for i, loc := range locs {
+		pattern += regexp.QuoteMeta(format[last:loc[0]])
+		if i == len(locs)-1 && loc[1] == len(format) {
+			pattern += "(.*)"
+		} else {
+			pattern += "(.*?)"
+		}
+		variables = append(variables, strings.Trim(format[loc[2]:loc[3]], "{}"))
+		last = loc[1]
+	}
+	pattern += regexp.QuoteMeta(format[last:]) + "$"
+	if len(variables) == 0 {
+		return nil, fmt.Errorf("log format %q has no variable", format)
+	}
+	myRegexp, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &FormatLogParser{regexp: myRegexp, variables: variables}, nil
+}
+
+func (parser *FormatLogParser) Parse(line string) (AccessLog, error) {
+	accessLog := AccessLog{
+		Hour: "-", Year: "-", Day: "-", Min: "-", RequestTime: "-",
+		UpstreamResponseTime: "-", RemoteAddr: "-", UpstreamAddr: "-",
+		Hostname: "-", Method: "-", RequestURI: "-", HttpCode: "-",
+		BytesSent: "-", Referer: "-", UserAgent: "-", GzipRatio: "-",
+		HttpXForwardedFor: "-", ServerAddr: "-", GUID: "-", Sec: "-",
+		Month: "-", RequestLen: "-", ServerPort: "-",
+	}
+	fields := parser.regexp.FindStringSubmatch(line)
+	if fields == nil {
+		return accessLog, fmt.Errorf("line does not match the log format")
+	}
+	for i, variable := range parser.variables {
+		if err := setLogVariable(&accessLog, variable, fields[i+1]); err != nil {
+			return accessLog, err
+		}
+	}
+	return accessLog, nil
+}
+
+func setLogVariable(accessLog *AccessLog, variable string, value string) error {
+	switch variable {
+	case "remote_addr":
+		accessLog.RemoteAddr = value
+	case "upstream_addr":
+		accessLog.UpstreamAddr = value
+	case "host", "http_host", "server_name":
+		accessLog.Hostname = value
+	case "request":
+		parts := strings.SplitN(value, " ", 3)
+		accessLog.Method = parts[0]
+		if len(parts) > 1 {
+			accessLog.RequestURI = parts[1]
+		}
+	case "request_method":
+		accessLog.Method = value
+	case "request_uri":
+		accessLog.RequestURI = value
+	case "status":
+		accessLog.HttpCode = value
+	case "body_bytes_sent", "bytes_sent":
+		accessLog.BytesSent = value
+	case "http_referer":
+		accessLog.Referer = value
+	case "http_user_agent":
+		accessLog.UserAgent = value
+	case "gzip_ratio":
+		accessLog.GzipRatio = value
+	case "http_x_forwarded_for":
+		accessLog.HttpXForwardedFor = value
+	case "server_addr":
+		accessLog.ServerAddr = value
+	case "server_port":
+		accessLog.ServerPort = value
+	case "request_length":
+		accessLog.RequestLen = value
+	case "request_time":
+		accessLog.RequestTime = value
+	case "upstream_response_time":
+		accessLog.UpstreamResponseTime = value
+	case "time_local":
+		t, err := time.Parse("02/Jan/2006:15:04:05 -0700", value)
+		if err != nil {
+			return fmt.Errorf("bad time_local %q", value)
+		}
+		setLogTime(accessLog, t)
+	case "time_iso8601":
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("bad time_iso8601 %q", value)
+		}
+		setLogTime(accessLog, t)
+	default:
+		if strings.HasSuffix(variable, "guid") {
+			accessLog.GUID = value
+		}
+	}
+	return nil
+}
+
+// setLogTime set the time fields of an AccessLog to t converted into LogLocation
+func setLogTime(accessLog *AccessLog, t time.Time) {
+	t = t.In(LogLocation)
+	accessLog.Year = strconv.Itoa(t.Year())
+	accessLog.Month = fmt.Sprintf("%02d", int(t.Month()))
+	accessLog.Day = fmt.Sprintf("%02d", t.Day())
+	accessLog.Hour = fmt.Sprintf("%02d", t.Hour())
+	accessLog.Min = fmt.Sprintf("%02d", t.Minute())
+	accessLog.Sec = fmt.Sprintf("%02d", t.Second())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApacheCombinedParser(t *testing.T) {
+	defer func(location *time.Location) { LogLocation = location }(LogLocation)
+	LogLocation = time.FixedZone("UTC", 0)
+	parser, err := NewLogParser("apache_combined", HolmesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := `10.0.0.1 - frank [09/Jul/2013:15:20:12 +0800] "GET /prop/view/123 HTTP/1.1" 200 2326 "http://www.anjuke.com/" "Mozilla/5.0 (Windows NT 6.1) Chrome/28.0"`
+	accessLog, err := parser.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessLog.RemoteAddr != "10.0.0.1" || accessLog.Method != "GET" || accessLog.RequestURI != "/prop/view/123" ||
+		accessLog.HttpCode != "200" || accessLog.BytesSent != "2326" || accessLog.Referer != "http://www.anjuke.com/" ||
+		accessLog.UserAgent != "Mozilla/5.0 (Windows NT 6.1) Chrome/28.0" {
+		t.Errorf("wrong fields: %+v", accessLog)
+	}
+	if logTime := accessLog.LogTimeString(); logTime != "2013-07-09 07:20:12" {
+		t.Errorf("wrong time: %s", logTime)
+	}
+	if accessLog.GUID != "-" {
+		t.Errorf("field not in the format should be -, got %s", accessLog.GUID)
+	}
+}
+
+func TestNginxLogFormatParser(t *testing.T) {
+	holmesConfig := HolmesConfig{NginxLogFormat: `$host $remote_addr $request_time "$request_method $request_uri" $status $cookie_guid`}
+	parser, err := NewLogParser("nginx_log_format", holmesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog, err := parser.Parse(`s.anjuke.com 10.0.0.2 0.003 "HEAD /a b" 404 abc-123`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessLog.Hostname != "s.anjuke.com" || accessLog.RemoteAddr != "10.0.0.2" || accessLog.RequestTime != "0.003" ||
+		accessLog.Method != "HEAD" || accessLog.RequestURI != "/a b" || accessLog.HttpCode != "404" || accessLog.GUID != "abc-123" {
+		t.Errorf("wrong fields: %+v", accessLog)
+	}
+
+	if _, err := parser.Parse("s.anjuke.com 10.0.0.2"); err == nil {
+		t.Errorf("a truncated line should be an error")
+	}
+	if _, err := NewLogParser("no_such_format", holmesConfig); err == nil {
+		t.Errorf("unknown format should be an error")
+	}
+}
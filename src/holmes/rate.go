@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateOffendersList = "RateOffenders"
+	rateOffendersMax  = 10000
+	rateShards        = 64
+)
+
+// RateWindow flags a key with more than Max requests within Seconds
+type RateWindow struct {
+	Seconds int64
+	Max     int
+}
+
+// RateOffense is recorded in the RateOffenders list when a key goes over the
+// max of a window, once per window until the key is under the max again
+type RateOffense struct {
+	Rule   string
+	Key    string
+	Window int64
+	Count  int
+	Max    int
+	From   string
+	To     string
+}
+
+// parseRateWindows parses "10:50,60:200", seconds:max for each window
+func parseRateWindows(spec string) ([]RateWindow, error) {
+	windows := []RateWindow{}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rate window %q is not seconds:max", item)
+		}
+		seconds, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("rate window %q has bad seconds", item)
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max <= 0 {
+			return nil, fmt.Errorf("rate window %q has bad max", item)
+		}
+		windows = append(windows, RateWindow{Seconds: seconds, Max: max})
+	}
+	return windows, nil
+}
+
+type rateKey struct {
+	times    []int64 // unix times of the last requests, in order
+	offended []bool  // whether the key is over the max of each window
+}
+
+type rateShard struct {
+	mutex sync.Mutex
+	keys  map[string]*rateKey
+	seen  int // requests since the last prune
+}
+
+// RateTracker counts the requests of each key in sliding windows. It keeps at
+// most the largest max + 1 times of a key, that is enough to tell whether
+// every window is over its max.
+type RateTracker struct {
+	windows []RateWindow
+	longest int64
+	keep    int
+	shards  [rateShards]rateShard
+}
+
+func NewRateTracker(windows []RateWindow) *RateTracker {
+	tracker := &RateTracker{windows: windows}
+	for _, window := range windows {
+		if window.Seconds > tracker.longest {
+			tracker.longest = window.Seconds
+		}
+		if window.Max+1 > tracker.keep {
+			tracker.keep = window.Max + 1
+		}
+	}
+	for i := range tracker.shards {
+		tracker.shards[i].keys = map[string]*rateKey{}
+	}
+	return tracker
+}
+
+// rateTrackers keeps the trackers across reloads, a rule keeps its counts if
+// its windows and key are not changed
+var rateTrackers = struct {
+	sync.Mutex
+	trackers map[string]*RateTracker
+}{trackers: map[string]*RateTracker{}}
+
+// rateTrackerID is the tracker a rate rule shares across reloads
+func rateTrackerID(conf RuleConf) string {
+	return fmt.Sprintf("%s|%s|%v|%s", conf.Name, conf.Field, conf.Values, conf.Value)
+}
+
+// rateTrackerIDs return the trackers of the rate rules of the pipelines
+func rateTrackerIDs(pipelines ...[]RuleConf) []string {
+	ids := []string{}
+	for _, confs := range pipelines {
+		for _, conf := range confs {
+			if conf.Op == "rate" {
+				ids = append(ids, rateTrackerID(conf))
+			}
+		}
+	}
+	return ids
+}
+
+// keepRateTrackers drops the trackers which are not in ids, they belong to the
+// rules of a runtime which is swapped out
+func keepRateTrackers(ids []string) {
+	keep := map[string]bool{}
+	for _, id := range ids {
+		keep[id] = true
+	}
+	rateTrackers.Lock()
+	defer rateTrackers.Unlock()
+	for id := range rateTrackers.trackers {
+		if !keep[id] {
+			delete(rateTrackers.trackers, id)
+		}
+	}
+}
+
+func sharedRateTracker(id string, windows []RateWindow) *RateTracker {
+	rateTrackers.Lock()
+	defer rateTrackers.Unlock()
+	tracker, ok := rateTrackers.trackers[id]
+	if !ok {
+		tracker = NewRateTracker(windows)
+		rateTrackers.trackers[id] = tracker
+	}
+	return tracker
+}
+
+// Observe counts a request of key at t and return the windows which the key
+// just went over, and whether the key is over any window
+func (tracker *RateTracker) Observe(key string, t time.Time) (offenses []RateOffense, over bool) {
+	shard := &tracker.shards[fnv32(key)%rateShards]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.seen++
+	if shard.seen >= 10000 {
+		shard.prune(t.Unix() - tracker.longest)
+		shard.seen = 0
+	}
+	state, ok := shard.keys[key]
+	if !ok {
+		state = &rateKey{offended: make([]bool, len(tracker.windows))}
+		shard.keys[key] = state
+	}
+	now := t.Unix()
+	// records come roughly in order, insert from the end
+	i := len(state.times)
+	for i > 0 && state.times[i-1] > now {
+		i--
+	}
+	state.times = append(state.times, 0)
+	copy(state.times[i+1:], state.times[i:])
+	state.times[i] = now
+	if len(state.times) > tracker.keep {
+		state.times = state.times[len(state.times)-tracker.keep:]
+	}
+	last := state.times[len(state.times)-1]
+	for w, window := range tracker.windows {
+		from := last - window.Seconds
+		first := sort.Search(len(state.times), func(j int) bool { return state.times[j] > from })
+		count := len(state.times) - first
+		if count <= window.Max {
+			state.offended[w] = false
+			continue
+		}
+		over = true
+		if !state.offended[w] {
+			state.offended[w] = true
+			offenses = append(offenses, RateOffense{
+				Key:    key,
+				Window: window.Seconds,
+				Count:  count,
+				Max:    window.Max,
+				From:   time.Unix(state.times[first], 0).In(LogLocation).Format("2006-01-02 15:04:05"),
+				To:     time.Unix(last, 0).In(LogLocation).Format("2006-01-02 15:04:05"),
+			})
+		}
+	}
+	return offenses, over
+}
+
+// prune drops the keys without a request since before
+func (shard *rateShard) prune(before int64) {
+	for key, state := range shard.keys {
+		if len(state.times) == 0 || state.times[len(state.times)-1] <= before {
+			delete(shard.keys, key)
+		}
+	}
+}
+
+// compileRate is the rate op: Field and the fields of Values make the key,
+// Value is the windows, such as "10:50,60:200,3600:3000"
+func compileRate(conf RuleConf) (func(ctx *RuleContext, value string) bool, error) {
+	windows, err := parseRateWindows(conf.Value)
+	if err != nil {
+		return nil, err
+	}
+	keyFields := []int{}
+	for _, name := range conf.Values {
+		field, err := accessLogField(name)
+		if err != nil {
+			return nil, err
+		}
+		keyFields = append(keyFields, field)
+	}
+	tracker := sharedRateTracker(rateTrackerID(conf), windows)
+	return func(ctx *RuleContext, value string) bool {
+		t, err := ctx.accesslog.LogTime()
+		if err != nil {
+			return false
+		}
+		key := value
+		if len(keyFields) > 0 {
+			fields := reflect.ValueOf(ctx.accesslog).Elem()
+			for _, field := range keyFields {
+				key += "|" + fields.Field(field).String()
+			}
+		}
+		offenses, over := tracker.Observe(key, t)
+		for _, offense := range offenses {
+			offense.Rule = conf.Name
+			recordRateOffense(ctx.conns.Lists, offense)
+		}
+		return over
+	}, nil
+}
+
+// recordRateOffense keeps the offense in the RateOffenders list for review
+func recordRateOffense(redisConn *RedisConn, offense RateOffense) {
+	data, err := json.Marshal(offense)
+	if err != nil {
+		return
+	}
+	_, err = redisConn.Pipeline([]RedisCmd{
+		NewRedisCmd("LPUSH", rateOffendersList, string(data)),
+		NewRedisCmd("LTRIM", rateOffendersList, 0, rateOffendersMax-1),
+	})
+	logRedisError("recordRateOffense", err)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateTracker(t *testing.T) {
+	tracker := NewRateTracker([]RateWindow{{Seconds: 10, Max: 3}, {Seconds: 60, Max: 5}})
+	start := time.Date(2013, 7, 9, 15, 20, 0, 0, time.UTC)
+	observe := func(key string, second int) ([]RateOffense, bool) {
+		return tracker.Observe(key, start.Add(time.Duration(second)*time.Second))
+	}
+	for _, second := range []int{0, 1, 2} {
+		if offenses, over := observe("10.0.0.1", second); over || len(offenses) != 0 {
+			t.Errorf("request at %d is over", second)
+		}
+	}
+	offenses, over := observe("10.0.0.1", 3)
+	if !over || len(offenses) != 1 || offenses[0].Window != 10 || offenses[0].Count != 4 {
+		t.Errorf("4 requests in 10s got %v %+v", over, offenses)
+	}
+	// an offense is recorded once while the key stays over
+	if offenses, over := observe("10.0.0.1", 4); !over || len(offenses) != 0 {
+		t.Errorf("5th request got %v %+v", over, offenses)
+	}
+	if _, over := observe("10.0.0.2", 4); over {
+		t.Errorf("another key is over")
+	}
+	// the 10s window slides, the 60s window is still over
+	offenses, over = observe("10.0.0.1", 30)
+	if !over || len(offenses) != 1 || offenses[0].Window != 60 {
+		t.Errorf("6 requests in 60s got %v %+v", over, offenses)
+	}
+	if _, over := observe("10.0.0.1", 100); over {
+		t.Errorf("request after the windows is over")
+	}
+
+	for _, spec := range []string{"", "10", "10:0", "x:5", "10:5,"} {
+		if _, err := parseRateWindows(spec); err == nil {
+			t.Errorf("%q is accepted", spec)
+		}
+	}
+}
+
+func TestRateTrackersReload(t *testing.T) {
+	if old, ok := currentRuntime.Load().(*Runtime); ok {
+		defer SetRuntime(old)
+	}
+	patterns := []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}}
+	tracked := func(conf RuleConf) bool {
+		rateTrackers.Lock()
+		defer rateTrackers.Unlock()
+		return rateTrackers.trackers[rateTrackerID(conf)] != nil
+	}
+	fast := RuleConf{Name: "ip_rate", Field: "RemoteAddr", Op: "rate", Value: "10:5", OnMatch: RuleOutcome{Result: "NO"}}
+	slow := fast
+	slow.Value = "60:20"
+	var ipUA RuleConf
+	for _, conf := range DefaultFilterRules {
+		if conf.Name == "ip_ua_rate" {
+			ipUA = conf
+		}
+	}
+
+	runtime, err := NewRuntime(HolmesConfig{FilterRules: []RuleConf{fast}}, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRuntime(runtime)
+	if !tracked(fast) {
+		t.Fatalf("the tracker of %s is not shared", fast.Value)
+	}
+	kept := sharedRateTracker(rateTrackerID(fast), nil)
+
+	// the tracker of a changed rule is dropped when the new runtime is swapped in
+	runtime, err = NewRuntime(HolmesConfig{FilterRules: []RuleConf{fast}, WatchingRules: []RuleConf{slow}}, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRuntime(runtime)
+	if !tracked(fast) || !tracked(slow) || sharedRateTracker(rateTrackerID(fast), nil) != kept {
+		t.Errorf("the tracker of an unchanged rule is not kept")
+	}
+	runtime, err = NewRuntime(HolmesConfig{FilterRules: []RuleConf{slow}}, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRuntime(runtime)
+	if tracked(fast) || !tracked(slow) || tracked(ipUA) {
+		t.Errorf("the trackers of the rules swapped out are kept")
+	}
+}
@@ -1,22 +1,53 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	defaultRedisMaxIdle      = 8
+	defaultRedisIdleTimeout  = 240 // seconds
+	defaultRedisRetries      = 3
+	defaultRedisRetryBackoff = 100 // milliseconds
+)
+
 type RedisConf struct {
 	Network        string
 	Address        string
 	ConnectTimeout int64
-	ReadTimeout    int64
+	ReadTimeout    int64 // must be 0 or longer than the timeout of the blocking pops
 	WriteTimeout   int64
 	BlockTimeout   int64
+	MaxIdle        int    // idle connections kept in the pool, default is 8
+	MaxActive      int    // connections opened at most, 0 is no limit
+	IdleTimeout    int64  // seconds an idle connection is kept, default is 240
+	Retries        int    // times an idempotent command is retried, default is 3
+	RetryBackoff   int64  // milliseconds before the first retry, doubled after each retry
+	Database       int    // selected after a connection is dialed, default is 0
+	ChannelPrefix  string // prefixed to the names of the pub/sub channels
 }
 
+// RedisConn is a pool of connections to one redis server. It is safe to use
+// from several goroutines. Broken connections are dropped by the pool and a
+// new one is dialed by the next command, idempotent commands are retried with
+// backoff so a restart of redis is not seen by the callers.
+// The pub/sub channels are not kept apart by the database, their names are
+// prefixed by ChannelPrefix, so a replay into another database does not reach
+// the running filter.
 type RedisConn struct {
-	conn redis.Conn
+	pool          *redis.Pool
+	retries       int
+	backoff       time.Duration
+	channelPrefix string
 }
 
 type Slowlog struct {
@@ -27,17 +58,132 @@ type Slowlog struct {
 }
 
 func NewRedisConn(redisConf RedisConf) *RedisConn {
-	c, err := redis.DialTimeout(redisConf.Network, redisConf.Address, time.Duration(redisConf.ConnectTimeout), time.Duration(redisConf.ReadTimeout), time.Duration(redisConf.WriteTimeout))
-	if err != nil {
-		log.Fatal("(NewRedisConn) ", err)
+	maxIdle := redisConf.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultRedisMaxIdle
+	}
+	idleTimeout := time.Duration(redisConf.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRedisIdleTimeout * time.Second
+	}
+	retries := redisConf.Retries
+	if retries <= 0 {
+		retries = defaultRedisRetries
+	}
+	backoff := time.Duration(redisConf.RetryBackoff) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultRedisRetryBackoff * time.Millisecond
+	}
+	pool := &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   redisConf.MaxActive,
+		IdleTimeout: idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.DialTimeout(redisConf.Network, redisConf.Address, time.Duration(redisConf.ConnectTimeout), time.Duration(redisConf.ReadTimeout), time.Duration(redisConf.WriteTimeout))
+			if err != nil || redisConf.Database == 0 {
+				return c, err
+			}
+			if _, err := c.Do("SELECT", redisConf.Database); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+		// check a connection which was idle for a while before using it
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
 	}
 	return &RedisConn{
-		conn: c,
+		pool:          pool,
+		retries:       retries,
+		backoff:       backoff,
+		channelPrefix: redisConf.ChannelPrefix,
+	}
+}
+
+// Channel return the name of a pub/sub channel on this connection, to
+// PUBLISH it in a pipeline or a script
+func (redisConn *RedisConn) Channel(name string) string {
+	if redisConn == nil {
+		return name
 	}
+	return redisConn.channelPrefix + name
 }
 
 func (redisConn *RedisConn) Close() {
-	redisConn.conn.Close()
+	if redisConn != nil {
+		redisConn.pool.Close()
+	}
+}
+
+// do sends a command on a connection of the pool. An error replied by redis is
+// returned at once, a network error is retried if the command is idempotent.
+func (redisConn *RedisConn) do(idempotent bool, cmd string, args ...interface{}) (interface{}, error) {
+	backoff := redisConn.backoff
+	for i := 0; ; i++ {
+		conn := redisConn.pool.Get()
+		r, err := conn.Do(cmd, args...)
+		conn.Close()
+		if err == nil {
+			return r, nil
+		}
+		if _, ok := err.(redis.Error); ok || !idempotent || i >= redisConn.retries {
+			return nil, err
+		}
+		log.Println("(RedisConn) ", cmd, " failed, retry in ", backoff, ": ", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// stringSlice converts a multi bulk reply into a string slice
+func stringSlice(r interface{}, err error) ([]string, error) {
+	items := make([]string, 0, 16)
+	if err != nil || r == nil {
+		return items, err
+	}
+	v, err := redis.Strings(r, err)
+	if err != nil {
+		return items, err
+	}
+	return append(items, v...), nil
+}
+
+// nullableString converts a bulk reply into a string, a nil reply is ""
+func nullableString(r interface{}, err error) (string, error) {
+	if err != nil || r == nil {
+		return "", err
+	}
+	return redis.String(r, err)
+}
+
+// redisInt64 converts an integer reply, a nil reply is 0
+func redisInt64(r interface{}, err error) (int64, error) {
+	if err != nil || r == nil {
+		return 0, err
+	}
+	n, ok := r.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %T", r)
+	}
+	return n, nil
+}
+
+// pair converts the reply of the blocking pops into a <list,item> pair
+func pair(r interface{}, err error) (string, string, error) {
+	if err != nil || r == nil {
+		return "", "", err
+	}
+	v, err := redis.Strings(r, err)
+	if err != nil {
+		return "", "", err
+	}
+	return v[0], v[1], nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -46,50 +192,27 @@ func (redisConn *RedisConn) Close() {
 
 // GetKeys return the keys match the pattern in redis
 // output:a keys string slice
-func (redisConn *RedisConn) GetKeys(pattern string) []string {
-	keys := make([]string, 0, 16)
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("KEYS", pattern)
-		if err != nil {
-			log.Panic("(GetKeys) ", err)
-		}
-		if r != nil {
-			v, err := redis.Values(r, err)
-			if err != nil {
-				log.Panic("(GetKeys) ", err)
-			}
-			for _, key := range v {
-				keys = append(keys, string(key.([]uint8)))
-			}
-		}
+func (redisConn *RedisConn) GetKeys(pattern string) ([]string, error) {
+	if redisConn == nil {
+		return []string{}, nil
 	}
-	return keys
+	return stringSlice(redisConn.do(true, "KEYS", pattern))
 }
 
 // KeyType return the string representation of key
 // output:none,string,list,hash,set,zset
-func (redisConn *RedisConn) KeyType(key string) string {
-	var keyType string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("TYPE", key)
-		if err != nil {
-			log.Panic("(KeyType) ", err)
-		}
-		keyType = string(r.([]uint8))
+func (redisConn *RedisConn) KeyType(key string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return keyType
+	return redis.String(redisConn.do(true, "TYPE", key))
 }
 
-func (redisConn *RedisConn) KeyDel(key string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("DEL", key)
-		if err != nil {
-			panic(err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) KeyDel(key string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "DEL", key))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -98,31 +221,21 @@ func (redisConn *RedisConn) KeyDel(key string) int64 {
 
 // Set set a key value pair in redis
 // output:return string "OK"
-func (redisConn *RedisConn) Set(key string, value string) string {
-	var result string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SET", key, value)
-		if err != nil {
-			log.Panic("(Set) ", err)
-		}
-		result = r.(string)
+func (redisConn *RedisConn) Set(key string, value string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return result
+	return redis.String(redisConn.do(true, "SET", key, value))
 }
 
 // Get return a value of a key
 // output:1)if the key exist and is a string, return its value,
 //        2)else,return null string
-func (redisConn *RedisConn) Get(key string) string {
-	var result string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("GET", key)
-		if err != nil {
-			log.Panic("(Get) ", err)
-		}
-		result = r.(string)
+func (redisConn *RedisConn) Get(key string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return result
+	return nullableString(redisConn.do(true, "GET", key))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -137,40 +250,60 @@ func (redisConn *RedisConn) Get(key string) string {
 //     3)value
 // output:
 //     if the field is not exist,return 1,else return 0
-func (redisConn *RedisConn) HashSet(ht string, field string, value string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("HSET", ht, field, value)
-		if err != nil {
-			log.Panic("(HashSet) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) HashSet(ht string, field string, value string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "HSET", ht, field, value))
 }
 
-func (redisConn *RedisConn) HashGet(ht string, field string) string {
-	var result string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("HGET", ht, field)
-		if err != nil {
-			log.Panic("(HashGet) ", err)
-		}
-		result = string(r.([]uint8))
+func (redisConn *RedisConn) HashGet(ht string, field string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return result
+	return nullableString(redisConn.do(true, "HGET", ht, field))
 }
 
-func (redisConn *RedisConn) HashIncrby(ht string, field string, increment int) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("HINCRBY", ht, field, increment)
-		if err != nil {
-			log.Panic("(HashIncrby) ", err)
+// HashMultiGet return the values of the fields, "" for a missing field
+func (redisConn *RedisConn) HashMultiGet(ht string, fields ...string) ([]string, error) {
+	values := make([]string, len(fields))
+	if redisConn == nil || len(fields) == 0 {
+		return values, nil
+	}
+	args := redis.Args{}.Add(ht).AddFlat(fields)
+	items, err := redis.Values(redisConn.do(true, "HMGET", args...))
+	if err != nil {
+		return values, err
+	}
+	for i, item := range items {
+		if i < len(values) && item != nil {
+			values[i], _ = redis.String(item, nil)
 		}
-		result = r.(int64)
 	}
-	return result
+	return values, nil
+}
+
+// HashGetAll return the fields and values of ht
+func (redisConn *RedisConn) HashGetAll(ht string) (map[string]string, error) {
+	values := map[string]string{}
+	if redisConn == nil {
+		return values, nil
+	}
+	items, err := stringSlice(redisConn.do(true, "HGETALL", ht))
+	if err != nil {
+		return values, err
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		values[items[i]] = items[i+1]
+	}
+	return values, nil
+}
+
+func (redisConn *RedisConn) HashIncrby(ht string, field string, increment int) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(false, "HINCRBY", ht, field, increment))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -179,100 +312,54 @@ func (redisConn *RedisConn) HashIncrby(ht string, field string, increment int) i
 
 // ListLen return the lenght of a list
 // output:the lenght of list
-func (redisConn *RedisConn) ListLen(list string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("LLEN", list)
-		if err != nil {
-			log.Panic("(ListLen) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) ListLen(list string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "LLEN", list))
 }
 
-func (redisConn *RedisConn) ListRange(list string, start, end int) []string {
-	items := make([]string, 0, 16)
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("LRANGE", list, start, end)
-		if err != nil {
-			log.Panic("(ListRange) ", err)
-		}
-		if r != nil {
-			v, err := redis.Values(r, err)
-			if err != nil {
-				log.Panic("(ListRange) ", err)
-			}
-			for _, item := range v {
-				items = append(items, string(item.([]uint8)))
-			}
-		}
+func (redisConn *RedisConn) ListRange(list string, start, end int) ([]string, error) {
+	if redisConn == nil {
+		return []string{}, nil
 	}
-	return items
+	return stringSlice(redisConn.do(true, "LRANGE", list, start, end))
 }
 
 // ListLeftPush push an item into a list at the left side of the list
 // output:the lenght of list after push this item
-func (redisConn *RedisConn) ListLeftPush(list, item string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("LPUSH", list, item)
-		if err != nil {
-			log.Panic("(ListLeftPush) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) ListLeftPush(list, item string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(false, "LPUSH", list, item))
 }
 
 // ListLeftPop return the most left side element of a list
 // output:if list a items return the most left side element,else,return null string
-func (redisConn *RedisConn) ListLeftPop(list string) string {
-	var result string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("LPOP", list)
-		if err != nil {
-			log.Panic("(ListLeftPop) ", err)
-		}
-		if r == nil {
-			result = ""
-		} else {
-			result = string(r.([]uint8))
-		}
+func (redisConn *RedisConn) ListLeftPop(list string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return result
+	return nullableString(redisConn.do(false, "LPOP", list))
 }
 
 // ListRightPush push an item into a list at the right side of the list
 // output:the lenght of list after push this item
-func (redisConn *RedisConn) ListRightPush(list, item string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("RPUSH", list, item)
-		if err != nil {
-			log.Panic("(ListRightPush) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) ListRightPush(list, item string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(false, "RPUSH", list, item))
 }
 
 // ListRightPop return the most right side element of a list
 // output:if list a items return the most right side element,else,return null string
-func (redisConn *RedisConn) ListRightPop(list string) string {
-	var result string
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("RPOP", list)
-		if err != nil {
-			log.Panic("(ListRightPop) ", err)
-		}
-		if r == nil {
-			result = ""
-		} else {
-			result = string(r.([]uint8))
-		}
+func (redisConn *RedisConn) ListRightPop(list string) (string, error) {
+	if redisConn == nil {
+		return "", nil
 	}
-	return result
+	return nullableString(redisConn.do(false, "RPOP", list))
 }
 
 // BlockListLeftPop return the most left side element of a list,when the list we want to
@@ -282,23 +369,11 @@ func (redisConn *RedisConn) ListRightPop(list string) string {
 //     2)timeout second type of int64
 // output:
 //     if success,return a <list,item> pair;else return a <"",""> pair
-func (redisConn *RedisConn) BlockListLeftPop(list string, timeout int64) (string, string) {
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("BLPOP", list, timeout)
-		if err != nil {
-			log.Panic("(BlockListLeftPop) ", err)
-		}
-		if r != nil {
-			v, err := redis.Values(r, err)
-			if err != nil {
-				log.Panic("(BlockListLeftPop) ", err)
-			}
-			listname := string(v[0].([]uint8))
-			item := string(v[1].([]uint8))
-			return listname, item
-		}
+func (redisConn *RedisConn) BlockListLeftPop(list string, timeout int64) (string, string, error) {
+	if redisConn == nil {
+		return "", "", nil
 	}
-	return "", ""
+	return pair(redisConn.do(false, "BLPOP", list, timeout))
 }
 
 // BlockListRightPop return the most right side element of a list,when the list we want to
@@ -308,178 +383,573 @@ func (redisConn *RedisConn) BlockListLeftPop(list string, timeout int64) (string
 //     2)timeout second type of int64
 // output:
 //     if success,return a <list,item> pair;else return a <"",""> pair
-func (redisConn *RedisConn) BlockListRightPop(list string, timeout int64) (string, string) {
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("BRPOP", list, timeout)
-		if err != nil {
-			log.Panic("(BlockListRightPop) ", err)
-		}
-		if r != nil {
-			v, err := redis.Values(r, err)
-			if err != nil {
-				log.Panic("(BlockListRightPop) ", err)
-			}
-			listname := string(v[0].([]uint8))
-			item := string(v[1].([]uint8))
-			return listname, item
-		}
+func (redisConn *RedisConn) BlockListRightPop(list string, timeout int64) (string, string, error) {
+	if redisConn == nil {
+		return "", "", nil
+	}
+	return pair(redisConn.do(false, "BRPOP", list, timeout))
+}
+
+// BlockListsRightPop is BlockListRightPop over several lists, the lists are
+// checked in the order given
+// output:
+//     if success,return a <list,item> pair;else return a <"",""> pair
+func (redisConn *RedisConn) BlockListsRightPop(lists []string, timeout int64) (string, string, error) {
+	if redisConn == nil {
+		return "", "", nil
+	}
+	return pair(redisConn.do(false, "BRPOP", redis.Args{}.AddFlat(lists).Add(timeout)...))
+}
+
+// BlockListRightPopLeftPush moves the most right side element of src to the left
+// side of dst and return it, when src have no element,block at most timeout
+// seconds
+// output:the element, or null string if src is still empty
+func (redisConn *RedisConn) BlockListRightPopLeftPush(src, dst string, timeout int64) (string, error) {
+	if redisConn == nil {
+		return "", nil
+	}
+	return nullableString(redisConn.do(false, "BRPOPLPUSH", src, dst, timeout))
+}
+
+// ListRem removes count elements equal to item from a list, from the right side
+// if count is negative and all of them if it is 0
+// output:the number of removed elements
+func (redisConn *RedisConn) ListRem(list string, count int64, item string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return "", ""
+	return redis.Int64(redisConn.do(false, "LREM", list, count, item))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // Sets operation
 ///////////////////////////////////////////////////////////////////////////////
 
-func (redisConn *RedisConn) SetAdd(set string, member string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SADD", set, member)
-		if err != nil {
-			log.Panic("(SetAdd) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) SetAdd(set string, member string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "SADD", set, member))
 }
 
-func (redisConn *RedisConn) SetRem(set string, member string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SREM", set, member)
-		if err != nil {
-			log.Panic("(SetRem) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) SetRem(set string, member string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "SREM", set, member))
 }
 
-func (redisConn *RedisConn) SetIsMember(set string, member string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SISMEMBER", set, member)
-		if err != nil {
-			log.Panic("(SetIsMember) ", err)
-		}
-		result = r.(int64)
+func (redisConn *RedisConn) SetIsMember(set string, member string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
 	}
-	return result
+	return redis.Int64(redisConn.do(true, "SISMEMBER", set, member))
 }
 
 // SetCard returns the set cardinality (number of elements) of the set stored at set
-func (redisConn *RedisConn) SetCard(set string) int64 {
-	var result int64
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SCARD", set)
+func (redisConn *RedisConn) SetCard(set string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(true, "SCARD", set))
+}
+
+// SetMembers returns all the members of the set value stored at set
+func (redisConn *RedisConn) SetMembers(set string) ([]string, error) {
+	if redisConn == nil {
+		return []string{}, nil
+	}
+	return stringSlice(redisConn.do(true, "SMEMBERS", set))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Sorted Sets operation
+///////////////////////////////////////////////////////////////////////////////
+
+// ScoredMember is a member of a sorted set with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// SortedSetAdd adds member with score to zset, or updates its score
+// output:the number of new members
+func (redisConn *RedisConn) SortedSetAdd(zset string, score float64, member string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(true, "ZADD", zset, score, member))
+}
+
+func (redisConn *RedisConn) SortedSetRem(zset string, member string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(true, "ZREM", zset, member))
+}
+
+// SortedSetScore return the score of member, ok is false if it is not in zset
+func (redisConn *RedisConn) SortedSetScore(zset string, member string) (score float64, ok bool, err error) {
+	if redisConn == nil {
+		return 0, false, nil
+	}
+	r, err := redisConn.do(true, "ZSCORE", zset, member)
+	if err != nil || r == nil {
+		return 0, false, err
+	}
+	score, err = redis.Float64(r, err)
+	return score, err == nil, err
+}
+
+func (redisConn *RedisConn) SortedSetCard(zset string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(true, "ZCARD", zset))
+}
+
+// SortedSetRangeByScore return the members with a score between min and max,
+// min and max are numbers, -inf, +inf, or a number after ( for an open bound
+func (redisConn *RedisConn) SortedSetRangeByScore(zset string, min string, max string) ([]string, error) {
+	if redisConn == nil {
+		return []string{}, nil
+	}
+	return stringSlice(redisConn.do(true, "ZRANGEBYSCORE", zset, min, max))
+}
+
+// SortedSetRangeByScoreWithScores is SortedSetRangeByScore which also return
+// the scores
+func (redisConn *RedisConn) SortedSetRangeByScoreWithScores(zset string, min string, max string) ([]ScoredMember, error) {
+	members := make([]ScoredMember, 0, 16)
+	if redisConn == nil {
+		return members, nil
+	}
+	items, err := redis.Strings(redisConn.do(true, "ZRANGEBYSCORE", zset, min, max, "WITHSCORES"))
+	if err != nil {
+		return members, err
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		score, err := strconv.ParseFloat(items[i+1], 64)
 		if err != nil {
-			log.Panic("(SetCard) ", err)
+			return members, err
 		}
-		result = r.(int64)
+		members = append(members, ScoredMember{Member: items[i], Score: score})
 	}
-	return result
+	return members, nil
 }
 
-// SetMembers returns all the members of the set value stored at set
-func (redisConn *RedisConn) SetMembers(set string) []string {
-	members := make([]string, 0, 16)
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("SMEMBERS", set)
+// SortedSetRemRangeByScore removes the members with a score between min and
+// max, see SortedSetRangeByScore
+// output:the number of removed members
+func (redisConn *RedisConn) SortedSetRemRangeByScore(zset string, min string, max string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(true, "ZREMRANGEBYSCORE", zset, min, max))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Pub/Sub operation
+///////////////////////////////////////////////////////////////////////////////
+
+// PubSubMessage is a message received from a channel
+type PubSubMessage struct {
+	Channel string
+	Data    string
+}
+
+// Publish posts a message to a channel
+// output:the number of clients which received the message
+func (redisConn *RedisConn) Publish(channel string, message string) (int64, error) {
+	if redisConn == nil {
+		return 0, nil
+	}
+	return redis.Int64(redisConn.do(false, "PUBLISH", redisConn.Channel(channel), message))
+}
+
+// Subscription delivers the messages of the subscribed channels on Messages.
+// It has its own connection, which is dialed again with backoff when it is
+// broken, the messages published in between are lost.
+type Subscription struct {
+	Messages  <-chan PubSubMessage
+	redisConn *RedisConn
+	channels  []string
+	mutex     sync.Mutex
+	conn      redis.Conn
+	closed    bool
+	done      chan struct{} // closed by Close
+}
+
+// Subscribe subscribes to the channels, the first connection is dialed at
+// once so a bad address is an error
+func (redisConn *RedisConn) Subscribe(channels ...string) (*Subscription, error) {
+	if redisConn == nil {
+		return nil, errors.New("subscribe on a nil RedisConn")
+	}
+	conn, err := redisConn.subscribe(channels)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(chan PubSubMessage, 64)
+	subscription := &Subscription{
+		Messages:  messages,
+		redisConn: redisConn,
+		channels:  channels,
+		conn:      conn,
+		done:      make(chan struct{}),
+	}
+	go subscription.run(messages)
+	return subscription, nil
+}
+
+func (redisConn *RedisConn) subscribe(channels []string) (redis.Conn, error) {
+	conn, err := redisConn.pool.Dial()
+	if err != nil {
+		return nil, err
+	}
+	args := redis.Args{}
+	for _, channel := range channels {
+		args = args.Add(redisConn.Channel(channel))
+	}
+	if err := (redis.PubSubConn{Conn: conn}).Subscribe(args...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (subscription *Subscription) run(messages chan<- PubSubMessage) {
+	defer close(messages)
+	backoff := subscription.redisConn.backoff
+	for {
+		subscription.mutex.Lock()
+		conn := subscription.conn
+		subscription.mutex.Unlock()
+		if conn != nil {
+			err := subscription.receive(conn, messages)
+			conn.Close()
+			if subscription.isClosed() {
+				return
+			}
+			log.Println("(Subscription) ", subscription.channels, " lost, resubscribe: ", err)
+			backoff = subscription.redisConn.backoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-subscription.done:
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+		conn, err := subscription.redisConn.subscribe(subscription.channels)
 		if err != nil {
-			log.Panic("(SetMembers) ", err)
+			log.Println("(Subscription) ", err)
 		}
-		if r != nil {
-			v, err := redis.Values(r, err)
-			if err != nil {
-				log.Panic("(SetMembers) ", err)
+		subscription.mutex.Lock()
+		if subscription.closed {
+			subscription.mutex.Unlock()
+			if conn != nil {
+				conn.Close()
 			}
-			for _, member := range v {
-				members = append(members, string(member.([]uint8)))
+			return
+		}
+		subscription.conn = conn
+		subscription.mutex.Unlock()
+	}
+}
+
+func (subscription *Subscription) receive(conn redis.Conn, messages chan<- PubSubMessage) error {
+	pubSubConn := redis.PubSubConn{Conn: conn}
+	for {
+		switch v := pubSubConn.Receive().(type) {
+		case redis.Message:
+			channel := strings.TrimPrefix(v.Channel, subscription.redisConn.channelPrefix)
+			select {
+			case messages <- PubSubMessage{Channel: channel, Data: string(v.Data)}:
+			case <-subscription.done:
+				// nobody reads Messages any more
+				return errors.New("subscription closed")
 			}
+		case error:
+			return v
 		}
 	}
-	return members
 }
 
-///////////////////////////////////////////////////////////////////////////////
-// Sorted Sets operation
-///////////////////////////////////////////////////////////////////////////////
+func (subscription *Subscription) isClosed() bool {
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+	return subscription.closed
+}
 
-// TODO
+// Close unsubscribes and closes Messages, the messages not read yet may be
+// dropped
+func (subscription *Subscription) Close() {
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	close(subscription.done)
+	if subscription.conn != nil {
+		subscription.conn.Close()
+	}
+}
 
 ///////////////////////////////////////////////////////////////////////////////
-// Pub/Sub operation
+// Pipelining
 ///////////////////////////////////////////////////////////////////////////////
 
-// TODO
+// RedisCmd is one command of a pipeline or a transaction
+type RedisCmd struct {
+	Name string
+	Args []interface{}
+}
+
+func NewRedisCmd(name string, args ...interface{}) RedisCmd {
+	return RedisCmd{Name: name, Args: args}
+}
+
+// Pipeline sends the commands in one round trip and return their replies.
+// The commands are not retried, an error replied by redis is put into the
+// replies and the first one is returned.
+func (redisConn *RedisConn) Pipeline(cmds []RedisCmd) ([]interface{}, error) {
+	if redisConn == nil || len(cmds) == 0 {
+		return []interface{}{}, nil
+	}
+	conn := redisConn.pool.Get()
+	defer conn.Close()
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		r, err := conn.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return nil, err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+			r = err
+		}
+		replies[i] = r
+	}
+	return replies, replyErr
+}
 
 ///////////////////////////////////////////////////////////////////////////////
 // Transactions operation
 ///////////////////////////////////////////////////////////////////////////////
 
-// TODO
+// ErrTransactionAborted is returned when a watched key kept changing until the
+// retries of WatchTransaction ran out
+var ErrTransactionAborted = errors.New("transaction aborted, a watched key was modified")
+
+// Transaction runs the commands in MULTI/EXEC and return their replies, none
+// of the commands is run when one of them can not be queued
+func (redisConn *RedisConn) Transaction(cmds []RedisCmd) ([]interface{}, error) {
+	if redisConn == nil || len(cmds) == 0 {
+		return []interface{}{}, nil
+	}
+	conn := redisConn.pool.Get()
+	defer conn.Close()
+	return execTransaction(conn, cmds)
+}
+
+// execTransaction sends MULTI, the commands and EXEC on conn, a nil reply of
+// EXEC means a watched key was modified
+func execTransaction(conn redis.Conn, cmds []RedisCmd) ([]interface{}, error) {
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return nil, err
+		}
+	}
+	r, err := conn.Do("EXEC")
+	if err == nil && r == nil {
+		return nil, ErrTransactionAborted
+	}
+	return redis.Values(r, err)
+}
+
+// RedisTx is the connection a WatchTransaction reads the watched keys on
+type RedisTx struct {
+	conn redis.Conn
+}
+
+func (tx *RedisTx) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return tx.conn.Do(cmd, args...)
+}
+
+// WatchTransaction WATCHes the keys and calls build, which reads them on tx and
+// return the commands to run in MULTI/EXEC. When one of the keys is modified
+// before EXEC, it starts over, at most Retries times.
+func (redisConn *RedisConn) WatchTransaction(keys []string, build func(tx *RedisTx) ([]RedisCmd, error)) ([]interface{}, error) {
+	if redisConn == nil {
+		return []interface{}{}, nil
+	}
+	conn := redisConn.pool.Get()
+	defer conn.Close()
+	for i := 0; ; i++ {
+		if _, err := conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+			return nil, err
+		}
+		cmds, err := build(&RedisTx{conn: conn})
+		if err != nil || len(cmds) == 0 {
+			conn.Do("UNWATCH")
+			return []interface{}{}, err
+		}
+		replies, err := execTransaction(conn, cmds)
+		if err != ErrTransactionAborted || i >= redisConn.retries {
+			return replies, err
+		}
+	}
+}
 
 ///////////////////////////////////////////////////////////////////////////////
 // Scripting operation
 ///////////////////////////////////////////////////////////////////////////////
 
-// TODO
+// RedisScript is a Lua script which is run by its SHA1, the script is only
+// sent to redis when redis does not have it in its script cache
+type RedisScript struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+// NewRedisScript return a script taking keyCount keys before its arguments
+func NewRedisScript(keyCount int, src string) *RedisScript {
+	hash := sha1.Sum([]byte(src))
+	return &RedisScript{keyCount: keyCount, src: src, hash: hex.EncodeToString(hash[:])}
+}
+
+// EvalScript runs the script with EVALSHA, loading it first if redis replies
+// NOSCRIPT. A script is not retried on a network error.
+func (redisConn *RedisConn) EvalScript(script *RedisScript, keysAndArgs ...interface{}) (interface{}, error) {
+	if redisConn == nil {
+		return nil, nil
+	}
+	args := redis.Args{}.Add(script.hash, script.keyCount).Add(keysAndArgs...)
+	r, err := redisConn.do(false, "EVALSHA", args...)
+	if err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return r, err
+	}
+	if err := redisConn.LoadScript(script); err != nil {
+		return nil, err
+	}
+	return redisConn.do(false, "EVALSHA", args...)
+}
+
+// LoadScript puts the script into the script cache of redis
+func (redisConn *RedisConn) LoadScript(script *RedisScript) error {
+	if redisConn == nil {
+		return nil
+	}
+	hash, err := redis.String(redisConn.do(true, "SCRIPT", "LOAD", script.src))
+	if err == nil && hash != script.hash {
+		err = fmt.Errorf("script loaded as %s, expect %s", hash, script.hash)
+	}
+	return err
+}
 
 ///////////////////////////////////////////////////////////////////////////////
 // Connection operation
 ///////////////////////////////////////////////////////////////////////////////
 
-// TODO
+// Ping checks that redis answers
+func (redisConn *RedisConn) Ping() error {
+	if redisConn == nil {
+		return errors.New("ping on a nil RedisConn")
+	}
+	_, err := redisConn.do(true, "PING")
+	return err
+}
 
 ///////////////////////////////////////////////////////////////////////////////
 // Server operation
 ///////////////////////////////////////////////////////////////////////////////
 
-// TODO
-func (redisConn *RedisConn) GetSlowlog() []Slowlog {
-	slowlogs := make([]Slowlog, 0, 16)
-	if redisConn != nil {
-		r, err := redisConn.conn.Do("slowlog", "get")
-		if err != nil {
-			log.Panic("(GetSlowlog) ", err)
+// Info return the fields of a section of INFO, such as memory or clients, all
+// the sections if section is ""
+func (redisConn *RedisConn) Info(section string) (map[string]string, error) {
+	info := map[string]string{}
+	if redisConn == nil {
+		return info, nil
+	}
+	args := []interface{}{}
+	if section != "" {
+		args = append(args, section)
+	}
+	text, err := redis.String(redisConn.do(true, "INFO", args...))
+	if err != nil {
+		return info, err
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		if i := strings.Index(line, ":"); i > 0 {
+			info[line[:i]] = line[i+1:]
+		}
+	}
+	return info, nil
+}
 
-		slogs, errForValues := redis.Values(r, err) // convert interface{} to []interface{}
-		if errForValues != nil {
-			log.Panic("(GetSlowlog) ", errForValues)
+func (redisConn *RedisConn) GetSlowlog() ([]Slowlog, error) {
+	slowlogs := make([]Slowlog, 0, 16)
+	if redisConn == nil {
+		return slowlogs, nil
+	}
+	r, err := redisConn.do(true, "slowlog", "get")
+	slogs, err := redis.Values(r, err) // convert interface{} to []interface{}
+	if err != nil {
+		return slowlogs, err
+	}
+	for _, slog := range slogs { // each log is type of interface{}
+		var slowlog Slowlog
+		slog_items, err := redis.Values(slog, nil) // convert interface{} to []interface{}
+		if err != nil {
+			return slowlogs, err
 		}
-		for _, slog := range slogs { // each log is type of interface{}
-			var slowlog Slowlog
-			slog_items, errForValues := redis.Values(slog, err) // convert interface{} to []interface{}
+		for i, slog_item := range slog_items { // each log item is type of interface{}
+			switch slog_item.(type) {
+			case int64:
+				if i == 0 {
+					slowlog.Id = slog_item.(int64)
+				} else if i == 1 {
+					slowlog.Log_timestamp = slog_item.(int64)
+				} else if i == 2 {
+					slowlog.Time_consumed = slog_item.(int64)
+				}
 
-			if errForValues != nil {
-				log.Panic("(GetSlowlog) ", errForValues)
-			}
-			for i, slog_item := range slog_items { // each log item is type of interface{}
-				switch slog_item.(type) {
-				case int64:
-					if i == 0 {
-						slowlog.Id = slog_item.(int64)
-					} else if i == 1 {
-						slowlog.Log_timestamp = slog_item.(int64)
-					} else if i == 2 {
-						slowlog.Time_consumed = slog_item.(int64)
-					}
-
-				case interface{}: // each cmd is type of interface{}
-					cmd_items, errForValues := redis.Values(slog_item, err) //  get each cmd item
-					if errForValues != nil {
-						log.Panic("(GetSlowlog) ", errForValues)
-					}
-					var cmd string
-					for _, cmd_item := range cmd_items {
-						cmd = cmd + string(cmd_item.([]uint8)) + " "
-					}
-					slowlog.Cmd = cmd
+			case []interface{}: // each cmd is type of []interface{}
+				cmd_items, err := redis.Strings(slog_item, nil) //  get each cmd item
+				if err != nil {
+					return slowlogs, err
 				}
-			} // end of loop for each log
-			slowlogs = append(slowlogs, slowlog)
-		} // end of loop for all logs
-	} // end of main if
-	return slowlogs
+				var cmd string
+				for _, cmd_item := range cmd_items {
+					cmd = cmd + cmd_item + " "
+				}
+				slowlog.Cmd = cmd
+			}
+		} // end of loop for each log
+		slowlogs = append(slowlogs, slowlog)
+	} // end of loop for all logs
+	return slowlogs, nil
 }
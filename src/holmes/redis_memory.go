@@ -0,0 +1,727 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRedis is a redis in memory with the commands of holmes, for a replay
+// which keeps its lists apart from the running filter, and for the tests. It
+// runs no Lua, a script is run by the Go function given to WithMemory.
+type MemoryRedis struct {
+	mutex       sync.Mutex
+	data        map[string]interface{} // string, []string, map[string]bool, map[string]float64 or map[string]string
+	expires     map[string]time.Time
+	subscribers map[*memoryConn]bool
+	published   []PubSubMessage
+}
+
+// memoryScripts are the Go functions of the scripts by their SHA1
+var memoryScripts = map[string]func(db *MemoryRedis, keys []string, args []string) interface{}{}
+
+// WithMemory sets the Go function which runs the script on a MemoryRedis, it
+// is called when the package is initialized
+func (script *RedisScript) WithMemory(run func(db *MemoryRedis, keys []string, args []string) interface{}) *RedisScript {
+	memoryScripts[script.hash] = run
+	return script
+}
+
+func NewMemoryRedis() *MemoryRedis {
+	return &MemoryRedis{
+		data:        map[string]interface{}{},
+		expires:     map[string]time.Time{},
+		subscribers: map[*memoryConn]bool{},
+	}
+}
+
+// Conn return a RedisConn on the data of db
+func (db *MemoryRedis) Conn() *RedisConn {
+	return &RedisConn{
+		pool: &redis.Pool{
+			MaxIdle: 4,
+			Dial:    func() (redis.Conn, error) { return &memoryConn{db: db}, nil },
+		},
+		retries: 1,
+		backoff: time.Millisecond,
+	}
+}
+
+type memoryConn struct {
+	db       *MemoryRedis
+	pending  []interface{}
+	multi    [][]string // the commands queued after MULTI, run by EXEC
+	inMulti  bool
+	watched  map[string]string // the watched keys and their values at WATCH
+	messages chan interface{}
+	closed   chan struct{}
+}
+
+func (conn *memoryConn) Close() error {
+	conn.db.mutex.Lock()
+	defer conn.db.mutex.Unlock()
+	if conn.closed != nil {
+		select {
+		case <-conn.closed:
+		default:
+			close(conn.closed)
+		}
+		delete(conn.db.subscribers, conn)
+	}
+	return nil
+}
+
+func (conn *memoryConn) Err() error {
+	return nil
+}
+
+func (conn *memoryConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	conn.pending = nil
+	r := conn.exec(cmd, args)
+	if err, ok := r.(error); ok {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (conn *memoryConn) Send(cmd string, args ...interface{}) error {
+	if r := conn.exec(cmd, args); cmd != "SUBSCRIBE" {
+		// the confirmations of SUBSCRIBE are received as messages
+		conn.pending = append(conn.pending, r)
+	}
+	return nil
+}
+
+func (conn *memoryConn) Flush() error {
+	return nil
+}
+
+func (conn *memoryConn) Receive() (interface{}, error) {
+	if len(conn.pending) > 0 {
+		r := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		if err, ok := r.(error); ok {
+			return nil, err
+		}
+		return r, nil
+	}
+	if conn.messages == nil {
+		return nil, errors.New("no reply to receive")
+	}
+	select {
+	case message := <-conn.messages:
+		return message, nil
+	case <-conn.closed:
+		return nil, errors.New("connection closed")
+	}
+}
+
+func (conn *memoryConn) exec(cmd string, args []interface{}) interface{} {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			strs[i] = string(v)
+		case float64:
+			strs[i] = memoryScore(v)
+		default:
+			strs[i] = fmt.Sprint(v)
+		}
+	}
+	cmd = strings.ToUpper(cmd)
+	switch cmd {
+	case "MULTI":
+		conn.inMulti, conn.multi = true, [][]string{}
+		return "OK"
+	case "EXEC":
+		watched := conn.watched
+		conn.inMulti, conn.watched = false, nil
+		for key, value := range watched {
+			if conn.db.dump(key) != value {
+				// a watched key was modified, the transaction is aborted
+				return nil
+			}
+		}
+		replies := make([]interface{}, len(conn.multi))
+		for i, queued := range conn.multi {
+			replies[i] = conn.db.run(queued[0], queued[1:])
+		}
+		return replies
+	case "WATCH":
+		if conn.watched == nil {
+			conn.watched = map[string]string{}
+		}
+		for _, key := range strs {
+			conn.watched[key] = conn.db.dump(key)
+		}
+		return "OK"
+	case "DISCARD", "UNWATCH":
+		conn.inMulti, conn.watched = false, nil
+		return "OK"
+	case "SUBSCRIBE":
+		conn.db.mutex.Lock()
+		if conn.messages == nil {
+			conn.messages = make(chan interface{}, 64)
+			conn.closed = make(chan struct{})
+		}
+		conn.db.subscribers[conn] = true
+		conn.db.mutex.Unlock()
+		for i, channel := range strs {
+			conn.messages <- []interface{}{[]byte("subscribe"), []byte(channel), int64(i + 1)}
+		}
+		return "OK"
+	}
+	if conn.inMulti {
+		conn.multi = append(conn.multi, append([]string{cmd}, strs...))
+		return "QUEUED"
+	}
+	return conn.db.run(cmd, strs)
+}
+
+// dump return the value of key as a string, to tell whether a watched key was
+// modified
+func (db *MemoryRedis) dump(key string) string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return fmt.Sprint(db.get(key))
+}
+
+func (db *MemoryRedis) run(cmd string, args []string) interface{} {
+	if cmd == "EVALSHA" {
+		run := memoryScripts[args[0]]
+		if run == nil {
+			return redis.Error("NOSCRIPT the script runs in redis only")
+		}
+		n, _ := strconv.Atoi(args[1])
+		return run(db, args[2:2+n], args[2+n:])
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.command(cmd, args)
+}
+
+// Do runs a command on the data, for the Go functions of the scripts
+func (db *MemoryRedis) Do(cmd string, args ...interface{}) interface{} {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = fmt.Sprint(arg)
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.command(strings.ToUpper(cmd), strs)
+}
+
+func memoryScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// memoryBound parses a bound of ZRANGEBYSCORE
+func memoryBound(bound string) (float64, bool) {
+	open := strings.HasPrefix(bound, "(")
+	score, _ := strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+	return score, open
+}
+
+func memoryInBounds(score float64, min string, max string) bool {
+	low, lowOpen := memoryBound(min)
+	high, highOpen := memoryBound(max)
+	return (score > low || !lowOpen && score == low) && (score < high || !highOpen && score == high)
+}
+
+func (db *MemoryRedis) get(key string) interface{} {
+	if expires, ok := db.expires[key]; ok && time.Now().After(expires) {
+		delete(db.data, key)
+		delete(db.expires, key)
+	}
+	return db.data[key]
+}
+
+func (db *MemoryRedis) list(key string) []string {
+	list, _ := db.get(key).([]string)
+	return list
+}
+
+func (db *MemoryRedis) set(key string) map[string]bool {
+	set, ok := db.get(key).(map[string]bool)
+	if !ok {
+		set = map[string]bool{}
+		db.data[key] = set
+	}
+	return set
+}
+
+func (db *MemoryRedis) zset(key string) map[string]float64 {
+	zset, ok := db.get(key).(map[string]float64)
+	if !ok {
+		zset = map[string]float64{}
+		db.data[key] = zset
+	}
+	return zset
+}
+
+func (db *MemoryRedis) hash(key string) map[string]string {
+	hash, ok := db.get(key).(map[string]string)
+	if !ok {
+		hash = map[string]string{}
+		db.data[key] = hash
+	}
+	return hash
+}
+
+// memorySortedMembers return the members of a zset by score then member
+func memorySortedMembers(zset map[string]float64) []string {
+	members := make([]string, 0, len(zset))
+	for member := range zset {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+func memoryBulks(strs []string) []interface{} {
+	replies := make([]interface{}, len(strs))
+	for i, s := range strs {
+		replies[i] = []byte(s)
+	}
+	return replies
+}
+
+func (db *MemoryRedis) dropEmpty(key string) {
+	switch v := db.data[key].(type) {
+	case []string:
+		if len(v) == 0 {
+			delete(db.data, key)
+		}
+	case map[string]bool:
+		if len(v) == 0 {
+			delete(db.data, key)
+		}
+	case map[string]float64:
+		if len(v) == 0 {
+			delete(db.data, key)
+		}
+	case map[string]string:
+		if len(v) == 0 {
+			delete(db.data, key)
+		}
+	}
+}
+
+// memoryKeyTypes are the types of the keys of the commands
+var memoryKeyTypes = map[string]string{
+	"GET": "string", "INCR": "string", "INCRBY": "string",
+	"LPUSH": "list", "LTRIM": "list", "RPUSH": "list", "LPOP": "list", "RPOP": "list", "LLEN": "list", "LRANGE": "list", "LREM": "list", "RPOPLPUSH": "list", "BRPOPLPUSH": "list",
+	"SADD": "set", "SREM": "set", "SISMEMBER": "set", "SCARD": "set", "SMEMBERS": "set",
+	"ZADD": "zset", "ZREM": "zset", "ZSCORE": "zset", "ZCARD": "zset", "ZRANGE": "zset", "ZRANGEBYSCORE": "zset", "ZREMRANGEBYSCORE": "zset", "ZCOUNT": "zset",
+	"HSET": "hash", "HGET": "hash", "HMGET": "hash", "HGETALL": "hash", "HINCRBY": "hash", "HDEL": "hash",
+}
+
+func (db *MemoryRedis) command(cmd string, args []string) interface{} {
+	if len(args) > 0 {
+		if keyType := memoryKeyTypes[cmd]; keyType != "" {
+			if actual := db.command("TYPE", args[:1]); actual != "none" && actual != keyType {
+				return redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+			}
+		}
+		defer db.dropEmpty(args[0])
+	}
+	switch cmd {
+	case "SCRIPT":
+		return redis.Error("ERR no Lua in memory")
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "FLUSHDB":
+		db.data, db.expires = map[string]interface{}{}, map[string]time.Time{}
+		return "OK"
+	case "INFO":
+		return []byte("# Server\r\nredis_version:memory\r\n\r\n# Keyspace\r\n")
+	case "SLOWLOG":
+		return []interface{}{}
+	case "PUBLISH":
+		message := []interface{}{[]byte("message"), []byte(args[0]), []byte(args[1])}
+		db.published = append(db.published, PubSubMessage{Channel: args[0], Data: args[1]})
+		for conn := range db.subscribers {
+			conn.messages <- message
+		}
+		return int64(len(db.subscribers))
+	case "KEYS":
+		keys := []string{}
+		for key := range db.data {
+			if matched, _ := path.Match(args[0], key); matched && db.get(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return memoryBulks(keys)
+	case "TYPE":
+		switch db.get(args[0]).(type) {
+		case string:
+			return "string"
+		case []string:
+			return "list"
+		case map[string]bool:
+			return "set"
+		case map[string]float64:
+			return "zset"
+		case map[string]string:
+			return "hash"
+		}
+		return "none"
+	case "EXISTS":
+		if db.get(args[0]) != nil {
+			return int64(1)
+		}
+		return int64(0)
+	case "DEL":
+		n := int64(0)
+		for _, key := range args {
+			if db.get(key) != nil {
+				n++
+			}
+			delete(db.data, key)
+			delete(db.expires, key)
+		}
+		return n
+	case "RENAME":
+		if db.get(args[0]) == nil {
+			return redis.Error("ERR no such key")
+		}
+		db.data[args[1]] = db.data[args[0]]
+		delete(db.data, args[0])
+		delete(db.expires, args[1])
+		return "OK"
+	case "EXPIRE":
+		if db.get(args[0]) == nil {
+			return int64(0)
+		}
+		seconds, _ := strconv.Atoi(args[1])
+		db.expires[args[0]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		return int64(1)
+	case "TTL":
+		if db.get(args[0]) == nil {
+			return int64(-2)
+		}
+		expires, ok := db.expires[args[0]]
+		if !ok {
+			return int64(-1)
+		}
+		return int64(time.Until(expires) / time.Second)
+	case "GET":
+		if s, ok := db.get(args[0]).(string); ok {
+			return []byte(s)
+		}
+		return nil
+	case "SET":
+		nx, ex := false, 0
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "EX":
+				i++
+				ex, _ = strconv.Atoi(args[i])
+			}
+		}
+		if nx && db.get(args[0]) != nil {
+			return nil
+		}
+		db.data[args[0]] = args[1]
+		delete(db.expires, args[0])
+		if ex > 0 {
+			db.expires[args[0]] = time.Now().Add(time.Duration(ex) * time.Second)
+		}
+		return "OK"
+	case "SETEX":
+		return db.command("SET", []string{args[0], args[2], "EX", args[1]})
+	case "INCR":
+		return db.command("INCRBY", []string{args[0], "1"})
+	case "INCRBY":
+		n, _ := strconv.ParseInt(fmt.Sprint(db.get(args[0])), 10, 64)
+		by, _ := strconv.ParseInt(args[1], 10, 64)
+		db.data[args[0]] = strconv.FormatInt(n+by, 10)
+		return n + by
+	case "LPUSH", "RPUSH":
+		list := db.list(args[0])
+		for _, item := range args[1:] {
+			if cmd == "LPUSH" {
+				list = append([]string{item}, list...)
+			} else {
+				list = append(list, item)
+			}
+		}
+		db.data[args[0]] = list
+		return int64(len(list))
+	case "LPOP", "RPOP":
+		list := db.list(args[0])
+		if len(list) == 0 {
+			return nil
+		}
+		var item string
+		if cmd == "LPOP" {
+			item, list = list[0], list[1:]
+		} else {
+			item, list = list[len(list)-1], list[:len(list)-1]
+		}
+		db.data[args[0]] = list
+		return []byte(item)
+	case "BLPOP", "BRPOP":
+		for _, key := range args[:len(args)-1] {
+			if item := db.command(cmd[1:], []string{key}); item != nil {
+				return []interface{}{[]byte(key), item}
+			}
+		}
+		return nil
+	case "RPOPLPUSH", "BRPOPLPUSH":
+		item := db.command("RPOP", []string{args[0]})
+		if item != nil {
+			db.command("LPUSH", []string{args[1], string(item.([]byte))})
+		}
+		return item
+	case "LLEN":
+		return int64(len(db.list(args[0])))
+	case "LRANGE":
+		list := db.list(args[0])
+		start, _ := strconv.Atoi(args[1])
+		end, _ := strconv.Atoi(args[2])
+		if start < 0 {
+			start += len(list)
+		}
+		if end < 0 {
+			end += len(list)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end >= len(list) {
+			end = len(list) - 1
+		}
+		if start > end {
+			return []interface{}{}
+		}
+		return memoryBulks(list[start : end+1])
+	case "LTRIM":
+		kept := db.command("LRANGE", args).([]interface{})
+		list := make([]string, len(kept))
+		for i, item := range kept {
+			list[i] = string(item.([]byte))
+		}
+		db.data[args[0]] = list
+		return "OK"
+	case "LREM":
+		list := db.list(args[0])
+		count, _ := strconv.Atoi(args[1])
+		limit := count
+		if count < 0 {
+			limit = -count
+		}
+		removed := map[int]bool{}
+		for i := range list {
+			if count < 0 {
+				// from the right side
+				i = len(list) - 1 - i
+			}
+			if list[i] == args[2] && (count == 0 || len(removed) < limit) {
+				removed[i] = true
+			}
+		}
+		kept := []string{}
+		for i, item := range list {
+			if !removed[i] {
+				kept = append(kept, item)
+			}
+		}
+		db.data[args[0]] = kept
+		return int64(len(removed))
+	case "SADD", "SREM":
+		set := db.set(args[0])
+		n := int64(0)
+		for _, member := range args[1:] {
+			if set[member] != (cmd == "SADD") {
+				n++
+			}
+			if cmd == "SADD" {
+				set[member] = true
+			} else {
+				delete(set, member)
+			}
+		}
+		return n
+	case "SISMEMBER":
+		if db.set(args[0])[args[1]] {
+			return int64(1)
+		}
+		return int64(0)
+	case "SCARD":
+		return int64(len(db.set(args[0])))
+	case "SMEMBERS":
+		members := []string{}
+		for member := range db.set(args[0]) {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return memoryBulks(members)
+	case "ZADD":
+		zset := db.zset(args[0])
+		gt, nx := false, false
+		i := 1
+		for ; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "GT":
+				gt = true
+				continue
+			case "NX":
+				nx = true
+				continue
+			}
+			break
+		}
+		n := int64(0)
+		for ; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return redis.Error("ERR value is not a valid float")
+			}
+			old, ok := zset[args[i+1]]
+			if !ok {
+				n++
+			}
+			if ok && (nx || gt && score <= old) {
+				continue
+			}
+			zset[args[i+1]] = score
+		}
+		return n
+	case "ZREM":
+		zset := db.zset(args[0])
+		n := int64(0)
+		for _, member := range args[1:] {
+			if _, ok := zset[member]; ok {
+				n++
+				delete(zset, member)
+			}
+		}
+		return n
+	case "ZSCORE":
+		if score, ok := db.zset(args[0])[args[1]]; ok {
+			return []byte(memoryScore(score))
+		}
+		return nil
+	case "ZCARD":
+		return int64(len(db.zset(args[0])))
+	case "ZRANGE":
+		members := memorySortedMembers(db.zset(args[0]))
+		start, _ := strconv.Atoi(args[1])
+		end, _ := strconv.Atoi(args[2])
+		if end < 0 {
+			end += len(members)
+		}
+		if end >= len(members) {
+			end = len(members) - 1
+		}
+		if start > end {
+			return []interface{}{}
+		}
+		if len(args) < 4 || strings.ToUpper(args[3]) != "WITHSCORES" {
+			return memoryBulks(members[start : end+1])
+		}
+		zset, replies := db.zset(args[0]), []interface{}{}
+		for _, member := range members[start : end+1] {
+			replies = append(replies, []byte(member), []byte(memoryScore(zset[member])))
+		}
+		return replies
+	case "ZRANGEBYSCORE", "ZREMRANGEBYSCORE", "ZCOUNT":
+		zset := db.zset(args[0])
+		matched := []interface{}{}
+		n := int64(0)
+		for _, member := range memorySortedMembers(zset) {
+			if !memoryInBounds(zset[member], args[1], args[2]) {
+				continue
+			}
+			n++
+			matched = append(matched, []byte(member))
+			if len(args) > 3 && strings.ToUpper(args[3]) == "WITHSCORES" {
+				matched = append(matched, []byte(memoryScore(zset[member])))
+			}
+			if cmd == "ZREMRANGEBYSCORE" {
+				delete(zset, member)
+			}
+		}
+		if cmd == "ZRANGEBYSCORE" {
+			return matched
+		}
+		return n
+	case "HSET":
+		hash := db.hash(args[0])
+		_, ok := hash[args[1]]
+		hash[args[1]] = args[2]
+		if ok {
+			return int64(0)
+		}
+		return int64(1)
+	case "HGET":
+		if value, ok := db.hash(args[0])[args[1]]; ok {
+			return []byte(value)
+		}
+		return nil
+	case "HMGET":
+		hash := db.hash(args[0])
+		values := []interface{}{}
+		for _, field := range args[1:] {
+			if value, ok := hash[field]; ok {
+				values = append(values, []byte(value))
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "HGETALL":
+		hash := db.hash(args[0])
+		fields := []string{}
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		values := []interface{}{}
+		for _, field := range fields {
+			values = append(values, []byte(field), []byte(hash[field]))
+		}
+		return values
+	case "HINCRBY":
+		hash := db.hash(args[0])
+		n, _ := strconv.ParseInt(hash[args[1]], 10, 64)
+		by, _ := strconv.ParseInt(args[2], 10, 64)
+		hash[args[1]] = strconv.FormatInt(n+by, 10)
+		return n + by
+	case "HDEL":
+		hash := db.hash(args[0])
+		n := int64(0)
+		for _, field := range args[1:] {
+			if _, ok := hash[field]; ok {
+				n++
+				delete(hash, field)
+			}
+		}
+		return n
+	}
+	return redis.Error("ERR unknown command " + cmd + " in memory")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRedis(t *testing.T) {
+	db := NewMemoryRedis()
+	redisConn := db.Conn()
+	defer redisConn.Close()
+
+	replies, err := redisConn.Transaction([]RedisCmd{
+		NewRedisCmd("ZADD", "WhiteList", 1, "10.0.0.1"),
+		NewRedisCmd("LPUSH", "WL_10.0.0.2", "a", "b"),
+		NewRedisCmd("SETEX", "CrawlerDNS_10.0.0.3", 1, "-"),
+	})
+	if err != nil || len(replies) != 3 || replies[1] != int64(2) {
+		t.Errorf("Transaction got %v %v", replies, err)
+	}
+	if _, err := redisConn.ListLeftPush("WhiteList", "x"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("LPUSH on a zset got %v", err)
+	}
+	if lines, err := redisConn.ListRange("WL_10.0.0.2", 0, -1); err != nil || strings.Join(lines, ",") != "b,a" {
+		t.Errorf("LRANGE got %v %v", lines, err)
+	}
+	db.expires["CrawlerDNS_10.0.0.3"] = time.Now().Add(-time.Second)
+	if cached, err := redisConn.Get("CrawlerDNS_10.0.0.3"); err != nil || cached != "" {
+		t.Errorf("an expired key got %q %v", cached, err)
+	}
+
+	// the changes of a replay are published on channels of its own
+	redisConn.channelPrefix = "replay_1_"
+	subscription, err := redisConn.Subscribe(blackListChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+	if err := AddBlackList(redisConn, "10.0.0.4", "test", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.published) != 1 || db.published[0].Channel != "replay_1_BlackListChanged" {
+		t.Errorf("published %+v", db.published)
+	}
+	select {
+	case message := <-subscription.Messages:
+		if message.Channel != blackListChannel || message.Data != "10.0.0.4" {
+			t.Errorf("received %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no message received")
+	}
+	if banned, err := IsBlackListed(redisConn, "10.0.0.4", time.Now()); err != nil || !banned {
+		t.Errorf("the IP banned in memory is not black listed")
+	}
+}
+
+// scriptCase runs a script after the setup commands
+type scriptCase struct {
+	name        string
+	setup       [][]interface{}
+	script      *RedisScript
+	keysAndArgs []interface{}
+}
+
+// runScriptCase return the reply of the script and the data it leaves
+func runScriptCase(t *testing.T, redisConn *RedisConn, c scriptCase) (interface{}, map[string]interface{}) {
+	if _, err := redisConn.do(false, "FLUSHDB"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range c.setup {
+		if _, err := redisConn.do(false, cmd[0].(string), cmd[1:]...); err != nil {
+			t.Fatalf("%s: %v %v", c.name, cmd, err)
+		}
+	}
+	reply, err := redisConn.EvalScript(c.script, c.keysAndArgs...)
+	if err != nil {
+		t.Fatalf("%s: %v", c.name, err)
+	}
+	return plainReply(reply), dumpRedis(t, redisConn)
+}
+
+// plainReply turns the bulk strings of a reply into strings
+func plainReply(reply interface{}) interface{} {
+	switch reply := reply.(type) {
+	case []byte:
+		return string(reply)
+	case []interface{}:
+		plain := make([]interface{}, len(reply))
+		for i, item := range reply {
+			plain[i] = plainReply(item)
+		}
+		return plain
+	}
+	return reply
+}
+
+// dumpRedis return the values of the keys, the members of a set sorted, and
+// whether they expire
+func dumpRedis(t *testing.T, redisConn *RedisConn) map[string]interface{} {
+	keys, err := stringSlice(redisConn.do(false, "KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{}
+	for _, key := range keys {
+		keyType, err := redis.String(redisConn.do(false, "TYPE", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value interface{}
+		switch keyType {
+		case "string":
+			value, err = redis.String(redisConn.do(false, "GET", key))
+		case "list":
+			value, err = stringSlice(redisConn.do(false, "LRANGE", key, 0, -1))
+		case "set":
+			var members []string
+			members, err = stringSlice(redisConn.do(false, "SMEMBERS", key))
+			sort.Strings(members)
+			value = members
+		case "zset":
+			value, err = stringSlice(redisConn.do(false, "ZRANGE", key, 0, -1, "WITHSCORES"))
+		case "hash":
+			value, err = redis.StringMap(redisConn.do(false, "HGETALL", key))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttl, err := redisInt64(redisConn.do(false, "TTL", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[key] = []interface{}{value, ttl > 0}
+	}
+	return data
+}
+
+// checkScripts runs the cases on a MemoryRedis, and checks the Go functions of
+// their scripts against the Lua on the redis at HOLMES_TEST_REDIS if it is
+// set. Its database 15 is flushed.
+func checkScripts(t *testing.T, cases []scriptCase) {
+	var redisConn *RedisConn
+	if address := os.Getenv("HOLMES_TEST_REDIS"); address != "" {
+		redisConn = NewRedisConn(RedisConf{Network: "tcp", Address: address, Database: 15})
+		defer redisConn.Close()
+	} else {
+		t.Log("HOLMES_TEST_REDIS is not set, the Lua of the scripts is not run")
+	}
+	for _, c := range cases {
+		reply, data := runScriptCase(t, NewMemoryRedis().Conn(), c)
+		if redisConn == nil {
+			continue
+		}
+		wantReply, wantData := runScriptCase(t, redisConn, c)
+		if !reflect.DeepEqual(reply, wantReply) {
+			t.Errorf("%s replied %#v in memory and %#v in redis", c.name, reply, wantReply)
+		}
+		if !reflect.DeepEqual(data, wantData) {
+			t.Errorf("%s left %v in memory and %v in redis", c.name, data, wantData)
+		}
+	}
+}
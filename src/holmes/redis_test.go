@@ -0,0 +1,80 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionClose(t *testing.T) {
+	db := NewMemoryRedis()
+	redisConn := db.Conn()
+	subscription, err := redisConn.Subscribe(blackListChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads Messages, the receiver blocks once it is full
+	for i := 0; i < 100; i++ {
+		db.Do("PUBLISH", blackListChannel, i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	running := runtime.NumGoroutine()
+	subscription.Close()
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() >= running; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the receiver of a closed subscription is left running")
+		}
+	}
+}
+
+func TestWatchTransaction(t *testing.T) {
+	db := NewMemoryRedis()
+	redisConn := db.Conn()
+	db.Do("SET", "n", 1)
+	builds := 0
+	replies, err := redisConn.WatchTransaction([]string{"n"}, func(tx *RedisTx) ([]RedisCmd, error) {
+		builds++
+		n, err := redisInt64(tx.Do("INCRBY", "n", 0))
+		if err != nil {
+			return nil, err
+		}
+		if builds == 1 {
+			// another client changes n before EXEC
+			db.Do("SET", "n", 10)
+			n = 1
+		}
+		return []RedisCmd{NewRedisCmd("SET", "n", n+1)}, nil
+	})
+	if err != nil || len(replies) != 1 || builds != 2 {
+		t.Errorf("got %v %v after %d builds", replies, err, builds)
+	}
+	if n, _ := strconv.Atoi(string(db.Do("GET", "n").([]byte))); n != 11 {
+		t.Errorf("n is %d", n)
+	}
+
+	// the commands are not run when the transaction is aborted
+	db.Do("SET", "n", 1)
+	_, err = redisConn.WatchTransaction([]string{"n"}, func(tx *RedisTx) ([]RedisCmd, error) {
+		db.Do("INCRBY", "n", 1)
+		return []RedisCmd{NewRedisCmd("SET", "m", 1)}, nil
+	})
+	if err != ErrTransactionAborted || db.Do("EXISTS", "m") != int64(0) {
+		t.Errorf("an aborted transaction got %v", err)
+	}
+}
+
+func TestPingInfo(t *testing.T) {
+	redisConn := NewMemoryRedis().Conn()
+	if err := redisConn.Ping(); err != nil {
+		t.Error(err)
+	}
+	info, err := redisConn.Info("server")
+	if err != nil || info["redis_version"] != "memory" {
+		t.Errorf("info is %v %v", info, err)
+	}
+	var nilConn *RedisConn
+	if nilConn.Ping() == nil {
+		t.Errorf("a nil RedisConn answers a ping")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ReplayResult is what a replay found per minute of log time
+type ReplayResult struct {
+	Records  int
+	Skipped  int                         // lines which can not be parsed or have no valid time
+	Verdicts map[string][3]int64         // YES, NO and UNKNOWN records by minute
+	Counters map[string]map[string]int64 // the counters of the rules by hash and field
+}
+
+// ReplayCommand is `holmes replay`, it runs log files through the filter rules
+// in log time order and prints the per minute results, so a rule change can be
+// evaluated before it is deployed. The lists are in a redis database of their
+// own with -db, whose changes are published on channels of their own, without
+// it they are kept in memory for the replay. The counters stay in memory. A
+// crawler is only verified from the cache of -db, or by DNS with -dns.
+func ReplayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	confFile := flags.String("conf", "holmes.conf", "holmes config file, its rules are replayed")
+	patternFile := flags.String("patterns", "../data/user_agent_pattern.json", "UA pattern file")
+	format := flags.String("format", "", "log format of the files, default is InLogFormat")
+	db := flags.Int("db", -1, "redis database of RedisConfs[1] for the lists of the replay, -1 keeps them in memory")
+	flush := flags.Bool("flush", false, "empty the -db database before the replay")
+	columns := flags.String("counters", "", "comma separated per minute counters to print, default is all")
+	dns := flags.Bool("dns", false, "verify the crawlers which are not in the cache by DNS, each record waits for the answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	runtime, err := LoadRuntime(*confFile, *patternFile)
+	if err != nil {
+		return err
+	}
+	holmesConfig := runtime.Config
+	if err := InitLogLocation(holmesConfig.LogTimeZone); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = holmesConfig.InLogFormat
+		if *format == "" {
+			*format = "nginx"
+		}
+	}
+	parser, err := NewLogParser(*format, holmesConfig)
+	if err != nil {
+		return err
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		if paths, err = logFiles(holmesConfig.InLogDir); err != nil {
+			return err
+		}
+	}
+	SetRuntime(runtime)
+	runtime.Crawlers.Lookup = CrawlerLookupNever
+	if *dns {
+		runtime.Crawlers.Lookup = CrawlerLookupAtOnce
+	}
+
+	conns := &FilterConns{Counters: NewMemoryCounterBatch(), Lists: NewMemoryRedis().Conn()}
+	defer conns.Lists.Close()
+	cidrLists.Set(map[string]*PrefixTrie{})
+	if *db >= 0 {
+		listConf := holmesConfig.RedisConfs[1]
+		if *db == listConf.Database {
+			return fmt.Errorf("-db %d is the database of the running filter, replay into another one", *db)
+		}
+		listConf.Database = *db
+		listConf.ChannelPrefix = fmt.Sprintf("replay_%d_", *db)
+		conns.Lists = NewRedisConn(listConf)
+		defer conns.Lists.Close()
+		if *flush {
+			if _, err := conns.Lists.Pipeline([]RedisCmd{NewRedisCmd("FLUSHDB")}); err != nil {
+				return err
+			}
+		}
+		tries, err := LoadCIDRLists(conns.Lists, time.Now())
+		if err != nil {
+			return err
+		}
+		cidrLists.Set(tries)
+	}
+	result, err := Replay(runtime, conns, parser, paths)
+	if err != nil {
+		return err
+	}
+	var selected []string
+	if *columns != "" {
+		selected = strings.Split(*columns, ",")
+	}
+	return PrintReplay(os.Stdout, result, selected)
+}
+
+// logFiles return the log files under dir as Stage reads them, with the
+// rotated .gz files
+func logFiles(dir string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode().IsRegular() && !strings.HasPrefix(fileInfo.Name(), ".") {
+			paths = append(paths, filepath.Join(dir, fileInfo.Name()))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no log file under %s", dir)
+	}
+	return paths, nil
+}
+
+// Replay runs the records of the files through DoFilter as FilterWorker does
+func Replay(runtime *Runtime, conns *FilterConns, parser LogParser, paths []string) (ReplayResult, error) {
+	result := ReplayResult{Verdicts: map[string][3]int64{}}
+	skipped, err := MergeLogFiles(paths, parser, func(accesslog *AccessLog) {
+		result.Records++
+		logTimeMin := accesslog.LogTimeMinString()
+		conns.Counters.HashIncrby("accesslog_result_total_request_per_min", logTimeMin, 1)
+		verdict := DoFilter(runtime, conns, accesslog)
+		if verdict.Result == YES {
+			conns.Counters.HashIncrby("accesslog_result_vppv_effective_per_min", logTimeMin, 1)
+		}
+		CountClass(conns.Counters, logTimeMin, verdict.Class)
+		verdicts := result.Verdicts[logTimeMin]
+		verdicts[verdict.Result]++
+		result.Verdicts[logTimeMin] = verdicts
+	})
+	result.Skipped = skipped
+	if err != nil {
+		return result, err
+	}
+	err = StoreSessions(conns.Lists, runtime.Config, sessions.Close(time.Time{}))
+	logRedisError("Replay", err)
+	result.Counters = conns.Counters.Counts()
+	return result, nil
+}
+
+type logSource struct {
+	path    string
+	file    io.ReadCloser
+	scanner *bufio.Scanner
+	head    AccessLog
+	time    time.Time
+	skipped int
+}
+
+// next reads the next record of the source, false at the end of the file
+func (source *logSource) next(parser LogParser) bool {
+	for source.scanner.Scan() {
+		accesslog, err := parser.Parse(source.scanner.Text())
+		if err != nil {
+			source.skipped++
+			continue
+		}
+		t, err := accesslog.LogTime()
+		if err != nil {
+			source.skipped++
+			continue
+		}
+		source.head, source.time = accesslog, t
+		return true
+	}
+	return false
+}
+
+// MergeLogFiles calls record for the records of the files in log time order,
+// each file is expected in order as a web server writes it. It return the
+// number of skipped lines.
+func MergeLogFiles(paths []string, parser LogParser, record func(accesslog *AccessLog)) (int, error) {
+	sources := []*logSource{}
+	skipped := 0
+	defer func() {
+		for _, source := range sources {
+			source.file.Close()
+		}
+	}()
+	for _, path := range paths {
+		file, err := OpenLogFile(path)
+		if err != nil {
+			return skipped, err
+		}
+		source := &logSource{path: path, file: file, scanner: newLogScanner(file)}
+		sources = append(sources, source)
+	}
+	active := []*logSource{}
+	for _, source := range sources {
+		if source.next(parser) {
+			active = append(active, source)
+		} else if err := source.scanner.Err(); err != nil {
+			return skipped, fmt.Errorf("%s: %s", source.path, err)
+		}
+	}
+	for len(active) > 0 {
+		first := 0
+		for i, source := range active {
+			if source.time.Before(active[first].time) {
+				first = i
+			}
+		}
+		source := active[first]
+		accesslog := source.head
+		record(&accesslog)
+		if !source.next(parser) {
+			if err := source.scanner.Err(); err != nil {
+				return skipped, fmt.Errorf("%s: %s", source.path, err)
+			}
+			active = append(active[:first], active[first+1:]...)
+		}
+	}
+	for _, source := range sources {
+		skipped += source.skipped
+	}
+	return skipped, nil
+}
+
+// PrintReplay writes a table of the verdicts and the per minute counters by
+// minute, and the other counters after it. counters are the per minute
+// counters to print, all of them when it is empty.
+func PrintReplay(w io.Writer, result ReplayResult, counters []string) error {
+	if len(counters) == 0 {
+		for ht := range result.Counters {
+			if strings.HasSuffix(ht, "_per_min") {
+				counters = append(counters, ht)
+			}
+		}
+		sort.Strings(counters)
+	}
+	minuteSet := map[string]bool{}
+	for minute := range result.Verdicts {
+		minuteSet[minute] = true
+	}
+	for _, ht := range counters {
+		for minute := range result.Counters[ht] {
+			minuteSet[minute] = true
+		}
+	}
+	minutes := make([]string, 0, len(minuteSet))
+	for minute := range minuteSet {
+		minutes = append(minutes, minute)
+	}
+	sort.Strings(minutes)
+
+	fmt.Fprintf(w, "%d records replayed, %d lines skipped\n", result.Records, result.Skipped)
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(table, "minute\tYES\tNO\tUNKNOWN\t")
+	for _, ht := range counters {
+		fmt.Fprintf(table, "%s\t", strings.TrimSuffix(strings.TrimPrefix(ht, "accesslog_result_"), "_per_min"))
+	}
+	fmt.Fprintln(table)
+	var total [3]int64
+	for _, minute := range minutes {
+		verdicts := result.Verdicts[minute]
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t", minute, verdicts[YES], verdicts[NO], verdicts[UNKNOWN])
+		for i := range total {
+			total[i] += verdicts[i]
+		}
+		for _, ht := range counters {
+			fmt.Fprintf(table, "%d\t", result.Counters[ht][minute])
+		}
+		fmt.Fprintln(table)
+	}
+	fmt.Fprintf(table, "total\t%d\t%d\t%d\t", total[YES], total[NO], total[UNKNOWN])
+	for _, ht := range counters {
+		var sum int64
+		for _, count := range result.Counters[ht] {
+			sum += count
+		}
+		fmt.Fprintf(table, "%d\t", sum)
+	}
+	fmt.Fprintln(table)
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	others := []string{}
+	for ht := range result.Counters {
+		if !strings.HasSuffix(ht, "_per_min") {
+			others = append(others, ht)
+		}
+	}
+	sort.Strings(others)
+	for _, ht := range others {
+		fmt.Fprintf(w, "\n%s\n", ht)
+		fields := make([]string, 0, len(result.Counters[ht]))
+		for field := range result.Counters[ht] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, field := range fields {
+			fmt.Fprintf(table, "  %s\t%d\n", field, result.Counters[ht][field])
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
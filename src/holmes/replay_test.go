@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	LogLocation = time.UTC
+	defer func() { LogLocation = time.Local }()
+	dir, err := ioutil.TempDir("", "holmes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	record := func(min string, sec string, ua string) string {
+		accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: min, Sec: sec,
+			RemoteAddr: "10.0.0.1", UserAgent: ua, GUID: "-", Method: "GET", HttpCode: "200",
+			Hostname: "www.anjuke.com", RequestURI: "/prop/view/1", Referer: "-"}
+		return accesslog.String()
+	}
+	// each file is in order, the files interleave
+	plain := []string{record("20", "00", "Chrome/28"), "broken line", record("21", "30", "Googlebot/2.1")}
+	rotated := []string{record("20", "10", "curl/7.29"), record("21", "00", "Chrome/28")}
+	if err := ioutil.WriteFile(filepath.Join(dir, "access.log"), []byte(strings.Join(plain, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var zipped bytes.Buffer
+	writer := gzip.NewWriter(&zipped)
+	writer.Write([]byte(strings.Join(rotated, "\n")))
+	writer.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "access.log.1.gz"), zipped.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := logFiles(dir)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("logFiles got %v %v", paths, err)
+	}
+
+	parser := LogParserFunc(GetLog)
+	times := []string{}
+	skipped, err := MergeLogFiles(paths, parser, func(accesslog *AccessLog) {
+		times = append(times, accesslog.LogTimeString())
+	})
+	want := []string{"2013-07-09 15:20:00", "2013-07-09 15:20:10", "2013-07-09 15:21:00", "2013-07-09 15:21:30"}
+	if err != nil || skipped != 1 || strings.Join(times, ",") != strings.Join(want, ",") {
+		t.Errorf("MergeLogFiles got %v %d %v", times, skipped, err)
+	}
+
+	runtime, err := NewRuntime(HolmesConfig{}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.Crawlers.Lookup = CrawlerLookupNever
+	lists := NewMemoryRedis()
+	result, err := Replay(runtime, &FilterConns{Counters: NewMemoryCounterBatch(), Lists: lists.Conn()}, parser, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watched := lists.Do("LLEN", "WL_10.0.0.1"); watched != int64(2) {
+		t.Errorf("the watching list in memory has %v records", watched)
+	}
+	// the Chrome records are watched, curl and Googlebot are robots,
+	// Googlebot is not verified without -dns
+	if result.Records != 4 || result.Verdicts["2013-07-09 15:20"] != [3]int64{0, 1, 1} || result.Verdicts["2013-07-09 15:21"] != [3]int64{0, 1, 1} {
+		t.Errorf("Replay got %+v", result)
+	}
+	if result.Counters["accesslog_result_total_request_per_min"]["2013-07-09 15:21"] != 2 || result.Counters["accesslog_result_ua_statistic"]["chrome"] != 2 {
+		t.Errorf("counters are %v", result.Counters)
+	}
+
+	// with -dns the Googlebot of a Google IP is a good robot
+	dns := stubDNS(t, map[string][]string{
+		"1.0.0.10.in-addr.arpa":        {"crawl-10-0-0-1.googlebot.com"},
+		"crawl-10-0-0-1.googlebot.com": {"10.0.0.1"},
+	})
+	defer dns.Close()
+	verified, err := NewRuntime(HolmesConfig{CrawlerResolver: dns.LocalAddr().String()}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified.Crawlers.Lookup = CrawlerLookupAtOnce
+	dnsResult, err := Replay(verified, &FilterConns{Counters: NewMemoryCounterBatch()}, parser, paths)
+	if err != nil || dnsResult.Verdicts["2013-07-09 15:21"] != [3]int64{0, 0, 2} || dnsResult.Counters["accesslog_result_good_robot_per_min"]["2013-07-09 15:21"] != 1 {
+		t.Errorf("Replay with DNS got %+v %v", dnsResult, err)
+	}
+
+	var output bytes.Buffer
+	if err := PrintReplay(&output, result, []string{"accesslog_result_ua_not_pass_per_min"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(output.String(), "\n")
+	if len(lines) < 6 || !strings.Contains(lines[1], "ua_not_pass") || strings.Join(strings.Fields(lines[4]), " ") != "total 0 2 2 2" {
+		t.Errorf("table is\n%s", output.String())
+	}
+}
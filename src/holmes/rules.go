@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RuleConf declares one stage of a rule pipeline in holmes.conf. A rule looks
+// at one field of the AccessLog, and its OnMatch or OnMiss outcome says what
+// to count, what to do and where to go next. The set and zset ops also match
+// an IP in a CIDR of the WhiteList, BlackList or IgnoreList.
+type RuleConf struct {
+	Name     string
+	Field    string   // name of an AccessLog field, such as UserAgent
+	Op       string   // regexp, contains, in, eq, ne, lt, le, gt, ge, set, zset, ua_family, rate, classifier, crawler or any
+	Value    string   // the regexp, substring, number, redis set or sorted set, rate windows, score bound or crawler check of Op
+	Values   []string // the members of Op in, or the fields added to the key of Op rate
+	Negate   bool     // swap match and miss
+	Counters []string // per minute counters increased whatever the rule decides
+	OnMatch  RuleOutcome
+	OnMiss   RuleOutcome
+}
+
+// RuleOutcome is what a rule does after it matched or missed
+type RuleOutcome struct {
+	Result   string   // YES, NO, UNKNOWN, continue (the default) or the name of a later rule
+	Counters []string // per minute counters, {Field} is replaced by the value of the field
+	Actions  []string // names of RuleActions
+	// the TrafficClass of a YES, NO or UNKNOWN Result, by default human, bad_robot
+	// or unclassified, and how sure the rule is of it, by default 1 or the
+	// probability of the classifier op
+	Class      string  `json:",omitempty"`
+	Confidence float64 `json:",omitempty"`
+}
+
+// RuleContext is the state of one record going through a pipeline
+type RuleContext struct {
+	runtime   *Runtime
+	conns     *FilterConns
+	accesslog *AccessLog
+	uaFamily  string // set by the ua_family op
+	session   *SessionFeatures
+	scored    bool    // whether probability is computed
+	human     float64 // set by the classifier op
+	// set by the crawler op: verified, fake or ""
+	crawlerChecked bool
+	crawler        string
+	watched        bool // set by the watch action
+}
+
+// RuleAction is a side effect a rule can trigger by name
+type RuleAction func(ctx *RuleContext)
+
+var ruleActions = map[string]RuleAction{
+	"ua_statistic": func(ctx *RuleContext) {
+		if ctx.uaFamily == "" {
+			ctx.uaFamily = ctx.runtime.UAParsers.Parse(ctx.accesslog.UserAgent)
+		}
+		ctx.conns.Counters.HashIncrby(uaStatisticCounter, strings.ToLower(ctx.uaFamily), 1)
+	},
+	"referer": func(ctx *RuleContext) {
+		AddRefererList(ctx.conns.Lists, ctx.accesslog)
+	},
+	"touch_white": func(ctx *RuleContext) {
+		AddWhiteList(ctx.conns.Lists, ctx.accesslog)
+	},
+	"watch": func(ctx *RuleContext) {
+		if size := AddWatchingList(ctx.conns, ctx.accesslog); size > 0 {
+			ctx.watched = true
+			ctx.runtime.BanRules.CheckWatchingSize(ctx.conns, ctx.accesslog.RemoteAddr, size)
+		}
+	},
+	"resolve_watching": func(ctx *RuleContext) {
+		ProcessWatchingList(ctx.runtime, ctx.conns, ctx.accesslog)
+	},
+}
+
+// DefaultFilterRules is the decision chain of DoFilter when holmes.conf has no
+// FilterRules: ignored IP -> UA -> request rate -> URI -> HTTP code -> white
+// IP -> session classifier, and the records of the trusted host resolve the
+// watching list of their IP
+var DefaultFilterRules = []RuleConf{
+	{Name: "ignore_ip", Field: "RemoteAddr", Op: "set", Value: "IgnoreList",
+		OnMatch: RuleOutcome{Result: "UNKNOWN", Counters: []string{"accesslog_result_ignore_per_min"}}},
+	{Name: "good_robot", Field: "UserAgent", Op: "crawler", Value: "verified",
+		OnMatch: RuleOutcome{Result: "UNKNOWN", Counters: []string{"accesslog_result_good_robot_per_min"}, Class: "good_robot"}},
+	{Name: "fake_robot", Field: "UserAgent", Op: "crawler", Value: "fake",
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_fake_robot_per_min"}}},
+	{Name: "ua_keyword", Field: "UserAgent", Op: "regexp", Value: `(?i)bot|spider|^-$`,
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_ua_not_pass_per_min"}}},
+	{Name: "ua_family", Field: "UserAgent", Op: "ua_family",
+		OnMatch: RuleOutcome{Counters: []string{"accesslog_result_ua_pass_per_min"}, Actions: []string{"ua_statistic", "referer"}},
+		OnMiss:  RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_ua_not_pass_per_min"}}},
+	{Name: "ip_rate", Field: "RemoteAddr", Op: "rate", Value: "10:50,60:200,3600:3000",
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_rate_not_pass_per_min"}}},
+	{Name: "ip_ua_rate", Field: "RemoteAddr", Op: "rate", Values: []string{"UserAgent"}, Value: "60:120",
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_rate_not_pass_per_min"}}},
+	{Name: "vppv", Field: "RequestURI", Op: "regexp", Value: `^/prop/view/`,
+		OnMatch: RuleOutcome{Counters: []string{"accesslog_result_vppv_total_per_min"}},
+		OnMiss:  RuleOutcome{Result: "trusted_host"}},
+	{Name: "http_code", Field: "HttpCode", Op: "regexp", Value: `^2\d\d$`,
+		Counters: []string{"accesslog_result_vppv_code_{HttpCode}_per_min"},
+		OnMiss:   RuleOutcome{Result: "UNKNOWN"}},
+	{Name: "white_ip", Field: "RemoteAddr", Op: "zset", Value: "WhiteList",
+		OnMatch: RuleOutcome{Result: "YES", Actions: []string{"touch_white"}}},
+	{Name: "classify_human", Field: "RemoteAddr", Op: "classifier", Value: ">=0.9",
+		OnMatch: RuleOutcome{Result: "YES", Counters: []string{"accesslog_result_classifier_human_per_min"}}},
+	{Name: "classify_robot", Field: "RemoteAddr", Op: "classifier", Value: "<=0.1",
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_classifier_robot_per_min"}}},
+	{Name: "watch", Field: "RemoteAddr", Op: "any",
+		OnMatch: RuleOutcome{Result: "UNKNOWN", Actions: []string{"watch"}}},
+	{Name: "trusted_host", Field: "Hostname", Op: "regexp", Value: `^s\.anjuke\.com`,
+		OnMatch: RuleOutcome{Result: "UNKNOWN", Actions: []string{"resolve_watching"}},
+		OnMiss:  RuleOutcome{Result: "UNKNOWN"}},
+}
+
+// DefaultWatchingRules decide each record of a watching list once the IP is
+// resolved, a YES record is effective and makes the IP trusted
+var DefaultWatchingRules = []RuleConf{
+	{Name: "from_my", Field: "Referer", Op: "contains", Value: "my.anjuke.com",
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_vppv_from_my_per_min"}}},
+	{Name: "no_referer", Field: "Referer", Op: "in", Values: []string{"-"},
+		OnMatch: RuleOutcome{Result: "NO", Counters: []string{"accesslog_result_vppv_no_referer_per_min"}},
+		OnMiss:  RuleOutcome{Result: "YES"}},
+}
+
+const ruleContinue = -1
+
+type ruleOutcome struct {
+	result     int // YES, NO, UNKNOWN or ruleContinue
+	next       int // index of the next rule when result is ruleContinue
+	counters   []string
+	actions    []RuleAction
+	class      TrafficClass
+	confidence float64 // 0 is the default
+}
+
+// Rule is a compiled RuleConf
+type Rule struct {
+	name     string
+	op       string
+	field    int // index of the field in AccessLog
+	match    func(ctx *RuleContext, value string) bool
+	negate   bool
+	counters []string
+	onMatch  ruleOutcome
+	onMiss   ruleOutcome
+}
+
+// RulePipeline is an ordered list of rules, a rule can only jump forward so a
+// record always leaves the pipeline
+type RulePipeline []*Rule
+
+var counterFieldRegexp = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// NewRulePipeline compiles the rule confs, a bad regexp, an unknown field,
+// op, action or rule name is an error
+func NewRulePipeline(confs []RuleConf) (RulePipeline, error) {
+	index := map[string]int{}
+	for i, conf := range confs {
+		if conf.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if _, ok := index[conf.Name]; ok {
+			return nil, fmt.Errorf("rule %s is declared twice", conf.Name)
+		}
+		index[conf.Name] = i
+	}
+	pipeline := make(RulePipeline, 0, len(confs))
+	for i, conf := range confs {
+		rule, err := compileRule(conf, i, index)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", conf.Name, err)
+		}
+		pipeline = append(pipeline, rule)
+	}
+	return pipeline, nil
+}
+
+func compileRule(conf RuleConf, i int, index map[string]int) (*Rule, error) {
+	rule := &Rule{name: conf.Name, op: conf.Op, negate: conf.Negate}
+	var err error
+	if rule.field, err = accessLogField(conf.Field); err != nil {
+		return nil, err
+	}
+	if rule.match, err = compileMatch(conf); err != nil {
+		return nil, err
+	}
+	if err = checkCounters(conf.Counters); err != nil {
+		return nil, err
+	}
+	rule.counters = conf.Counters
+	if rule.onMatch, err = compileOutcome(conf.OnMatch, i, index); err != nil {
+		return nil, err
+	}
+	if rule.onMiss, err = compileOutcome(conf.OnMiss, i, index); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func accessLogField(name string) (int, error) {
+	field, ok := reflect.TypeOf(AccessLog{}).FieldByName(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown field %q", name)
+	}
+	return field.Index[0], nil
+}
+
+// sortedSetLists are the lists of holmes which are sorted sets, the rules of an
+// older holmes.conf may still match them with the set op
+var sortedSetLists = append([]string{blackListKey}, lastSeenKeys...)
+
+func compileMatch(conf RuleConf) (func(ctx *RuleContext, value string) bool, error) {
+	if conf.Op == "set" {
+		for _, list := range sortedSetLists {
+			if conf.Value == list {
+				log.Println("(rules) rule ", conf.Name, ": ", list, " is a sorted set, it is matched by the zset op")
+				conf.Op = "zset"
+			}
+		}
+	}
+	switch conf.Op {
+	case "regexp":
+		myRegexp, err := regexp.Compile(conf.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *RuleContext, value string) bool {
+			return myRegexp.MatchString(value)
+		}, nil
+	case "contains":
+		return func(ctx *RuleContext, value string) bool {
+			return strings.Contains(value, conf.Value)
+		}, nil
+	case "in":
+		members := map[string]bool{}
+		for _, member := range conf.Values {
+			members[member] = true
+		}
+		return func(ctx *RuleContext, value string) bool {
+			return members[value]
+		}, nil
+	case "eq", "ne", "lt", "le", "gt", "ge":
+		number, err := strconv.ParseFloat(conf.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, got %q", conf.Op, conf.Value)
+		}
+		op := conf.Op
+		return func(ctx *RuleContext, value string) bool {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false
+			}
+			switch op {
+			case "eq":
+				return n == number
+			case "ne":
+				return n != number
+			case "lt":
+				return n < number
+			case "le":
+				return n <= number
+			case "gt":
+				return n > number
+			}
+			return n >= number
+		}, nil
+	case "set":
+		if conf.Value == "" {
+			return nil, fmt.Errorf("set needs the name of a redis set")
+		}
+		return func(ctx *RuleContext, value string) bool {
+			isMember, err := ctx.conns.Lists.SetIsMember(conf.Value, value)
+			logRedisError("rule "+conf.Name, err)
+			return isMember == 1 || cidrLists.Contains(conf.Value, value)
+		}, nil
+	case "zset":
+		if conf.Value == "" {
+			return nil, fmt.Errorf("zset needs the name of a redis sorted set")
+		}
+		return func(ctx *RuleContext, value string) bool {
+			_, isMember, err := ctx.conns.Lists.SortedSetScore(conf.Value, value)
+			logRedisError("rule "+conf.Name, err)
+			return isMember || cidrLists.Contains(conf.Value, value)
+		}, nil
+	case "ua_family":
+		return func(ctx *RuleContext, value string) bool {
+			ctx.uaFamily = ctx.runtime.UAParsers.Parse(value)
+			return ctx.uaFamily != ""
+		}, nil
+	case "rate":
+		return compileRate(conf)
+	case "classifier":
+		return compileClassifier(conf)
+	case "crawler":
+		return compileCrawler(conf)
+	case "any":
+		return func(ctx *RuleContext, value string) bool {
+			return true
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", conf.Op)
+}
+
+func checkCounters(counters []string) error {
+	for _, counter := range counters {
+		for _, match := range counterFieldRegexp.FindAllStringSubmatch(counter, -1) {
+			if _, err := accessLogField(match[1]); err != nil {
+				return fmt.Errorf("counter %s: %s", counter, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compileOutcome(conf RuleOutcome, i int, index map[string]int) (ruleOutcome, error) {
+	outcome := ruleOutcome{result: ruleContinue, next: i + 1, counters: conf.Counters}
+	switch conf.Result {
+	case "YES":
+		outcome.result = YES
+	case "NO":
+		outcome.result = NO
+	case "UNKNOWN":
+		outcome.result = UNKNOWN
+	case "", "continue":
+	default:
+		next, ok := index[conf.Result]
+		if !ok {
+			return outcome, fmt.Errorf("unknown result %q", conf.Result)
+		}
+		if next <= i {
+			return outcome, fmt.Errorf("can not jump back to %s", conf.Result)
+		}
+		outcome.next = next
+	}
+	if conf.Class != "" || conf.Confidence != 0 {
+		if outcome.result == ruleContinue {
+			return outcome, fmt.Errorf("Class and Confidence need a YES, NO or UNKNOWN result")
+		}
+		if conf.Confidence < 0 || conf.Confidence > 1 {
+			return outcome, fmt.Errorf("Confidence must be within [0, 1], got %v", conf.Confidence)
+		}
+	}
+	outcome.class, outcome.confidence = resultClass(outcome.result), conf.Confidence
+	if conf.Class != "" {
+		class, err := ParseTrafficClass(conf.Class)
+		if err != nil {
+			return outcome, err
+		}
+		outcome.class = class
+	}
+	if err := checkCounters(conf.Counters); err != nil {
+		return outcome, err
+	}
+	for _, name := range conf.Actions {
+		action, ok := ruleActions[name]
+		if !ok {
+			return outcome, fmt.Errorf("unknown action %q", name)
+		}
+		outcome.actions = append(outcome.actions, action)
+	}
+	return outcome, nil
+}
+
+// Run pass a record through the pipeline and return its verdict, a record
+// which runs off the end of the pipeline is UNKNOWN and unclassified
+func (pipeline RulePipeline) Run(runtime *Runtime, conns *FilterConns, accesslog *AccessLog) Verdict {
+	return pipeline.Decide(runtime, conns, accesslog, nil)
+}
+
+// Decide is Run with the session of the record so far for the classifier
+// rules, they miss when it is nil. The Reason of the verdict is the name of
+// the deciding rule.
+func (pipeline RulePipeline) Decide(runtime *Runtime, conns *FilterConns, accesslog *AccessLog, session *SessionFeatures) Verdict {
+	ctx := &RuleContext{runtime: runtime, conns: conns, accesslog: accesslog, session: session}
+	fields := reflect.ValueOf(accesslog).Elem()
+	logTimeMin := accesslog.LogTimeMinString()
+	for i := 0; i < len(pipeline); {
+		rule := pipeline[i]
+		outcome := rule.onMiss
+		if rule.match(ctx, fields.Field(rule.field).String()) != rule.negate {
+			outcome = rule.onMatch
+		}
+		incrCounters(conns.Counters, fields, rule.counters, logTimeMin)
+		incrCounters(conns.Counters, fields, outcome.counters, logTimeMin)
+		for _, action := range outcome.actions {
+			action(ctx)
+		}
+		if outcome.result != ruleContinue {
+			return ctx.verdict(rule, outcome)
+		}
+		i = outcome.next
+	}
+	return Verdict{Result: UNKNOWN, Watched: ctx.watched}
+}
+
+func (ctx *RuleContext) verdict(rule *Rule, outcome ruleOutcome) Verdict {
+	verdict := Verdict{Result: outcome.result, Class: outcome.class, Reason: rule.name, Confidence: outcome.confidence, Watched: ctx.watched}
+	switch {
+	case verdict.Confidence > 0 || verdict.Class == Unclassified:
+	case rule.op == "classifier" && ctx.scored && verdict.Class == Human:
+		verdict.Confidence = ctx.human
+	case rule.op == "classifier" && ctx.scored:
+		verdict.Confidence = 1 - ctx.human
+	default:
+		verdict.Confidence = 1
+	}
+	return verdict
+}
+
+func incrCounters(batch *CounterBatch, fields reflect.Value, counters []string, logTimeMin string) {
+	for _, counter := range counters {
+		if strings.Contains(counter, "{") {
+			counter = counterFieldRegexp.ReplaceAllStringFunc(counter, func(name string) string {
+				return fields.FieldByName(name[1 : len(name)-1]).String()
+			})
+		}
+		batch.HashIncrby(counter, logTimeMin, 1)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDefaultFilterRules(t *testing.T) {
+	runtime, err := NewRuntime(HolmesConfig{}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		userAgent  string
+		requestURI string
+		httpCode   string
+		result     int
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1)", "/prop/view/1", "200", NO},
+		{"-", "/prop/view/1", "200", NO},
+		{"curl/7.29.0", "/prop/view/1", "200", NO},
+		{"Mozilla/5.0 Chrome/28.0", "/sale/", "200", UNKNOWN},
+		{"Mozilla/5.0 Chrome/28.0", "/prop/view/1", "404", UNKNOWN},
+		{"Mozilla/5.0 Chrome/28.0", "/prop/view/1", "200", UNKNOWN}, // not in WhiteList
+	}
+	for _, c := range cases {
+		accesslog := AccessLog{UserAgent: c.userAgent, RequestURI: c.requestURI, HttpCode: c.httpCode, Hostname: "www.anjuke.com"}
+		if verdict := DoFilter(runtime, &FilterConns{}, &accesslog); verdict.Result != c.result {
+			t.Errorf("%+v got %s", c, verdict)
+		}
+	}
+}
+
+func TestRulePipeline(t *testing.T) {
+	pipeline, err := NewRulePipeline([]RuleConf{
+		{Name: "slow", Field: "RequestTime", Op: "gt", Value: "1.5", OnMatch: RuleOutcome{Result: "post"}},
+		{Name: "head", Field: "Method", Op: "in", Values: []string{"HEAD", "OPTIONS"}, OnMatch: RuleOutcome{Result: "NO"}},
+		{Name: "post", Field: "Method", Op: "regexp", Value: "^POST$", Negate: true, OnMatch: RuleOutcome{Result: "YES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method      string
+		requestTime string
+		result      int
+	}{
+		{"HEAD", "0.1", NO},
+		{"HEAD", "2.0", YES}, // jumps over head
+		{"GET", "-", YES},
+		{"POST", "0.1", UNKNOWN},
+	}
+	for _, c := range cases {
+		accesslog := AccessLog{Method: c.method, RequestTime: c.requestTime}
+		if verdict := pipeline.Run(&Runtime{}, &FilterConns{}, &accesslog); verdict.Result != c.result {
+			t.Errorf("%+v got %s", c, verdict)
+		}
+	}
+
+	// the set op of an older holmes.conf on the WhiteList, now a sorted set
+	pipeline, err = NewRulePipeline([]RuleConf{
+		{Name: "white_ip", Field: "RemoteAddr", Op: "set", Value: "WhiteList", OnMatch: RuleOutcome{Result: "YES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryRedis()
+	db.Do("ZADD", "WhiteList", 1, "10.0.0.1")
+	accesslog := AccessLog{RemoteAddr: "10.0.0.1"}
+	if verdict := pipeline.Run(&Runtime{}, &FilterConns{Lists: db.Conn()}, &accesslog); verdict.Result != YES {
+		t.Errorf("a white IP matched by the set op got %s", verdict)
+	}
+
+	bad := [][]RuleConf{
+		{{Name: "a", Field: "NoSuchField", Op: "any"}},
+		{{Name: "a", Field: "Method", Op: "no_such_op"}},
+		{{Name: "a", Field: "Method", Op: "regexp", Value: "("}},
+		{{Name: "a", Field: "Method", Op: "any"}, {Name: "b", Field: "Method", Op: "any", OnMatch: RuleOutcome{Result: "a"}}},
+		{{Name: "a", Field: "Method", Op: "any", OnMatch: RuleOutcome{Actions: []string{"no_such_action"}}}},
+		{{Name: "a", Field: "Method", Op: "any", OnMatch: RuleOutcome{Class: "human"}}},
+		{{Name: "a", Field: "Method", Op: "any", OnMatch: RuleOutcome{Result: "NO", Class: "crawler"}}},
+		{{Name: "a", Field: "Method", Op: "any", OnMatch: RuleOutcome{Result: "NO", Confidence: 1.5}}},
+	}
+	for _, confs := range bad {
+		if _, err := NewRulePipeline(confs); err == nil {
+			t.Errorf("%+v should not compile", confs)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	runtime, err := NewRuntime(HolmesConfig{}, []UAParserPattern{{RegexpString: `(Chrome)/`, FamilyReplacement: "None"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accesslog := AccessLog{UserAgent: "curl/7.29.0", RequestURI: "/prop/view/1"}
+	if verdict := runtime.FilterRules.Decide(runtime, &FilterConns{}, &accesslog, nil); verdict.Result != NO || verdict.Reason != "ua_family" {
+		t.Errorf("got %s", verdict)
+	}
+
+	// a watched record waits for its watching list to be resolved
+	conns := &FilterConns{Lists: NewMemoryRedis().Conn(), Counters: NewMemoryCounterBatch()}
+	accesslog = AccessLog{RemoteAddr: "10.0.0.1", UserAgent: "Chrome/28", HttpCode: "200", Hostname: "www.anjuke.com", RequestURI: "/prop/view/1"}
+	if verdict := runtime.FilterRules.Decide(runtime, conns, &accesslog, nil); verdict.Result != UNKNOWN || !verdict.Watched {
+		t.Errorf("got %s, watched %v", verdict, verdict.Watched)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Runtime is what the filter builds from holmes.conf and the UA pattern file.
+// A reload builds and validates a new Runtime and swaps it in as a whole, the
+// filter picks it up at the next record.
+type Runtime struct {
+	Config        HolmesConfig
+	UAParsers     UAParserList
+	QueueParser   LogParser
+	FilterRules   RulePipeline
+	WatchingRules RulePipeline
+	BanRules      BanRules
+	Classifier    Classifier // nil without a ClassifierModel
+	Crawlers      *CrawlerVerifier
+	rateTrackers  []string // the trackers of the rate rules
+}
+
+// the settings which are only read when holmes starts
+var restartConfigFields = []string{"InLogDir", "OutLogDir", "StageOffsetFile", "ExportMaxBytes", "ExportInterval", "InLogFormat", "LogTimeZone", "FilterWorkers", "CounterFlushInterval", "SweepInterval", "HTTPListen", "AdminToken"}
+
+var currentRuntime atomic.Value
+
+// CurrentRuntime return the runtime in use
+func CurrentRuntime() *Runtime {
+	return currentRuntime.Load().(*Runtime)
+}
+
+// SetRuntime swaps runtime in, the rate trackers it does not use are dropped
+func SetRuntime(runtime *Runtime) {
+	currentRuntime.Store(runtime)
+	keepRateTrackers(runtime.rateTrackers)
+}
+
+// LoadRuntime reads and compiles the config and the UA patterns, any error
+// means the files must not be used
+func LoadRuntime(configPath string, patternPath string) (*Runtime, error) {
+	holmesConfig, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := ReadPattern(patternPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewRuntime(holmesConfig, patterns)
+}
+
+func NewRuntime(holmesConfig HolmesConfig, patterns []UAParserPattern) (*Runtime, error) {
+	runtime := &Runtime{Config: holmesConfig}
+	var err error
+	if runtime.UAParsers, err = NewUAParsers(patterns); err != nil {
+		return nil, err
+	}
+	format := holmesConfig.QueueLogFormat
+	if format == "" {
+		format = "tsv"
+	}
+	if runtime.QueueParser, err = NewLogParser(format, holmesConfig); err != nil {
+		return nil, fmt.Errorf("QueueLogFormat: %s", err)
+	}
+	filterConfs := holmesConfig.FilterRules
+	if len(filterConfs) == 0 {
+		filterConfs = DefaultFilterRules
+	}
+	if runtime.FilterRules, err = NewRulePipeline(filterConfs); err != nil {
+		return nil, fmt.Errorf("FilterRules: %s", err)
+	}
+	watchingConfs := holmesConfig.WatchingRules
+	if len(watchingConfs) == 0 {
+		watchingConfs = DefaultWatchingRules
+	}
+	if runtime.WatchingRules, err = NewRulePipeline(watchingConfs); err != nil {
+		return nil, fmt.Errorf("WatchingRules: %s", err)
+	}
+	runtime.rateTrackers = rateTrackerIDs(filterConfs, watchingConfs)
+	switch holmesConfig.ExpiredWatching {
+	case "", "UNKNOWN", "NO":
+	default:
+		return nil, fmt.Errorf("ExpiredWatching must be UNKNOWN or NO, got %q", holmesConfig.ExpiredWatching)
+	}
+	if runtime.BanRules, err = NewBanRules(holmesConfig.BanRules, runtime.FilterRules); err != nil {
+		return nil, fmt.Errorf("BanRules: %s", err)
+	}
+	if holmesConfig.ClassifierModel != "" {
+		if runtime.Classifier, _, err = LoadClassifier(holmesConfig.ClassifierModel); err != nil {
+			return nil, fmt.Errorf("ClassifierModel: %s", err)
+		}
+	}
+	crawlers := holmesConfig.Crawlers
+	if len(crawlers) == 0 {
+		crawlers = DefaultCrawlers
+	}
+	if runtime.Crawlers, err = NewCrawlerVerifier(crawlers, holmesConfig.CrawlerResolver, holmesConfig.CrawlerCacheTTL); err != nil {
+		return nil, fmt.Errorf("Crawlers: %s", err)
+	}
+	return runtime, nil
+}
+
+// WatchRuntime reloads the runtime when holmes.conf or the UA pattern file is
+// modified, or when holmes receives SIGHUP. It never return.
+func WatchRuntime(configPath string, patternPath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	modTimes := fileModTimes(configPath, patternPath)
+	for {
+		select {
+		case <-hup:
+			log.Println("(WatchRuntime) got SIGHUP")
+		case <-ticker.C:
+			newModTimes := fileModTimes(configPath, patternPath)
+			if reflect.DeepEqual(newModTimes, modTimes) {
+				continue
+			}
+			modTimes = newModTimes
+		}
+		if err := ReloadRuntime(configPath, patternPath); err != nil {
+			log.Println("(WatchRuntime) reload is rejected, keep the running config: ", err)
+		}
+	}
+}
+
+func fileModTimes(paths ...string) []time.Time {
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		if fileInfo, err := os.Stat(path); err == nil {
+			modTimes[i] = fileInfo.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// ReloadRuntime loads the files and swaps the new runtime in if it is valid
+// and its redis servers are reachable
+func ReloadRuntime(configPath string, patternPath string) error {
+	runtime, err := LoadRuntime(configPath, patternPath)
+	if err != nil {
+		return err
+	}
+	old := CurrentRuntime()
+	for i, redisConf := range runtime.Config.RedisConfs {
+		if i < len(old.Config.RedisConfs) && redisConf == old.Config.RedisConfs[i] {
+			continue
+		}
+		c, err := redis.DialTimeout(redisConf.Network, redisConf.Address, time.Duration(redisConf.ConnectTimeout), time.Duration(redisConf.ReadTimeout), time.Duration(redisConf.WriteTimeout))
+		if err != nil {
+			return fmt.Errorf("RedisConfs[%d]: %s", i, err)
+		}
+		c.Close()
+	}
+	changed := changedConfigFields(old.Config, runtime.Config)
+	if !reflect.DeepEqual(old.UAParsers.Patterns(), runtime.UAParsers.Patterns()) {
+		changed = append(changed, fmt.Sprintf("UA patterns (%d -> %d)", len(old.UAParsers), len(runtime.UAParsers)))
+	}
+	SetRuntime(runtime)
+	old.Crawlers.Close()
+	if len(changed) == 0 {
+		log.Println("(ReloadRuntime) reloaded, nothing changed")
+	} else {
+		log.Println("(ReloadRuntime) reloaded, changed: ", changed)
+	}
+	for _, name := range restartConfigFields {
+		for _, field := range changed {
+			if field == name {
+				log.Println("(ReloadRuntime) ", name, " only takes effect after holmes is restarted")
+			}
+		}
+	}
+	return nil
+}
+
+func changedConfigFields(old HolmesConfig, new HolmesConfig) []string {
+	changed := []string{}
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, oldValue.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
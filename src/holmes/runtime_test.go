@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes_runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "holmes.conf")
+	patternPath := filepath.Join(dir, "user_agent_pattern.json")
+	redisConfs := `"RedisConfs":[{"Address":"127.0.0.1:6379"},{"Address":"127.0.0.1:6479"},{"Address":"127.0.0.1:6579"}]`
+	write := func(path string, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(configPath, `{`+redisConfs+`}`)
+	write(patternPath, `[{"RegexpString":"(Chrome)/","FamilyReplacement":"None"}]`)
+	runtime, err := LoadRuntime(configPath, patternPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRuntime(runtime)
+
+	write(configPath, `{`+redisConfs+`,"FilterRules":[{"Name":"a","Field":"NoSuchField","Op":"any"}]}`)
+	if err := ReloadRuntime(configPath, patternPath); err == nil {
+		t.Errorf("a bad rule should reject the reload")
+	}
+	write(patternPath, `[{"RegexpString":"(Chrome/","FamilyReplacement":"None"}]`)
+	write(configPath, `{`+redisConfs+`}`)
+	if err := ReloadRuntime(configPath, patternPath); err == nil {
+		t.Errorf("a bad UA pattern should reject the reload")
+	}
+	if CurrentRuntime() != runtime {
+		t.Errorf("a rejected reload must keep the running runtime")
+	}
+
+	write(patternPath, `[{"RegexpString":"(Firefox)/","FamilyReplacement":"None"}]`)
+	if err := ReloadRuntime(configPath, patternPath); err != nil {
+		t.Fatal(err)
+	}
+	if family := CurrentRuntime().UAParsers.Parse("Mozilla/5.0 Firefox/22.0"); family != "Firefox" {
+		t.Errorf("the new UA patterns are not used, got %q", family)
+	}
+}
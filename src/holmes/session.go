@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionTimeout = 1800  // seconds
+	defaultSessionKeep    = 86400 // seconds
+	sessionsList          = "Sessions"
+	sessionsListMax       = 100000
+	sessionShards         = 64
+	sessionSweepEvery     = 1000 // records
+)
+
+var staticURIRegexp = regexp.MustCompile(`(?i)\.(css|js|png|jpe?g|gif|ico|svg|webp|woff2?|ttf|eot|map|swf)(\?|$)`)
+
+// SessionFeatures describe the behaviour of a client in one session, the
+// ratios are shares of the requests of the session
+type SessionFeatures struct {
+	Key                  string // guid:<GUID>, or ipua:<ip>|<UA> when there is no GUID
+	RemoteAddr           string
+	UserAgent            string
+	Start                string
+	End                  string
+	Requests             int
+	DistinctURIs         int
+	PropViewRatio        float64 // /prop/view/ pages
+	StaticRatio          float64 // css, js, images and fonts
+	InterArrivalMean     float64 // seconds
+	InterArrivalVariance float64
+	HeadRatio            float64
+	ClientErrorRatio     float64 // 4xx
+	EmptyRefererRatio    float64
+	NightRatio           float64 // between 0:00 and 6:00 of LogLocation
+	Classified           bool    `json:",omitempty"` // whether a classifier rule scored the session
+	HumanProbability     float64 `json:",omitempty"` // the last score of the classifier rules
+}
+
+// session is an open session, the inter arrival times are summed with the
+// Welford method so the variance needs no list of the times
+type session struct {
+	key          string
+	remoteAddr   string
+	userAgent    string
+	start        time.Time
+	last         time.Time
+	requests     int
+	uris         map[string]bool
+	propView     int
+	static       int
+	head         int
+	clientError  int
+	emptyReferer int
+	night        int
+	gaps         int
+	gapMean      float64
+	gapM2        float64
+	classified   bool
+	human        float64
+}
+
+// SessionKey return the session of a record, by its GUID when it has one
+func SessionKey(accesslog *AccessLog) string {
+	if accesslog.GUID != "" && accesslog.GUID != "-" {
+		return "guid:" + accesslog.GUID
+	}
+	return "ipua:" + accesslog.RemoteAddr + "|" + accesslog.UserAgent
+}
+
+func (s *session) add(accesslog *AccessLog, t time.Time) {
+	if s.requests > 0 {
+		gap := t.Sub(s.last).Seconds()
+		if gap < 0 { // a late record
+			gap = 0
+		}
+		s.gaps++
+		delta := gap - s.gapMean
+		s.gapMean += delta / float64(s.gaps)
+		s.gapM2 += delta * (gap - s.gapMean)
+	}
+	if t.After(s.last) {
+		s.last = t
+	}
+	s.requests++
+	s.uris[accesslog.RequestURI] = true
+	if strings.HasPrefix(accesslog.RequestURI, "/prop/view/") {
+		s.propView++
+	}
+	if staticURIRegexp.MatchString(accesslog.RequestURI) {
+		s.static++
+	}
+	if accesslog.Method == "HEAD" {
+		s.head++
+	}
+	if strings.HasPrefix(accesslog.HttpCode, "4") {
+		s.clientError++
+	}
+	if accesslog.Referer == "" || accesslog.Referer == "-" {
+		s.emptyReferer++
+	}
+	if t.Hour() < 6 {
+		s.night++
+	}
+}
+
+func (s *session) features() SessionFeatures {
+	requests := float64(s.requests)
+	features := SessionFeatures{
+		Key:               s.key,
+		RemoteAddr:        s.remoteAddr,
+		UserAgent:         s.userAgent,
+		Start:             s.start.Format("2006-01-02 15:04:05"),
+		End:               s.last.Format("2006-01-02 15:04:05"),
+		Requests:          s.requests,
+		DistinctURIs:      len(s.uris),
+		PropViewRatio:     float64(s.propView) / requests,
+		StaticRatio:       float64(s.static) / requests,
+		HeadRatio:         float64(s.head) / requests,
+		ClientErrorRatio:  float64(s.clientError) / requests,
+		EmptyRefererRatio: float64(s.emptyReferer) / requests,
+		NightRatio:        float64(s.night) / requests,
+		InterArrivalMean:  s.gapMean,
+		Classified:        s.classified,
+		HumanProbability:  s.human,
+	}
+	if s.gaps > 1 {
+		features.InterArrivalVariance = s.gapM2 / float64(s.gaps-1)
+	}
+	return features
+}
+
+type sessionShard struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+// Sessionizer groups the records into sessions, a session is closed when its
+// client made no request for the timeout. The time is the time of the
+// records, the newest record seen tells how late it is.
+type Sessionizer struct {
+	shards   [sessionShards]sessionShard
+	mutex    sync.Mutex
+	newest   time.Time
+	observed int
+}
+
+func NewSessionizer() *Sessionizer {
+	sessionizer := &Sessionizer{}
+	for i := range sessionizer.shards {
+		sessionizer.shards[i].sessions = map[string]*session{}
+	}
+	return sessionizer
+}
+
+// sessions is the sessionizer of the filter, it is shared by the workers
+// since a GUID may come from several IPs
+var sessions = NewSessionizer()
+
+// Observe adds a record to its session and return the features of the session
+// so far, with the sessions which were closed by their timeout
+func (sessionizer *Sessionizer) Observe(accesslog *AccessLog, timeout time.Duration) (SessionFeatures, []SessionFeatures) {
+	t, err := accesslog.LogTime()
+	if err != nil {
+		return SessionFeatures{}, nil
+	}
+	closed := []SessionFeatures{}
+	sessionizer.mutex.Lock()
+	if t.After(sessionizer.newest) {
+		sessionizer.newest = t
+	}
+	sessionizer.observed++
+	sweep := sessionizer.observed%sessionSweepEvery == 0
+	newest := sessionizer.newest
+	sessionizer.mutex.Unlock()
+	if sweep {
+		closed = sessionizer.Close(newest.Add(-timeout))
+	}
+
+	key := SessionKey(accesslog)
+	shard := &sessionizer.shards[fnv32(key)%sessionShards]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	s, ok := shard.sessions[key]
+	if ok && t.Sub(s.last) > timeout {
+		closed = append(closed, s.features())
+		ok = false
+	}
+	if !ok {
+		s = &session{key: key, remoteAddr: accesslog.RemoteAddr, userAgent: accesslog.UserAgent, start: t, last: t, uris: map[string]bool{}}
+		shard.sessions[key] = s
+	}
+	s.add(accesslog, t)
+	return s.features(), closed
+}
+
+// Score keeps the human probability the classifier gave to an open session
+func (sessionizer *Sessionizer) Score(key string, probability float64) {
+	shard := &sessionizer.shards[fnv32(key)%sessionShards]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if s, ok := shard.sessions[key]; ok {
+		s.classified = true
+		s.human = probability
+	}
+}
+
+// Close closes the sessions without a request since before, all the sessions
+// if before is zero
+func (sessionizer *Sessionizer) Close(before time.Time) []SessionFeatures {
+	closed := []SessionFeatures{}
+	for i := range sessionizer.shards {
+		shard := &sessionizer.shards[i]
+		shard.mutex.Lock()
+		for key, s := range shard.sessions {
+			if before.IsZero() || !s.last.After(before) {
+				closed = append(closed, s.features())
+				delete(shard.sessions, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return closed
+}
+
+// SessionTimeout return the configured inactivity timeout of the sessions
+func SessionTimeout(holmesConfig HolmesConfig) time.Duration {
+	if holmesConfig.SessionTimeout <= 0 {
+		return defaultSessionTimeout * time.Second
+	}
+	return time.Duration(holmesConfig.SessionTimeout) * time.Second
+}
+
+// StoreSessions keeps the closed sessions in the Sessions list for the reports
+// and the training, and the last session of each key as Session_<key> for
+// SessionKeep seconds
+func StoreSessions(redisConn *RedisConn, holmesConfig HolmesConfig, closed []SessionFeatures) error {
+	if len(closed) == 0 {
+		return nil
+	}
+	keep := holmesConfig.SessionKeep
+	if keep <= 0 {
+		keep = defaultSessionKeep
+	}
+	cmds := make([]RedisCmd, 0, 2*len(closed)+1)
+	for _, features := range closed {
+		data, err := json.Marshal(features)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds,
+			NewRedisCmd("SETEX", "Session_"+features.Key, keep, string(data)),
+			NewRedisCmd("LPUSH", sessionsList, string(data)))
+	}
+	cmds = append(cmds, NewRedisCmd("LTRIM", sessionsList, 0, sessionsListMax-1))
+	_, err := redisConn.Pipeline(cmds)
+	return err
+}
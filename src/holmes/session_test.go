@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionizer(t *testing.T) {
+	LogLocation = time.UTC
+	defer func() { LogLocation = time.Local }()
+	sessionizer := NewSessionizer()
+	record := func(sec string, method string, uri string, code string, referer string) *AccessLog {
+		return &AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "03", Min: "20", Sec: sec,
+			RemoteAddr: "10.0.0.1", UserAgent: "Mozilla/5.0", GUID: "-",
+			Method: method, RequestURI: uri, HttpCode: code, Referer: referer}
+	}
+	timeout := 30 * time.Minute
+	sessionizer.Observe(record("00", "GET", "/prop/view/1", "200", "-"), timeout)
+	sessionizer.Observe(record("02", "GET", "/static/a.css", "200", "http://www.anjuke.com/"), timeout)
+	features, closed := sessionizer.Observe(record("06", "HEAD", "/prop/view/1", "404", "-"), timeout)
+	if len(closed) != 0 {
+		t.Errorf("closed %+v", closed)
+	}
+	want := SessionFeatures{
+		Key: "ipua:10.0.0.1|Mozilla/5.0", RemoteAddr: "10.0.0.1", UserAgent: "Mozilla/5.0",
+		Start: "2013-07-09 03:20:00", End: "2013-07-09 03:20:06",
+		Requests: 3, DistinctURIs: 2,
+		PropViewRatio: 2.0 / 3, StaticRatio: 1.0 / 3, HeadRatio: 1.0 / 3, ClientErrorRatio: 1.0 / 3,
+		EmptyRefererRatio: 2.0 / 3, NightRatio: 1,
+		InterArrivalMean: 3, InterArrivalVariance: 2,
+	}
+	if features != want {
+		t.Errorf("got  %+v\nwant %+v", features, want)
+	}
+
+	// a request after the timeout starts a new session
+	late := record("06", "GET", "/", "200", "-")
+	late.Hour = "09"
+	features, closed = sessionizer.Observe(late, timeout)
+	if len(closed) != 1 || closed[0].Requests != 3 || features.Requests != 1 {
+		t.Errorf("after the timeout got %+v and closed %+v", features, closed)
+	}
+	if closed := sessionizer.Close(time.Time{}); len(closed) != 1 {
+		t.Errorf("close all got %+v", closed)
+	}
+}
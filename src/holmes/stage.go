@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStageOffsetFile = ".holmes_stage_offset"
+	stageSaveLines         = 1000            // lines drained between two saves of the offsets
+	stageSaveInterval      = 2 * time.Second // at most between two saves while a file is drained
+	stageHeadBytes         = 4096            // bytes of the first line which identify a file
+	stageMarkTTL           = 7 * 86400       // seconds the push mark of a file is kept
+)
+
+// StageFile is the tailing state of one access log file. A file is identified
+// by its inode and the hash of its first line, so a rotated (renamed) file
+// keeps its offset, and a new file which reuses the inode of a removed one is
+// read from the beginning. Generation counts the truncations of the file.
+type StageFile struct {
+	Name       string
+	Inode      uint64
+	Head       string // "" until the first line is complete
+	Generation int
+	Offset     int64
+}
+
+// mark is the redis key of the end offset of the last line pushed from the file
+func (file *StageFile) mark() string {
+	return fmt.Sprintf("StageMark_%d_%s_%d", file.Inode, file.Head, file.Generation)
+}
+
+// StagedLine is a complete line of a file. Mark names the file and End is the
+// offset after the line, a line pushed again after a crash has the same ones.
+type StagedLine struct {
+	Text string
+	Mark string
+	End  int64
+}
+
+type Stager struct {
+	dir        string
+	offsetFile string
+	files      map[string]*StageFile // keyed by file name
+	saveLines  int
+	drained    int // lines drained since the last save
+	saved      time.Time
+}
+
+// NewStager return a stager which tails every file under dir, the offsets
+// of the files are restored from offsetFile if it exists
+func NewStager(dir string, offsetFile string) *Stager {
+	stager := &Stager{
+		dir:        dir,
+		offsetFile: offsetFile,
+		files:      map[string]*StageFile{},
+		saveLines:  stageSaveLines,
+	}
+	data, err := ioutil.ReadFile(offsetFile)
+	if err == nil {
+		var files []*StageFile
+		if err := json.Unmarshal(data, &files); err != nil {
+			log.Println("(NewStager) ignore broken offset file ", offsetFile, ": ", err)
+		}
+		for _, file := range files {
+			stager.files[file.Name] = file
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatal("(NewStager) ", err)
+	}
+	return stager
+}
+
+// Stage tails the access logs under InLogDir and push them into the accesslog
+// list, it return after stop is closed
+func Stage(holmesConfig HolmesConfig, stop <-chan struct{}) {
+	offsetFile := holmesConfig.StageOffsetFile
+	if offsetFile == "" {
+		offsetFile = filepath.Join(holmesConfig.InLogDir, defaultStageOffsetFile)
+	}
+	format := holmesConfig.InLogFormat
+	if format == "" {
+		format = "nginx"
+	}
+	parser, err := NewLogParser(format, holmesConfig)
+	if err != nil {
+		log.Fatal("(Stage) ", err)
+	}
+	stager := NewStager(holmesConfig.InLogDir, offsetFile)
+	redisConn := NewRedisConn(holmesConfig.RedisConfs[0])
+	defer redisConn.Close()
+	counters := NewCounterBatch(holmesConfig.RedisConfs[2], CounterFlushInterval(holmesConfig))
+	defer counters.Close()
+	deadLetterList := DeadLetterList(holmesConfig)
+
+	for {
+		err := stager.Poll(func(line StagedLine) error {
+			accesslog, err := parser.Parse(line.Text)
+			if err != nil {
+				return PushDeadLetter(redisConn, counters, deadLetterList, "stage", line.Text, err)
+			}
+			_, err = redisConn.EvalScript(stagePushScript, "accesslog", line.Mark, accesslog.String(), line.End, stageMarkTTL)
+			return err
+		})
+		if err != nil {
+			log.Println("(Stage) ", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// stagePushScript pushes ARGV[1] into KEYS[1] unless a line ending at ARGV[2]
+// or later was already pushed from the file of the mark KEYS[2], so the lines
+// read again after a crash are not pushed twice
+var stagePushScript = NewRedisScript(2, `
+local mark = tonumber(redis.call('GET', KEYS[2]) or '-1')
+if tonumber(ARGV[2]) <= mark then
+	return 0
+end
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[2], ARGV[2], 'EX', ARGV[3])
+return 1
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	mark := int64(-1)
+	if value, ok := db.Do("GET", keys[1]).([]byte); ok {
+		mark, _ = strconv.ParseInt(string(value), 10, 64)
+	}
+	if end, _ := strconv.ParseInt(args[1], 10, 64); end <= mark {
+		return int64(0)
+	}
+	db.Do("LPUSH", keys[0], args[0])
+	db.Do("SET", keys[1], args[1], "EX", args[2])
+	return int64(1)
+})
+
+// Poll scan the directory once and call push for each complete line appended
+// since the last poll. Offsets are saved every saveLines lines or
+// stageSaveInterval, and after each file is drained. When push fails the
+// offset stays at the failed line, which is pushed again next poll.
+func (stager *Stager) Poll(push func(line StagedLine) error) error {
+	if err := stager.scan(); err != nil {
+		return err
+	}
+	for _, file := range stager.files {
+		drainErr := stager.drain(file, push)
+		if err := stager.save(); err != nil {
+			return err
+		}
+		if drainErr != nil {
+			return drainErr
+		}
+	}
+	return nil
+}
+
+// scan rebuild the file table from the directory, the offset of a file
+// follows its inode across rename, and is reset when the file was truncated or
+// its inode is reused by another file
+func (stager *Stager) scan() error {
+	fileInfos, err := ioutil.ReadDir(stager.dir)
+	if err != nil {
+		return err
+	}
+	byInode := map[uint64]*StageFile{}
+	for _, file := range stager.files {
+		byInode[file.Inode] = file
+	}
+	files := map[string]*StageFile{}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if !fileInfo.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		path := filepath.Join(stager.dir, name)
+		if path == filepath.Clean(stager.offsetFile) || path == filepath.Clean(stager.offsetFile+".tmp") {
+			continue
+		}
+		inode := fileInfo.Sys().(*syscall.Stat_t).Ino
+		head, err := fileHead(path)
+		if err != nil {
+			if os.IsNotExist(err) { // removed after ReadDir
+				continue
+			}
+			return err
+		}
+		file, ok := byInode[inode]
+		if ok && file.Head != "" && head != "" && head != file.Head {
+			log.Println("(Stage) ", name, " reuses the inode of ", file.Name, ", read it from the beginning")
+			ok = false
+		}
+		if !ok {
+			file = &StageFile{Inode: inode}
+		}
+		file.Name = name
+		if fileInfo.Size() < file.Offset {
+			log.Println("(Stage) ", name, " was truncated, read it from the beginning")
+			file.Offset = 0
+			file.Generation++
+			file.Head = ""
+		}
+		if file.Head == "" {
+			file.Head = head
+		}
+		files[name] = file
+	}
+	stager.files = files
+	return nil
+}
+
+func (stager *Stager) drain(file *StageFile, push func(line StagedLine) error) error {
+	f, err := os.Open(filepath.Join(stager.dir, file.Name))
+	if err != nil {
+		if os.IsNotExist(err) { // removed after scan
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(file.Offset, 0); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF { // a partial line is read again at next poll
+				return nil
+			}
+			return err
+		}
+		if file.Offset == 0 && file.Head == "" {
+			// the first line was completed after scan
+			file.Head = headHash([]byte(line))
+		}
+		if trimmed := strings.TrimRight(line, "\r\n"); trimmed != "" {
+			if err := push(StagedLine{Text: trimmed, Mark: file.mark(), End: file.Offset + int64(len(line))}); err != nil {
+				return err
+			}
+		}
+		file.Offset += int64(len(line))
+		if err := stager.checkpoint(); err != nil {
+			return err
+		}
+	}
+}
+
+// checkpoint saves the offsets when saveLines lines were drained or
+// stageSaveInterval passed since the last save
+func (stager *Stager) checkpoint() error {
+	stager.drained++
+	if stager.drained < stager.saveLines && time.Since(stager.saved) < stageSaveInterval {
+		return nil
+	}
+	return stager.save()
+}
+
+// fileHead return the hash of the first line of a file, "" when the line is
+// not complete yet
+func fileHead(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buffer := make([]byte, stageHeadBytes)
+	n, err := io.ReadFull(f, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	buffer = buffer[:n]
+	for i, c := range buffer {
+		if c == '\n' {
+			return headHash(buffer[:i+1]), nil
+		}
+	}
+	if n < stageHeadBytes {
+		return "", nil
+	}
+	return headHash(buffer), nil
+}
+
+// headHash hashes the first stageHeadBytes of the first line of a file
+func headHash(line []byte) string {
+	if len(line) > stageHeadBytes {
+		line = line[:stageHeadBytes]
+	}
+	hash := fnv.New64a()
+	hash.Write(line)
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// save write the offsets into a temporary file and rename it, so the offset
+// file is never left half written
+func (stager *Stager) save() error {
+	stager.drained, stager.saved = 0, time.Now()
+	files := make([]*StageFile, 0, len(stager.files))
+	for _, file := range stager.files {
+		files = append(files, file)
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	temp := stager.offsetFile + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, stager.offsetFile)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pollLines(t *testing.T, stager *Stager) []string {
+	lines := []string{}
+	err := stager.Poll(func(line StagedLine) error {
+		lines = append(lines, line.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func appendFile(t *testing.T, filename string, content string) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStagerPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes_stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, defaultStageOffsetFile)
+	accessLog := filepath.Join(dir, "access.log")
+
+	stager := NewStager(dir, offsetFile)
+	appendFile(t, accessLog, "a\nb\npartial")
+	if lines := pollLines(t, stager); len(lines) != 2 || lines[0] != "a" || lines[1] != "b" {
+		t.Errorf("first poll got %v", lines)
+	}
+
+	// a restarted stager continues from the saved offset
+	stager = NewStager(dir, offsetFile)
+	appendFile(t, accessLog, "\nc\n")
+	if lines := pollLines(t, stager); len(lines) != 2 || lines[0] != "partial" || lines[1] != "c" {
+		t.Errorf("poll after restart got %v", lines)
+	}
+
+	// rotation: the old file is renamed and a new one is created
+	appendFile(t, accessLog, "d\n")
+	if err := os.Rename(accessLog, accessLog+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, accessLog, "e\n")
+	if lines := pollLines(t, stager); len(lines) != 2 {
+		t.Errorf("poll after rotation got %v", lines)
+	}
+
+	// truncation
+	if err := os.Truncate(accessLog, 0); err != nil {
+		t.Fatal(err)
+	}
+	pollLines(t, stager)
+	appendFile(t, accessLog, "f\n")
+	if lines := pollLines(t, stager); len(lines) != 1 || lines[0] != "f" {
+		t.Errorf("poll after truncation got %v", lines)
+	}
+
+	// a failed push keeps the offset at the failed line
+	appendFile(t, accessLog, "g\nh\n")
+	err = stager.Poll(func(line StagedLine) error {
+		if line.Text == "h" {
+			return os.ErrInvalid
+		}
+		return nil
+	})
+	if err != os.ErrInvalid {
+		t.Errorf("poll with a failed push got %v", err)
+	}
+	if lines := pollLines(t, stager); len(lines) != 1 || lines[0] != "h" {
+		t.Errorf("poll after a failed push got %v", lines)
+	}
+
+	// a new file with the inode of the old one and no fewer bytes
+	stager.files["access.log"].Head = "0000000000000000"
+	if lines := pollLines(t, stager); len(lines) != 3 || lines[0] != "f" {
+		t.Errorf("poll after inode reuse got %v", lines)
+	}
+}
+
+func TestStagerCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes_stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, defaultStageOffsetFile)
+	appendFile(t, filepath.Join(dir, "access.log"), "a\nb\nc\nd\n")
+
+	// the offsets are saved every 2 lines, a crash after c reads c and d again
+	stager := NewStager(dir, offsetFile)
+	stager.saveLines = 2
+	var first []StagedLine
+	stager.Poll(func(line StagedLine) error {
+		first = append(first, line)
+		if line.Text == "c" {
+			return os.ErrInvalid
+		}
+		return nil
+	})
+	data, err := ioutil.ReadFile(offsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(offsetFile+".crash", data, 0644)
+	pollLines(t, stager)
+	os.Rename(offsetFile+".crash", offsetFile)
+
+	var again []StagedLine
+	NewStager(dir, offsetFile).Poll(func(line StagedLine) error {
+		again = append(again, line)
+		return nil
+	})
+	// the lines read again carry the mark and end offset of their first read,
+	// so the push script drops them
+	if len(first) != 3 || len(again) != 2 || again[0] != first[2] || again[1].End != 8 || again[1].Mark != first[0].Mark {
+		t.Errorf("first read %+v, read again %+v", first, again)
+	}
+}
+
+func TestStagePushScript(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"stagePush", nil, stagePushScript, []interface{}{"accesslog", "StageMark_1", "a", 10, 60}},
+		{"stagePush pushed", [][]interface{}{{"SET", "StageMark_1", 10}}, stagePushScript, []interface{}{"accesslog", "StageMark_1", "a", 10, 60}},
+		{"stagePush next", [][]interface{}{{"SET", "StageMark_1", 10}}, stagePushScript, []interface{}{"accesslog", "StageMark_1", "b", 20, 60}},
+	})
+}
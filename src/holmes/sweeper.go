@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSweepInterval = 60 // seconds
+	sweepBatch           = 1000
+)
+
+// The WhiteList, WatchingList and RefererList are sorted sets of the IPs
+// scored by the unix time the IP was last seen, so the sweeper can drop the
+// entries which were not seen for their TTL.
+var lastSeenKeys = []string{"WhiteList", "WatchingList", "RefererList"}
+
+// migrateSetScript turns the set of an older holmes into a sorted set, the
+// members are seen at ARGV[1]
+var migrateSetScript = NewRedisScript(1, `
+if redis.call('TYPE', KEYS[1]).ok ~= 'set' then
+	return 0
+end
+local members = redis.call('SMEMBERS', KEYS[1])
+redis.call('DEL', KEYS[1])
+for _, member in ipairs(members) do
+	redis.call('ZADD', KEYS[1], ARGV[1], member)
+end
+return #members
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	if db.Do("TYPE", keys[0]) != "set" {
+		return int64(0)
+	}
+	members := db.Do("SMEMBERS", keys[0]).([]interface{})
+	db.Do("DEL", keys[0])
+	for _, member := range members {
+		db.Do("ZADD", keys[0], args[0], string(member.([]byte)))
+	}
+	return int64(len(members))
+})
+
+// MigrateListKeys turns the WhiteList, WatchingList and RefererList sets into
+// sorted sets, it must run before the filter starts
+func MigrateListKeys(redisConn *RedisConn, now time.Time) error {
+	for _, key := range lastSeenKeys {
+		n, err := redisInt64(redisConn.EvalScript(migrateSetScript, key, now.Unix()))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Println("(MigrateListKeys) ", key, " is a sorted set now, ", n, " members")
+		}
+	}
+	return nil
+}
+
+// expireWatchingScript takes the watching list of ARGV[1] out of redis if it
+// was not seen since ARGV[2]
+// KEYS: WL_<ip>, WatchingList
+var expireWatchingScript = NewRedisScript(2, `
+local seen = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if not seen or tonumber(seen) > tonumber(ARGV[2]) then
+	return {}
+end
+local records = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return records
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	seen, ok := db.Do("ZSCORE", keys[1], args[0]).([]byte)
+	if !ok {
+		return []interface{}{}
+	}
+	score, _ := strconv.ParseFloat(string(seen), 64)
+	if before, _ := strconv.ParseFloat(args[1], 64); score > before {
+		return []interface{}{}
+	}
+	records := db.Do("LRANGE", keys[0], 0, -1)
+	db.Do("DEL", keys[0])
+	db.Do("ZREM", keys[1], args[0])
+	return records
+})
+
+// expireRefererScript removes the IPs of RefererList not seen since ARGV[1]
+// with their Referer_<ip> sets
+var expireRefererScript = NewRedisScript(1, `
+local ips = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, ip in ipairs(ips) do
+	redis.call('ZREM', KEYS[1], ip)
+	redis.call('DEL', 'Referer_' .. ip)
+end
+return #ips
+`).WithMemory(func(db *MemoryRedis, keys []string, args []string) interface{} {
+	ips := db.Do("ZRANGEBYSCORE", keys[0], "-inf", args[0]).([]interface{})
+	if limit, _ := strconv.Atoi(args[1]); len(ips) > limit {
+		ips = ips[:limit]
+	}
+	for _, ip := range ips {
+		db.Do("ZREM", keys[0], string(ip.([]byte)))
+		db.Do("DEL", "Referer_"+string(ip.([]byte)))
+	}
+	return int64(len(ips))
+})
+
+// SweepWhiteList removes the IPs not seen since before
+func SweepWhiteList(redisConn *RedisConn, before time.Time) (int64, error) {
+	return redisConn.SortedSetRemRangeByScore("WhiteList", "-inf", strconv.FormatInt(before.Unix(), 10))
+}
+
+// SweepRefererList removes the referers of the IPs not seen since before
+func SweepRefererList(redisConn *RedisConn, before time.Time) (int64, error) {
+	var swept int64
+	for {
+		n, err := redisInt64(redisConn.EvalScript(expireRefererScript, "RefererList", before.Unix(), sweepBatch))
+		swept += n
+		if err != nil || n < sweepBatch {
+			return swept, err
+		}
+	}
+}
+
+// SweepWatchingList drops the watching lists not seen since before. Their
+// records are counted in accesslog_result_vppv_watching_expired_per_min, and
+// are no longer counted as watching if expired is NO, then they are pushed
+// into the result lists as expired, UNKNOWN or NO.
+// output:the number of dropped records
+func SweepWatchingList(conns *FilterConns, before time.Time, expired string) (int64, error) {
+	var swept int64
+	verdict := Verdict{Result: UNKNOWN, Reason: "watching_expired"}
+	if expired == "NO" {
+		verdict = Verdict{Result: NO, Class: BadRobot, Reason: "watching_expired", Confidence: 1}
+	}
+	ips, err := conns.Lists.SortedSetRangeByScore("WatchingList", "-inf", strconv.FormatInt(before.Unix(), 10))
+	if err != nil {
+		return swept, err
+	}
+	for _, ip := range ips {
+		// the IP is checked again in the script, it may be seen in between
+		lines, err := stringSlice(conns.Lists.EvalScript(expireWatchingScript, "WL_"+ip, "WatchingList", ip, before.Unix()))
+		if err != nil {
+			return swept, err
+		}
+		records := make([]WatchedRecord, 0, len(lines))
+		for _, line := range lines {
+			watchAccesslog, err := GetLog(line)
+			if err != nil {
+				continue
+			}
+			records = append(records, WatchedRecord{AccessLog: watchAccesslog, Verdict: verdict})
+			logTimeMin := watchAccesslog.LogTimeMinString()
+			conns.Counters.HashIncrby("accesslog_result_vppv_watching_expired_per_min", logTimeMin, 1)
+			if expired == "NO" {
+				conns.Counters.HashIncrby("accesslog_result_vppv_watching_per_min", logTimeMin, -1)
+				Reclassify(conns.Counters, logTimeMin, Unclassified, BadRobot)
+			}
+		}
+		swept += int64(len(lines))
+		if err := PushWatchedRecords(conns, records); err != nil {
+			return swept, err
+		}
+	}
+	return swept, nil
+}
+
+// Sweeper drops the expired bans and the white, watching and referer entries
+// not seen for their TTL every SweepInterval, and returns the watching claims
+// a crashed filter did not finish, it return after stop is closed
+func Sweeper(holmesConfig HolmesConfig, stop <-chan struct{}) {
+	conns := NewFilterConns(holmesConfig)
+	defer conns.Close()
+	interval := time.Duration(holmesConfig.SweepInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultSweepInterval * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		config := CurrentRuntime().Config
+		now := time.Now()
+		if n, err := SweepBlackList(conns.Lists, now); err != nil {
+			log.Println("(Sweeper) BlackList: ", err)
+		} else if n > 0 {
+			log.Println("(Sweeper) ", n, " bans expired")
+		}
+		n, err := ReturnWatchingClaims(conns.Lists, now.Add(-watchingClaimTimeout), now)
+		logSweep(watchingClaimedKey, n, err)
+		if config.WhiteListTTL > 0 {
+			n, err := SweepWhiteList(conns.Lists, now.Add(-time.Duration(config.WhiteListTTL)*time.Second))
+			logSweep("WhiteList", n, err)
+		}
+		if config.WatchingTTL > 0 {
+			n, err := SweepWatchingList(conns, now.Add(-time.Duration(config.WatchingTTL)*time.Second), config.ExpiredWatching)
+			logSweep("WatchingList", n, err)
+		}
+		if config.RefererTTL > 0 {
+			n, err := SweepRefererList(conns.Lists, now.Add(-time.Duration(config.RefererTTL)*time.Second))
+			logSweep("RefererList", n, err)
+		}
+	}
+}
+
+func logSweep(key string, n int64, err error) {
+	if err != nil {
+		log.Println("(Sweeper) ", key, ": ", err)
+	} else if n > 0 {
+		log.Println("(Sweeper) ", n, " entries of ", key, " expired")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateListKeys(t *testing.T) {
+	db := NewMemoryRedis()
+	redisConn := db.Conn()
+	now := time.Unix(1373353200, 0)
+	db.Do("SADD", "WhiteList", "10.0.0.1", "10.0.0.2")
+	db.Do("ZADD", "WatchingList", 100, "10.0.0.3")
+
+	if err := MigrateListKeys(redisConn, now); err != nil {
+		t.Fatal(err)
+	}
+	if db.Do("TYPE", "WhiteList") != "zset" {
+		t.Fatalf("WhiteList is a %v", db.Do("TYPE", "WhiteList"))
+	}
+	if score, ok, err := redisConn.SortedSetScore("WhiteList", "10.0.0.2"); err != nil || !ok || score != float64(now.Unix()) {
+		t.Errorf("10.0.0.2 is seen at %v %v", score, err)
+	}
+	if score, ok, err := redisConn.SortedSetScore("WatchingList", "10.0.0.3"); err != nil || !ok || score != 100 {
+		t.Errorf("a sorted set is changed, 10.0.0.3 is seen at %v %v", score, err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	db := NewMemoryRedis()
+	conns := &FilterConns{Queue: db.Conn(), Lists: db.Conn(), Counters: NewMemoryCounterBatch()}
+	now := time.Unix(1373353200, 0)
+	before := now.Add(-time.Hour)
+	old, recent := before.Unix()-1, now.Unix()
+
+	db.Do("ZADD", "WhiteList", old, "10.0.0.1", recent, "10.0.0.2", math.Inf(1), "10.0.0.3")
+	if n, err := SweepWhiteList(conns.Lists, before); err != nil || n != 1 {
+		t.Errorf("swept %d %v", n, err)
+	}
+	if db.Do("ZCARD", "WhiteList") != int64(2) {
+		t.Errorf("the IP white listed by hand is swept")
+	}
+
+	db.Do("ZADD", "RefererList", old, "10.0.0.4", recent, "10.0.0.5")
+	db.Do("SADD", "Referer_10.0.0.4", "http://a/")
+	db.Do("SADD", "Referer_10.0.0.5", "http://b/")
+	if n, err := SweepRefererList(conns.Lists, before); err != nil || n != 1 {
+		t.Errorf("swept %d %v", n, err)
+	}
+	if db.Do("EXISTS", "Referer_10.0.0.4") != int64(0) || db.Do("EXISTS", "Referer_10.0.0.5") != int64(1) {
+		t.Errorf("the referers are not swept with their IP")
+	}
+
+	accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: "20", Sec: "00",
+		RemoteAddr: "10.0.0.6", UserAgent: "Chrome/28", GUID: "-", Method: "GET", HttpCode: "200",
+		Hostname: "www.anjuke.com", RequestURI: "/prop/view/1", Referer: "-"}
+	AddWatchingList(conns, &accesslog)
+	db.Do("ZADD", "WatchingList", old, "10.0.0.6")
+	db.Do("ZADD", "WatchingList", recent, "10.0.0.7")
+	db.Do("LPUSH", "WL_10.0.0.7", accesslog.String())
+	if n, err := SweepWatchingList(conns, before, "NO"); err != nil || n != 1 {
+		t.Errorf("swept %d %v", n, err)
+	}
+	if db.Do("EXISTS", "WL_10.0.0.6") != int64(0) || db.Do("EXISTS", "WL_10.0.0.7") != int64(1) {
+		t.Errorf("the watching lists are not swept by their IP")
+	}
+	counts := conns.Counters.Counts()
+	if counts["accesslog_result_vppv_watching_expired_per_min"]["2013-07-09 15:20"] != 1 ||
+		counts["accesslog_result_vppv_watching_per_min"]["2013-07-09 15:20"] != 0 {
+		t.Errorf("the counters are %v", counts)
+	}
+	if exported := db.Do("LRANGE", "accesslog_no", 0, -1).([]interface{}); len(exported) != 1 ||
+		!strings.HasSuffix(string(exported[0].([]byte)), "\tNO\tbad_robot\twatching_expired\t1.00") {
+		t.Errorf("the expired records are exported as %q", exported)
+	}
+}
+
+func TestSweepScripts(t *testing.T) {
+	checkScripts(t, []scriptCase{
+		{"migrateSet", [][]interface{}{{"SADD", "WhiteList", "10.0.0.1", "10.0.0.2"}}, migrateSetScript, []interface{}{"WhiteList", 100}},
+		{"migrateSet sorted", [][]interface{}{{"ZADD", "WhiteList", 50, "10.0.0.1"}}, migrateSetScript, []interface{}{"WhiteList", 100}},
+		{"expireWatching", [][]interface{}{{"RPUSH", "WL_10.0.0.1", "a", "b"}, {"ZADD", "WatchingList", 100, "10.0.0.1"}}, expireWatchingScript, []interface{}{"WL_10.0.0.1", "WatchingList", "10.0.0.1", 200}},
+		{"expireWatching seen", [][]interface{}{{"RPUSH", "WL_10.0.0.1", "a", "b"}, {"ZADD", "WatchingList", 300, "10.0.0.1"}}, expireWatchingScript, []interface{}{"WL_10.0.0.1", "WatchingList", "10.0.0.1", 200}},
+		{"expireReferer", [][]interface{}{{"ZADD", "RefererList", 100, "10.0.0.1", 150, "10.0.0.2", 300, "10.0.0.3"}, {"SADD", "Referer_10.0.0.1", "http://a/"}, {"SADD", "Referer_10.0.0.3", "http://c/"}},
+			expireRefererScript, []interface{}{"RefererList", 200, 1}},
+	})
+}
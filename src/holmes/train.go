@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTreeDepth   = 6
+	defaultTreeMinLeaf = 10
+)
+
+// TrainingSample is a labeled session, Values are in the order of the
+// features of the model
+type TrainingSample struct {
+	Features SessionFeatures
+	Values   []float64
+	Human    bool
+}
+
+// TreeOptions limit the growth of a decision tree
+type TreeOptions struct {
+	MaxDepth int
+	MinLeaf  int // sessions a leaf needs at least
+}
+
+// TrainCommand is `holmes train`, it learns a model from the sessions of
+// historical access logs and reports how it does on a holdout split
+func TrainCommand(args []string) error {
+	flags := flag.NewFlagSet("train", flag.ContinueOnError)
+	confFile := flags.String("conf", "holmes.conf", "holmes config file")
+	format := flags.String("format", "", "log format of the files, default is InLogFormat")
+	labelFile := flags.String("labels", "", "CSV of ip or session key,human|robot; default is the WhiteList as humans")
+	unlisted := flags.String("unlisted", "skip", "label of the clients neither labeled nor in the WhiteList or BlackList: skip or robot")
+	modelType := flags.String("model", "decision_tree", "decision_tree or naive_bayes")
+	output := flags.String("out", "model.json", "model file to write")
+	version := flags.String("version", "", "version of the model, default is the time it is trained")
+	holdout := flags.Float64("holdout", 0.2, "share of the clients kept out of the training to evaluate the model")
+	seed := flags.Int64("seed", 1, "seed of the holdout split")
+	minRequests := flags.Int("min-requests", 0, "records a session needs, default is ClassifierMinRequests")
+	depth := flags.Int("depth", defaultTreeDepth, "max depth of the decision tree")
+	minLeaf := flags.Int("min-leaf", defaultTreeMinLeaf, "min sessions of a leaf of the decision tree")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: holmes train [flags] logfile...")
+	}
+	if *holdout < 0 || *holdout >= 1 {
+		return fmt.Errorf("-holdout must be within [0, 1)")
+	}
+	holmesConfig, err := ReadConfig(*confFile)
+	if err != nil {
+		return err
+	}
+	if err := InitLogLocation(holmesConfig.LogTimeZone); err != nil {
+		return err
+	}
+	if *unlisted != "robot" && *unlisted != "skip" {
+		return fmt.Errorf("-unlisted must be robot or skip, got %q", *unlisted)
+	}
+	if *format == "" {
+		*format = holmesConfig.InLogFormat
+		if *format == "" {
+			*format = "nginx"
+		}
+	}
+	parser, err := NewLogParser(*format, holmesConfig)
+	if err != nil {
+		return err
+	}
+	if *minRequests <= 0 {
+		*minRequests = holmesConfig.ClassifierMinRequests
+		if *minRequests <= 0 {
+			*minRequests = defaultClassifierMinRequests
+		}
+	}
+
+	var labels map[string]bool
+	if *labelFile != "" {
+		labels, err = ReadLabels(*labelFile)
+	} else {
+		labels, err = listLabels(NewRedisConn(holmesConfig.RedisConfs[1]))
+	}
+	if err != nil {
+		return err
+	}
+	sessionizer := NewSessionizer()
+	timeout := SessionTimeout(holmesConfig)
+	all := []SessionFeatures{}
+	for _, path := range flags.Args() {
+		err := ReadLogFile(path, func(line string) {
+			accesslog, err := parser.Parse(line)
+			if err != nil {
+				return
+			}
+			_, closed := sessionizer.Observe(&accesslog, timeout)
+			all = append(all, closed...)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	all = append(all, sessionizer.Close(time.Time{})...)
+	// the sessionizer closes in no order, sort so a seed always splits the same
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Start != all[j].Start {
+			return all[i].Start < all[j].Start
+		}
+		return all[i].Key < all[j].Key
+	})
+	vector, err := newFeatureVector(SessionFeatureNames)
+	if err != nil {
+		return err
+	}
+	samples := LabelSessions(all, labels, *unlisted == "robot", *minRequests, vector)
+	training, testing := HoldoutSplit(samples, *holdout, *seed)
+	fmt.Printf("%d sessions, %d labeled with %d records at least, %d to train and %d to test\n", len(all), len(samples), *minRequests, len(training), len(testing))
+
+	modelFile := ModelFile{Format: modelFormat, Type: *modelType, Version: *version, Features: SessionFeatureNames}
+	modelFile.Trained = time.Now().Format("2006-01-02 15:04:05")
+	if modelFile.Version == "" {
+		modelFile.Version = time.Now().Format("20060102150405")
+	}
+	var model interface{}
+	switch *modelType {
+	case "decision_tree":
+		model, err = TrainDecisionTree(training, TreeOptions{MaxDepth: *depth, MinLeaf: *minLeaf})
+	case "naive_bayes":
+		model, err = TrainNaiveBayes(training)
+	default:
+		err = fmt.Errorf("unknown model type %q", *modelType)
+	}
+	if err != nil {
+		return err
+	}
+	if modelFile.Model, err = json.Marshal(model); err != nil {
+		return err
+	}
+	classifier, err := NewClassifier(modelFile)
+	if err != nil {
+		return err
+	}
+	if len(testing) > 0 {
+		fmt.Print(Evaluate(classifier, testing).String())
+	}
+	data, err := json.MarshalIndent(modelFile, "", "    ")
+	if err != nil {
+		return err
+	}
+	if _, err := replaceFile(*output, append(data, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("model %s version %s is written to %s\n", modelFile.Type, modelFile.Version, *output)
+	return nil
+}
+
+// ReadLabels reads a CSV of "key,label", the key is an IP or a session key such
+// as guid:<GUID>, the label is human or robot
+func ReadLabels(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+	labels := map[string]bool{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return labels, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(record[1])) {
+		case "human", "1":
+			labels[strings.TrimSpace(record[0])] = true
+		case "robot", "0":
+			labels[strings.TrimSpace(record[0])] = false
+		default:
+			return nil, fmt.Errorf("%s: %s has label %q, not human or robot", path, record[0], record[1])
+		}
+	}
+}
+
+// listLabels takes the IPs of the WhiteList as humans and the IPs of the
+// BlackList as robots
+func listLabels(redisConn *RedisConn) (map[string]bool, error) {
+	defer redisConn.Close()
+	labels := map[string]bool{}
+	robots, err := redisConn.SortedSetRangeByScore(blackListKey, "-inf", "+inf")
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range robots {
+		labels[ip] = false
+	}
+	humans, err := redisConn.SortedSetRangeByScore("WhiteList", "-inf", "+inf")
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range humans {
+		labels[ip] = true
+	}
+	return labels, nil
+}
+
+// LabelSessions return the samples of the sessions with minRequests records at
+// least, a session is labeled by its key first and then by its IP
+func LabelSessions(all []SessionFeatures, labels map[string]bool, unlistedRobot bool, minRequests int, vector featureVector) []TrainingSample {
+	samples := []TrainingSample{}
+	for _, features := range all {
+		if features.Requests < minRequests {
+			continue
+		}
+		human, ok := labels[features.Key]
+		if !ok {
+			human, ok = labels[features.RemoteAddr]
+		}
+		if !ok && !unlistedRobot {
+			continue
+		}
+		samples = append(samples, TrainingSample{Features: features, Values: vector.values(features), Human: human})
+	}
+	return samples
+}
+
+// HoldoutSplit keeps a holdout share of the clients out of the training, all
+// the sessions of a client are on the same side so the model is not tested on
+// the clients it learned. A client is the IP of the session.
+func HoldoutSplit(samples []TrainingSample, holdout float64, seed int64) ([]TrainingSample, []TrainingSample) {
+	clients := []string{}
+	seen := map[string]bool{}
+	for _, sample := range samples {
+		if !seen[sample.Features.RemoteAddr] {
+			seen[sample.Features.RemoteAddr] = true
+			clients = append(clients, sample.Features.RemoteAddr)
+		}
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(len(clients), func(i, j int) {
+		clients[i], clients[j] = clients[j], clients[i]
+	})
+	held := map[string]bool{}
+	for _, client := range clients[len(clients)-int(float64(len(clients))*holdout):] {
+		held[client] = true
+	}
+	var training, testing []TrainingSample
+	for _, sample := range samples {
+		if held[sample.Features.RemoteAddr] {
+			testing = append(testing, sample)
+		} else {
+			training = append(training, sample)
+		}
+	}
+	return training, testing
+}
+
+func countHumans(samples []TrainingSample) int {
+	humans := 0
+	for _, sample := range samples {
+		if sample.Human {
+			humans++
+		}
+	}
+	return humans
+}
+
+func checkClasses(samples []TrainingSample) error {
+	humans := countHumans(samples)
+	if humans == 0 || humans == len(samples) {
+		return fmt.Errorf("%d of %d training sessions are humans, both classes are needed", humans, len(samples))
+	}
+	return nil
+}
+
+// TrainDecisionTree grows a CART tree splitting on the gini impurity
+func TrainDecisionTree(samples []TrainingSample, options TreeOptions) (*TreeNode, error) {
+	if err := checkClasses(samples); err != nil {
+		return nil, err
+	}
+	if options.MaxDepth <= 0 {
+		options.MaxDepth = defaultTreeDepth
+	}
+	if options.MinLeaf <= 0 {
+		options.MinLeaf = 1
+	}
+	return growTree(samples, options, 0), nil
+}
+
+func gini(humans, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	p := float64(humans) / float64(total)
+	return 2 * p * (1 - p)
+}
+
+func growTree(samples []TrainingSample, options TreeOptions, depth int) *TreeNode {
+	humans := countHumans(samples)
+	node := &TreeNode{Human: float64(humans) / float64(len(samples)), Samples: len(samples)}
+	if depth >= options.MaxDepth || len(samples) < 2*options.MinLeaf || humans == 0 || humans == len(samples) {
+		return node
+	}
+	best := gini(humans, len(samples)) * float64(len(samples))
+	bestFeature, bestThreshold := -1, 0.0
+	sorted := make([]TrainingSample, len(samples))
+	for feature := range samples[0].Values {
+		copy(sorted, samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Values[feature] < sorted[j].Values[feature] })
+		leftHumans := 0
+		for i := 0; i < len(sorted)-1; i++ {
+			if sorted[i].Human {
+				leftHumans++
+			}
+			left := i + 1
+			right := len(sorted) - left
+			if sorted[i].Values[feature] == sorted[i+1].Values[feature] || left < options.MinLeaf || right < options.MinLeaf {
+				continue
+			}
+			impurity := gini(leftHumans, left)*float64(left) + gini(humans-leftHumans, right)*float64(right)
+			if impurity < best-1e-12 {
+				best = impurity
+				bestFeature = feature
+				bestThreshold = (sorted[i].Values[feature] + sorted[i+1].Values[feature]) / 2
+			}
+		}
+	}
+	if bestFeature < 0 {
+		return node
+	}
+	var left, right []TrainingSample
+	for _, sample := range samples {
+		if sample.Values[bestFeature] <= bestThreshold {
+			left = append(left, sample)
+		} else {
+			right = append(right, sample)
+		}
+	}
+	node.Feature = bestFeature
+	node.Threshold = bestThreshold
+	node.Left = growTree(left, options, depth+1)
+	node.Right = growTree(right, options, depth+1)
+	return node
+}
+
+// TrainNaiveBayes fits a gaussian per feature and class
+func TrainNaiveBayes(samples []TrainingSample) (*NaiveBayesModel, error) {
+	if err := checkClasses(samples); err != nil {
+		return nil, err
+	}
+	humans := countHumans(samples)
+	model := &NaiveBayesModel{HumanPrior: float64(humans) / float64(len(samples))}
+	for feature := range samples[0].Values {
+		model.Human = append(model.Human, fitGaussian(samples, feature, true))
+		model.Robot = append(model.Robot, fitGaussian(samples, feature, false))
+	}
+	return model, nil
+}
+
+func fitGaussian(samples []TrainingSample, feature int, human bool) Gaussian {
+	var n, mean, m2 float64
+	for _, sample := range samples {
+		if sample.Human != human {
+			continue
+		}
+		n++
+		delta := sample.Values[feature] - mean
+		mean += delta / n
+		m2 += delta * (sample.Values[feature] - mean)
+	}
+	return Gaussian{Mean: mean, Variance: m2 / n}
+}
+
+// Evaluation is the confusion matrix of a model on the holdout sessions, a
+// session is predicted human when its probability is 0.5 at least
+type Evaluation struct {
+	HumanAsHuman int
+	HumanAsRobot int
+	RobotAsHuman int
+	RobotAsRobot int
+}
+
+// Evaluate scores the testing samples
+func Evaluate(classifier Classifier, testing []TrainingSample) Evaluation {
+	var evaluation Evaluation
+	for _, sample := range testing {
+		predicted := classifier.HumanProbability(sample.Features) >= 0.5
+		switch {
+		case sample.Human && predicted:
+			evaluation.HumanAsHuman++
+		case sample.Human:
+			evaluation.HumanAsRobot++
+		case predicted:
+			evaluation.RobotAsHuman++
+		default:
+			evaluation.RobotAsRobot++
+		}
+	}
+	return evaluation
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return float64(a) / float64(b)
+}
+
+func (evaluation Evaluation) String() string {
+	e := evaluation
+	return fmt.Sprintf(`holdout confusion matrix:
+                predicted human  predicted robot
+  actual human  %15d  %15d
+  actual robot  %15d  %15d
+human precision %.4f recall %.4f
+robot precision %.4f recall %.4f
+accuracy %.4f
+`,
+		e.HumanAsHuman, e.HumanAsRobot, e.RobotAsHuman, e.RobotAsRobot,
+		ratio(e.HumanAsHuman, e.HumanAsHuman+e.RobotAsHuman), ratio(e.HumanAsHuman, e.HumanAsHuman+e.HumanAsRobot),
+		ratio(e.RobotAsRobot, e.RobotAsRobot+e.HumanAsRobot), ratio(e.RobotAsRobot, e.RobotAsRobot+e.RobotAsHuman),
+		ratio(e.HumanAsHuman+e.RobotAsRobot, e.HumanAsHuman+e.HumanAsRobot+e.RobotAsHuman+e.RobotAsRobot))
+}
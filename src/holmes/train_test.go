@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// separable samples, the humans have few empty referers
+func trainingSamples(n int) []TrainingSample {
+	samples := []TrainingSample{}
+	for i := 0; i < n; i++ {
+		human := i%2 == 0
+		features := SessionFeatures{Requests: 5 + i%7, EmptyRefererRatio: 0.1 + float64(i%5)/100}
+		if !human {
+			features.EmptyRefererRatio += 0.7
+		}
+		samples = append(samples, TrainingSample{
+			Features: features,
+			Values:   []float64{float64(features.Requests), features.EmptyRefererRatio},
+			Human:    human,
+		})
+	}
+	return samples
+}
+
+func TestTrain(t *testing.T) {
+	samples := trainingSamples(100)
+	features := []string{"Requests", "EmptyRefererRatio"}
+	vector, _ := newFeatureVector(features)
+
+	root, err := TrainDecisionTree(samples, TreeOptions{MaxDepth: 3, MinLeaf: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsLeaf() || root.Feature != 1 || root.Threshold < 0.15 || root.Threshold > 0.8 {
+		t.Errorf("root splits %d at %v", root.Feature, root.Threshold)
+	}
+	tree := &DecisionTree{vector: vector, root: root}
+	if e := Evaluate(tree, samples); e.HumanAsRobot != 0 || e.RobotAsHuman != 0 || e.HumanAsHuman != 50 {
+		t.Errorf("tree got %+v", e)
+	}
+
+	model, err := TrainNaiveBayes(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.HumanPrior != 0.5 || len(model.Human) != 2 || model.Robot[1].Mean < 0.8 {
+		t.Errorf("bayes got %+v", model)
+	}
+	bayes := &NaiveBayes{vector: vector, model: *model}
+	if e := Evaluate(bayes, samples); e.HumanAsRobot != 0 || e.RobotAsHuman != 0 {
+		t.Errorf("bayes got %+v", e)
+	}
+
+	humans := samples[:0:0]
+	for _, sample := range samples {
+		if sample.Human {
+			humans = append(humans, sample)
+		}
+	}
+	if _, err := TrainDecisionTree(humans, TreeOptions{}); err == nil {
+		t.Errorf("a tree is trained without robots")
+	}
+	e := Evaluation{HumanAsHuman: 8, HumanAsRobot: 2, RobotAsHuman: 2, RobotAsRobot: 8}
+	if !strings.Contains(e.String(), "human precision 0.8000 recall 0.8000") {
+		t.Errorf("report is\n%s", e.String())
+	}
+}
+
+func TestTrainCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holmes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { LogLocation = time.Local }()
+	confFile := filepath.Join(dir, "holmes.conf")
+	if err := ioutil.WriteFile(confFile, []byte(`{"RedisConfs":[{},{},{}],"LogTimeZone":"UTC"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 20 human and 20 robot clients of 6 records, half of the log is gzipped
+	lines := []string{}
+	labels := "# ip,label\n"
+	for i := 0; i < 40; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i%2, i)
+		referer := "http://www.anjuke.com/"
+		if i%2 == 1 {
+			referer = "-"
+			labels += ip + ",robot\n"
+		} else {
+			labels += ip + ",human\n"
+		}
+		for j := 0; j < 6; j++ {
+			accesslog := AccessLog{Year: "2013", Month: "07", Day: "09", Hour: "15", Min: fmt.Sprintf("%02d", j), Sec: "00",
+				RemoteAddr: ip, UserAgent: "Mozilla/5.0", GUID: "-", Method: "GET", HttpCode: "200",
+				RequestURI: fmt.Sprintf("/prop/view/%d", j), Referer: referer}
+			lines = append(lines, accesslog.String())
+		}
+	}
+	plainFile := filepath.Join(dir, "access.log")
+	if err := ioutil.WriteFile(plainFile, []byte(strings.Join(lines[:120], "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gzipFile := filepath.Join(dir, "access.log.1.gz")
+	file, err := os.Create(gzipFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := gzip.NewWriter(file)
+	writer.Write([]byte(strings.Join(lines[120:], "\n") + "\n"))
+	writer.Close()
+	file.Close()
+	labelFile := filepath.Join(dir, "labels.csv")
+	if err := ioutil.WriteFile(labelFile, []byte(labels), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modelPath := filepath.Join(dir, "model.json")
+	err = TrainCommand([]string{"-conf", confFile, "-format", "tsv", "-labels", labelFile, "-min-leaf", "2",
+		"-version", "test-1", "-out", modelPath, plainFile, gzipFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	classifier, modelFile, err := LoadClassifier(modelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modelFile.Version != "test-1" || modelFile.Format != modelFormat || modelFile.Type != "decision_tree" {
+		t.Errorf("model file is %+v", modelFile)
+	}
+	if human := classifier.HumanProbability(SessionFeatures{Requests: 6, EmptyRefererRatio: 1}); human > 0.1 {
+		t.Errorf("a robot session got %v", human)
+	}
+	if human := classifier.HumanProbability(SessionFeatures{Requests: 6}); human < 0.9 {
+		t.Errorf("a human session got %v", human)
+	}
+}
+
+func TestHoldoutSplit(t *testing.T) {
+	samples := trainingSamples(100)
+	for i := range samples {
+		samples[i].Features.RemoteAddr = fmt.Sprintf("10.0.0.%d", i%10)
+	}
+	training, testing := HoldoutSplit(samples, 0.2, 1)
+	if len(training) != 80 || len(testing) != 20 {
+		t.Fatalf("split %d and %d sessions", len(training), len(testing))
+	}
+	trained := map[string]bool{}
+	for _, sample := range training {
+		trained[sample.Features.RemoteAddr] = true
+	}
+	for _, sample := range testing {
+		if trained[sample.Features.RemoteAddr] {
+			t.Errorf("%s is trained and tested", sample.Features.RemoteAddr)
+		}
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
-	"log"
-	"os"
+	"fmt"
+	"io/ioutil"
 	"regexp"
 )
 
@@ -19,20 +17,35 @@ type UAParser struct {
 	regexp          *regexp.Regexp
 }
 
-var UAParsers = []UAParser{}
+// UAParserList is a list of UA parsers tried in order
+type UAParserList []UAParser
 
-func InitUAParsers(pattern_file string) {
-	userAgentParserPatterns := LoadPattern(pattern_file)
-	for _, pattern := range userAgentParserPatterns {
-		regexp, _ := regexp.Compile(pattern.RegexpString)
-		uaParser := UAParser{uAParserPattern: pattern, regexp: regexp}
-		UAParsers = append(UAParsers, uaParser)
+// NewUAParsers compiles the UA patterns
+func NewUAParsers(patterns []UAParserPattern) (UAParserList, error) {
+	uaParsers := make(UAParserList, 0, len(patterns))
+	for _, pattern := range patterns {
+		regexp, err := regexp.Compile(pattern.RegexpString)
+		if err != nil {
+			return nil, fmt.Errorf("UA pattern %q: %s", pattern.RegexpString, err)
+		}
+		uaParsers = append(uaParsers, UAParser{uAParserPattern: pattern, regexp: regexp})
+	}
+	return uaParsers, nil
+}
+
+// Patterns return the patterns the parsers are compiled from
+func (uaParsers UAParserList) Patterns() []UAParserPattern {
+	patterns := make([]UAParserPattern, len(uaParsers))
+	for i, uaParser := range uaParsers {
+		patterns[i] = uaParser.uAParserPattern
 	}
+	return patterns
 }
 
-func Parse(ua string) string {
+// Parse return the family of the first parser matching ua, or "" if none
+func (uaParsers UAParserList) Parse(ua string) string {
 	var uaFamily string
-	for _, uaParser := range UAParsers {
+	for _, uaParser := range uaParsers {
 		uaFamily = uaParser.Parse(ua)
 		if uaFamily != "" {
 			break
@@ -52,32 +65,15 @@ func (uaParser *UAParser) Parse(ua string) string {
 	return "" // no matchs
 }
 
-func LoadPattern(filename string) []UAParserPattern {
+// ReadPattern reads the user agent patterns file
+func ReadPattern(filename string) ([]UAParserPattern, error) {
 	var userAgentParserPatterns []UAParserPattern
-	file, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer file.Close()
-	patternReader := bufio.NewReader(file)
-	var content string
-	for {
-		line, err := patternReader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				content = content + line
-				break
-			}
-			log.Fatal(err)
-		} else {
-			content = content + line
-		}
+	if err := json.Unmarshal(data, &userAgentParserPatterns); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
 	}
-	temp := []byte(content)
-	err = json.Unmarshal(temp, &userAgentParserPatterns)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return userAgentParserPatterns
+	return userAgentParserPatterns, nil
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// TrafficClass is who made a record: a user, a normal robot such as a
+// verified search engine crawler, or an abnormal crawler
+type TrafficClass int
+
+const (
+	Unclassified TrafficClass = iota // not decided, such as a watched record
+	Human
+	GoodRobot
+	BadRobot
+)
+
+var trafficClassNames = []string{"unclassified", "human", "good_robot", "bad_robot"}
+
+func (class TrafficClass) String() string {
+	if class < 0 || int(class) >= len(trafficClassNames) {
+		return trafficClassNames[Unclassified]
+	}
+	return trafficClassNames[class]
+}
+
+// ParseTrafficClass return the class of a name of TrafficClass.String
+func ParseTrafficClass(name string) (TrafficClass, error) {
+	for class, className := range trafficClassNames {
+		if name == className {
+			return TrafficClass(class), nil
+		}
+	}
+	return Unclassified, fmt.Errorf("unknown class %q, it is human, good_robot, bad_robot or unclassified", name)
+}
+
+// resultClass is the class of a result when the rule does not name one
+func resultClass(result int) TrafficClass {
+	switch result {
+	case YES:
+		return Human
+	case NO:
+		return BadRobot
+	}
+	return Unclassified
+}
+
+// Verdict is what the filter decides for a record. Result tells whether it is
+// an effective view, Class who made it, Reason is the deciding rule and
+// Confidence how sure the rule is of the class, 0 for Unclassified. A Watched
+// record is exported once its watching list is resolved or expires.
+type Verdict struct {
+	Result     int
+	Class      TrafficClass
+	Reason     string
+	Confidence float64
+	Watched    bool
+}
+
+// String return the columns the exported records end with: the result, the
+// class, the reason ("-" if none) and the confidence
+func (verdict Verdict) String() string {
+	reason := verdict.Reason
+	if reason == "" {
+		reason = "-"
+	}
+	return VerdictString(verdict.Result) + "\t" + verdict.Class.String() + "\t" + reason + "\t" + strconv.FormatFloat(verdict.Confidence, 'f', 2, 64)
+}
+
+// classCounter is the per minute counter of the records of class
+func classCounter(class TrafficClass) string {
+	return "accesslog_result_class_" + class.String() + "_per_min"
+}
+
+// CountClass counts a record of logTimeMin in the counter of its class
+func CountClass(counters *CounterBatch, logTimeMin string, class TrafficClass) {
+	counters.HashIncrby(classCounter(class), logTimeMin, 1)
+}
+
+// Reclassify moves a record of logTimeMin from the counter of a class to
+// another, when a watched record is resolved
+func Reclassify(counters *CounterBatch, logTimeMin string, from TrafficClass, to TrafficClass) {
+	if from == to {
+		return
+	}
+	counters.HashIncrby(classCounter(from), logTimeMin, -1)
+	counters.HashIncrby(classCounter(to), logTimeMin, 1)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVerdict(t *testing.T) {
+	pipeline, err := NewRulePipeline([]RuleConf{
+		{Name: "crawler", Field: "UserAgent", Op: "contains", Value: "Googlebot",
+			OnMatch: RuleOutcome{Result: "UNKNOWN", Class: "good_robot", Confidence: 0.8}},
+		{Name: "head", Field: "Method", Op: "in", Values: []string{"HEAD"}, OnMatch: RuleOutcome{Result: "NO"}},
+		{Name: "get", Field: "Method", Op: "in", Values: []string{"GET"}, OnMatch: RuleOutcome{Result: "YES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method    string
+		userAgent string
+		want      string
+	}{
+		{"GET", "Googlebot/2.1", "UNKNOWN\tgood_robot\tcrawler\t0.80"},
+		{"HEAD", "curl/7.29.0", "NO\tbad_robot\thead\t1.00"},
+		{"GET", "Chrome/28", "YES\thuman\tget\t1.00"},
+		{"POST", "Chrome/28", "UNKNOWN\tunclassified\t-\t0.00"},
+	} {
+		accesslog := AccessLog{Method: c.method, UserAgent: c.userAgent}
+		if verdict := pipeline.Run(&Runtime{}, &FilterConns{}, &accesslog); verdict.String() != c.want {
+			t.Errorf("%s %s got %q", c.method, c.userAgent, verdict)
+		}
+	}
+
+	for _, class := range []TrafficClass{Unclassified, Human, GoodRobot, BadRobot} {
+		if parsed, err := ParseTrafficClass(class.String()); err != nil || parsed != class {
+			t.Errorf("%s got %s %v", class, parsed, err)
+		}
+	}
+
+	counters := NewMemoryCounterBatch()
+	CountClass(counters, "2013-07-09 15:20", Unclassified)
+	Reclassify(counters, "2013-07-09 15:20", Unclassified, Human)
+	counts := counters.Counts()
+	if counts["accesslog_result_class_unclassified_per_min"]["2013-07-09 15:20"] != 0 || counts["accesslog_result_class_human_per_min"]["2013-07-09 15:20"] != 1 {
+		t.Errorf("counters are %v", counts)
+	}
+}